@@ -1,11 +1,13 @@
 package main
 
 import (
-	"bufio"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/thesephist/ink/pkg/ink"
@@ -26,6 +28,20 @@ Start an interactive repl.
 	>
 Run from the command line with -eval.
 	ink -eval "f := () => out('hi'), f()"
+Type check a program without running it.
+	ink -check main.ink
+Report likely mistakes in a program without running it.
+	ink vet [-disable=rule,...] main.ink
+Print the syntax tree of a program as JSON.
+	ink -ast-json main.ink
+Profile a program, for use with go tool pprof.
+	ink -profile=out.pprof main.ink
+Record a timeline of a program's callbacks, for Perfetto or chrome://tracing.
+	ink -trace=trace.json [-trace-calls] main.ink
+Run test functions in all *_test.ink files in a directory.
+	ink test [-format=text|tap|junit] [-cover] [dir]
+Step through a program in a debugger, or serve a debug adapter for editors.
+	ink debug [-dap=localhost:4711] main.ink
 
 `
 
@@ -53,12 +69,33 @@ func main() {
 
 	repl := flag.Bool("repl", false, "Run as an interactive repl")
 	eval := flag.String("eval", "", "Evaluate argument as an Ink program")
+	check := flag.Bool("check", false, "Type check an Ink program without running it")
+	astJSON := flag.Bool("ast-json", false, "Print the syntax tree of an Ink program as JSON")
+	profile := flag.String("profile", "", "Write a pprof profile of Ink functions to this file")
+	trace := flag.String("trace", "", "Write a trace of execution in the Chrome trace event format to this file")
+	traceCalls := flag.Bool("trace-calls", false, "Also trace every Ink function call, with -trace")
 
 	flag.Parse()
 
 	// collect all other non-parsed arguments from the CLI as files to be run
 	args := flag.Args()
 
+	perms := ink.PermissionsConfig{
+		Read:  !*noRead && !*isolate,
+		Write: !*noWrite && !*isolate,
+		Net:   !*noNet && !*isolate,
+		Exec:  !*noExec && !*isolate,
+	}
+
+	// subcommands
+	if len(args) > 0 && args[0] == "vet" {
+		os.Exit(vet(args[1:]))
+	} else if len(args) > 0 && args[0] == "test" {
+		os.Exit(runTests(args[1:], perms))
+	} else if len(args) > 0 && args[0] == "debug" {
+		os.Exit(debug(args[1:], perms))
+	}
+
 	// if asked for version, disregard everything else
 	if *version {
 		fmt.Printf("ink v%s\n", cliVersion)
@@ -66,6 +103,18 @@ func main() {
 	} else if *help {
 		flag.Usage()
 		return
+	} else if *check {
+		filePath := ""
+		if len(args) > 0 {
+			filePath = args[0]
+		}
+		os.Exit(typeCheck(filePath))
+	} else if *astJSON {
+		filePath := ""
+		if len(args) > 0 {
+			filePath = args[0]
+		}
+		os.Exit(printASTJSON(filePath))
 	}
 
 	// if no files given and no stdin, default to repl
@@ -76,13 +125,8 @@ func main() {
 
 	// execution environment
 	eng := ink.Engine{
-		FatalError: false,
-		Permissions: ink.PermissionsConfig{
-			Read:  !*noRead && !*isolate,
-			Write: !*noWrite && !*isolate,
-			Net:   !*noNet && !*isolate,
-			Exec:  !*noExec && !*isolate,
-		},
+		FatalError:  false,
+		Permissions: perms,
 		Debug: ink.DebugConfig{
 			Lex:   *debugLexer || *verbose,
 			Parse: *debugParser || *verbose,
@@ -90,45 +134,23 @@ func main() {
 		},
 	}
 
-	if *repl {
-		ctx := eng.CreateContext()
+	var profiler *ink.Profiler
+	if *profile != "" && !*repl {
+		profiler = ink.NewProfiler()
+		eng.Profiler = profiler
+		profiler.Start()
+	}
 
-		// add repl-specific builtins
-		ctx.LoadFunc("clear", func(ctx *ink.Context, in []ink.Value) (ink.Value, error) {
-			fmt.Printf("[2J[H")
-			return ink.Null, nil
-		})
-		ctx.LoadFunc("dump", func(ctx *ink.Context, in []ink.Value) (ink.Value, error) {
-			ctx.Dump()
-			return ink.Null, nil
-		})
+	var tracer *ink.Tracer
+	if *trace != "" && !*repl {
+		tracer = ink.NewTracer()
+		tracer.Calls = *traceCalls
+		eng.Tracer = tracer
+	}
 
+	if *repl {
 		// run interactively in a repl
-		reader := bufio.NewReader(os.Stdin)
-
-		for {
-			// green arrow
-			fmt.Printf(ink.AnsiGreenBold + "> " + ink.AnsiReset)
-			text, err := reader.ReadString('\n')
-
-			if err == io.EOF {
-				break
-			} else if err != nil {
-				ink.LogErrf(
-					ink.ErrSystem,
-					"unexpected end of input:\n\t-> %s", err.Error(),
-				)
-			}
-
-			// we don't really care if expressions fail to eval
-			// at the top level, user will see regardless, so drop err
-			val, _ := ctx.Exec(strings.NewReader(text))
-			if val != nil {
-				ink.LogInteractive(val.String())
-			}
-		}
-
-		// unreachable
+		ink.NewREPL(&eng, os.Stdin, os.Stdout, historyPath()).Run()
 	} else if *eval != "" {
 		eng.FatalError = true
 
@@ -148,4 +170,385 @@ func main() {
 	}
 
 	eng.Listeners.Wait()
+
+	if profiler != nil {
+		profiler.Stop()
+		err := writeProfile(profiler, *profile)
+		if err != nil {
+			ink.LogErrf(ink.ErrSystem, "could not write profile:\n\t-> %s", err)
+		}
+	}
+	if tracer != nil {
+		err := writeTrace(tracer, *trace)
+		if err != nil {
+			ink.LogErrf(ink.ErrSystem, "could not write trace:\n\t-> %s", err)
+		}
+	}
+}
+
+// historyPath returns the path of the file in which the repl saves
+// its history, from $INK_HISTORY or in the user's home directory.
+func historyPath() string {
+	if path, ok := os.LookupEnv("INK_HISTORY"); ok {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".ink_history")
+}
+
+// writeProfile writes the samples taken by a profiler to a file
+// in the pprof format.
+func writeProfile(profiler *ink.Profiler, path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return profiler.WriteProfile(file)
+}
+
+// writeTrace writes the events recorded by a tracer to a file as JSON.
+func writeTrace(tracer *ink.Tracer, path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return tracer.WriteTrace(file)
+}
+
+// debug runs the Ink program named in args in a debugger, driven from the
+// terminal or by a Debug Adapter Protocol client. It returns the exit code.
+func debug(args []string, perms ink.PermissionsConfig) int {
+	flags := flag.NewFlagSet("debug", flag.ExitOnError)
+	dapAddr := flags.String("dap", "", "Serve the Debug Adapter Protocol at this address, instead of reading commands from the terminal")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		ink.LogSafeErr(ink.ErrSystem, "ink debug needs a program to debug")
+		return ink.ErrSystem
+	}
+	filePath := flags.Arg(0)
+
+	eng := ink.Engine{
+		Permissions: perms,
+	}
+
+	var server *ink.DAPServer
+	if *dapAddr != "" {
+		listener, err := net.Listen("tcp", *dapAddr)
+		if err != nil {
+			ink.LogSafeErr(ink.ErrSystem, fmt.Sprintf("could not listen at %s:\n\t-> %s", *dapAddr, err))
+			return ink.ErrSystem
+		}
+		fmt.Fprintf(os.Stderr, "waiting for a debug adapter client at %s\n", listener.Addr())
+		conn, err := listener.Accept()
+		listener.Close()
+		if err != nil {
+			ink.LogSafeErr(ink.ErrSystem, fmt.Sprintf("could not accept a client:\n\t-> %s", err))
+			return ink.ErrSystem
+		}
+		defer conn.Close()
+
+		server = ink.NewDAPServer(conn)
+		eng.Hook = server.Debugger()
+		server.Serve()
+	} else {
+		fmt.Printf("debugging %s, type help for a list of commands\n", filePath)
+		frontend := ink.NewTerminalDebugger(os.Stdin, os.Stdout, filePath)
+		eng.Hook = ink.NewDebugger(frontend, true)
+	}
+
+	ctx := eng.CreateContext()
+	err := ctx.ExecPath(filePath)
+	eng.Listeners.Wait()
+
+	exitCode := 0
+	if err != nil {
+		exitCode = 1
+	}
+	if server != nil {
+		server.Exited(exitCode)
+	}
+	return exitCode
+}
+
+// runTests runs all Ink tests in the directory or file named in args, or the
+// current directory if none is given, and reports the results. It returns
+// the exit code, which is non-zero if any test failed.
+func runTests(args []string, perms ink.PermissionsConfig) int {
+	flags := flag.NewFlagSet("test", flag.ExitOnError)
+	format := flags.String("format", "text", "Report format: text, tap, or junit")
+	outPath := flags.String("o", "", "Write the report to a file instead of stdout")
+	cover := flags.Bool("cover", false, "Record test coverage of Ink source files")
+	coverProfile := flags.String("coverprofile", "coverage.lcov", "Write coverage in lcov format to this file, with -cover")
+	coverHTML := flags.String("coverhtml", "coverage.html", "Write coverage as annotated HTML to this file, with -cover")
+	flags.Parse(args)
+
+	root := "."
+	if flags.NArg() > 0 {
+		root = flags.Arg(0)
+	}
+
+	files, err := ink.FindTestFiles(root)
+	if err != nil {
+		ink.LogSafeErr(ink.ErrSystem, fmt.Sprintf("could not find tests in %s:\n\t-> %s", root, err))
+		return ink.ErrSystem
+	}
+
+	var coverage *ink.Coverage
+	var hook ink.EvalHook
+	if *cover {
+		coverage = ink.NewCoverage()
+		hook = coverage
+	}
+
+	results := make([]ink.TestResult, 0)
+	exitCode := 0
+	for _, file := range files {
+		fileResults, err := ink.RunTestFile(file, perms, hook)
+		if err != nil {
+			ink.LogSafeErr(ink.ErrSyntax, err.Error())
+			exitCode = 1
+			continue
+		}
+		results = append(results, fileResults...)
+	}
+	for _, r := range results {
+		if !r.Passed() {
+			exitCode = 1
+		}
+	}
+
+	var out io.Writer = os.Stdout
+	if *outPath != "" {
+		file, err := os.Create(*outPath)
+		if err != nil {
+			ink.LogSafeErr(ink.ErrSystem, fmt.Sprintf("could not create %s:\n\t-> %s", *outPath, err))
+			return ink.ErrSystem
+		}
+		defer file.Close()
+		out = file
+	}
+
+	switch *format {
+	case "text":
+		ink.WriteTestReport(out, results)
+	case "tap":
+		ink.WriteTAP(out, results)
+	case "junit":
+		err = ink.WriteJUnit(out, results)
+		if err != nil {
+			ink.LogSafeErr(ink.ErrSystem, fmt.Sprintf("could not write report:\n\t-> %s", err))
+			return ink.ErrSystem
+		}
+	default:
+		ink.LogSafeErr(ink.ErrUnknown, fmt.Sprintf("unknown report format %s", *format))
+		return 2
+	}
+
+	if coverage != nil {
+		err := writeCoverage(coverage, *coverProfile, *coverHTML)
+		if err != nil {
+			ink.LogSafeErr(ink.ErrSystem, fmt.Sprintf("could not write coverage:\n\t-> %s", err))
+			return ink.ErrSystem
+		}
+	}
+
+	return exitCode
+}
+
+// writeCoverage writes a coverage report in lcov and HTML formats to the
+// given paths, and prints a summary of coverage to stderr, so it does not
+// mix with test reports on stdout.
+func writeCoverage(coverage *ink.Coverage, lcovPath, htmlPath string) error {
+	writeFile := func(path string, write func(io.Writer) error) error {
+		file, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		return write(file)
+	}
+
+	err := writeFile(lcovPath, coverage.WriteLcov)
+	if err != nil {
+		return err
+	}
+	err = writeFile(htmlPath, coverage.WriteHTML)
+	if err != nil {
+		return err
+	}
+
+	summary, err := coverage.Summary()
+	if err != nil {
+		return err
+	}
+	for _, line := range summary {
+		fmt.Fprintf(os.Stderr, "coverage: %s\n", line)
+	}
+	fmt.Fprintf(os.Stderr, "coverage: wrote %s and %s\n", lcovPath, htmlPath)
+	return nil
+}
+
+// vet parses the Ink program named in args, or from stdin if no path is
+// given, and reports likely mistakes in it. It returns the exit code.
+func vet(args []string) int {
+	flags := flag.NewFlagSet("vet", flag.ExitOnError)
+	disable := flags.String("disable", "", "Comma-separated IDs of rules to skip")
+	enable := flags.String("enable", "", "Comma-separated IDs of the only rules to check")
+	flags.Usage = func() {
+		out := flags.Output()
+		fmt.Fprintf(out, "Report likely mistakes in an Ink program without running it.\n")
+		fmt.Fprintf(out, "\tink vet [-disable=rule,...] [-enable=rule,...] main.ink\n\n")
+		fmt.Fprintf(out, "Rules:\n")
+		for _, rule := range ink.VetRules {
+			fmt.Fprintf(out, "  %s\n\t%s\n", rule.ID, rule.Description)
+		}
+		fmt.Fprintf(out, "\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	known := map[string]bool{}
+	for _, rule := range ink.VetRules {
+		known[rule.ID] = true
+	}
+	parseRules := func(list string) (map[string]bool, bool) {
+		rules := map[string]bool{}
+		for _, id := range strings.Split(list, ",") {
+			id = strings.TrimSpace(id)
+			if id == "" {
+				continue
+			}
+			if !known[id] {
+				fmt.Fprintf(flags.Output(), "unknown vet rule %s\n\n", id)
+				flags.Usage()
+				return nil, false
+			}
+			rules[id] = true
+		}
+		return rules, true
+	}
+
+	disabled, ok := parseRules(*disable)
+	if !ok {
+		return 1
+	}
+	if *enable != "" {
+		enabled, ok := parseRules(*enable)
+		if !ok {
+			return 1
+		}
+		for id := range known {
+			if !enabled[id] {
+				disabled[id] = true
+			}
+		}
+	}
+
+	filePath := ""
+	if flags.NArg() > 0 {
+		filePath = flags.Arg(0)
+	}
+	return runDiagnostics(filePath, func(nodes []ink.Node) []ink.Diagnostic {
+		return ink.Vet(nodes, disabled)
+	})
+}
+
+// typeCheck parses and type checks the Ink program at filePath, or from
+// stdin if no path is given, and logs any errors found. It returns the
+// reason for the first error found, which is used as the exit code.
+func typeCheck(filePath string) int {
+	return runDiagnostics(filePath, ink.Check)
+}
+
+// printASTJSON parses the Ink program at filePath, or from stdin if no path is
+// given, and prints its syntax tree as JSON. It returns the exit code.
+func printASTJSON(filePath string) int {
+	var nodes []ink.Node
+	code := runDiagnostics(filePath, func(parsed []ink.Node) []ink.Diagnostic {
+		nodes = parsed
+		return nil
+	})
+	if code != 0 {
+		return code
+	}
+
+	data, err := ink.MarshalNodes(nodes)
+	if err != nil {
+		ink.LogSafeErr(ink.ErrSystem, fmt.Sprintf("could not serialize syntax tree:\n\t-> %s", err))
+		return ink.ErrSystem
+	}
+	fmt.Println(string(data))
+	return 0
+}
+
+// runDiagnostics parses the Ink program at filePath, or from stdin if no path
+// is given, and logs any syntax errors or diagnostics reported by analyze.
+// A path ending in .json is read as a syntax tree printed by -ast-json.
+// It returns the reason for the first error found, which is used as the
+// exit code.
+func runDiagnostics(filePath string, analyze func([]ink.Node) []ink.Diagnostic) int {
+	if strings.HasSuffix(filePath, ".json") {
+		data, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			ink.LogSafeErr(
+				ink.ErrSystem,
+				fmt.Sprintf("could not open %s for analysis:\n\t-> %s", filePath, err),
+			)
+			return ink.ErrSystem
+		}
+		nodes, err := ink.UnmarshalNodes(data)
+		if err != nil {
+			ink.LogSafeErr(
+				ink.ErrSyntax,
+				fmt.Sprintf("could not read syntax tree in %s:\n\t-> %s", filePath, err),
+			)
+			return ink.ErrSyntax
+		}
+		return logDiagnostics(filePath, analyze(nodes))
+	}
+
+	var input io.Reader = os.Stdin
+	if filePath != "" {
+		file, err := os.Open(filePath)
+		if err != nil {
+			ink.LogSafeErr(
+				ink.ErrSystem,
+				fmt.Sprintf("could not open %s for analysis:\n\t-> %s", filePath, err),
+			)
+			return ink.ErrSystem
+		}
+		defer file.Close()
+		input = file
+	}
+
+	nodes, diagnostics := ink.ParseAll(input)
+	if len(diagnostics) == 0 {
+		diagnostics = analyze(nodes)
+	}
+	return logDiagnostics(filePath, diagnostics)
+}
+
+// logDiagnostics logs diagnostics found in the program at filePath, and
+// returns the reason for the first, or 0 if there are none.
+func logDiagnostics(filePath string, diagnostics []ink.Diagnostic) int {
+	for _, d := range diagnostics {
+		msg := d.Message
+		if filePath != "" {
+			msg += " in " + filePath
+		}
+		ink.LogSafeErr(d.Reason, msg)
+	}
+
+	if len(diagnostics) > 0 {
+		return diagnostics[0].Reason
+	}
+	return 0
 }
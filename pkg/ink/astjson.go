@@ -0,0 +1,442 @@
+package ink
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// jsonNode is the JSON representation of a Node. Every node has a type
+// and the position of the node in its source, and the rest of the fields
+// are set depending on the type of the node.
+type jsonNode struct {
+	Type string `json:"type"`
+	Line int    `json:"line"`
+	Col  int    `json:"col"`
+
+	Operator   string          `json:"operator,omitempty"`
+	Name       string          `json:"name,omitempty"`
+	Annotation string          `json:"annotation,omitempty"`
+	Value      json.RawMessage `json:"value,omitempty"`
+
+	Operand     *jsonNode   `json:"operand,omitempty"`
+	Left        *jsonNode   `json:"left,omitempty"`
+	Right       *jsonNode   `json:"right,omitempty"`
+	Function    *jsonNode   `json:"function,omitempty"`
+	Arguments   []*jsonNode `json:"arguments,omitempty"`
+	Condition   *jsonNode   `json:"condition,omitempty"`
+	Clauses     []*jsonNode `json:"clauses,omitempty"`
+	Target      *jsonNode   `json:"target,omitempty"`
+	Expression  *jsonNode   `json:"expression,omitempty"`
+	Expressions []*jsonNode `json:"expressions,omitempty"`
+	Entries     []*jsonNode `json:"entries,omitempty"`
+	Key         *jsonNode   `json:"key,omitempty"`
+	Val         *jsonNode   `json:"val,omitempty"`
+	Values      []*jsonNode `json:"values,omitempty"`
+	Body        *jsonNode   `json:"body,omitempty"`
+}
+
+// operators that may appear in unary and binary expressions
+var jsonOperators = []Kind{
+	NegationOp,
+	AddOp, SubtractOp, MultiplyOp, DivideOp, ModulusOp,
+	LogicalAndOp, LogicalOrOp, LogicalXorOp,
+	GreaterThanOp, LessThanOp, EqualOp, DefineOp, AccessorOp,
+}
+
+func operatorSymbol(op Kind) string {
+	return strings.Trim(op.String(), "'")
+}
+
+func operatorKind(symbol string) (Kind, error) {
+	for _, op := range jsonOperators {
+		if operatorSymbol(op) == symbol {
+			return op, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown operator %s", symbol)
+}
+
+// MarshalNodes serializes a list of AST nodes, like a program returned by
+// ParseAll, to a JSON array. Nodes are serialized with their positions in
+// the source, so they can be analyzed by external tools.
+func MarshalNodes(nodes []Node) ([]byte, error) {
+	jsonNodes, err := toJSONNodes(nodes)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonNodes)
+}
+
+// UnmarshalNodes deserializes a list of AST nodes serialized by
+// MarshalNodes, which can then be evaluated.
+func UnmarshalNodes(data []byte) ([]Node, error) {
+	var jsonNodes []*jsonNode
+	err := json.Unmarshal(data, &jsonNodes)
+	if err != nil {
+		return nil, err
+	}
+	return fromJSONNodes(jsonNodes)
+}
+
+// MarshalNode serializes a single AST node to a JSON object.
+func MarshalNode(n Node) ([]byte, error) {
+	jn, err := toJSONNode(n)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(jn)
+}
+
+// UnmarshalNode deserializes a single AST node serialized by MarshalNode.
+func UnmarshalNode(data []byte) (Node, error) {
+	var jn jsonNode
+	err := json.Unmarshal(data, &jn)
+	if err != nil {
+		return nil, err
+	}
+	return fromJSONNode(&jn)
+}
+
+func toJSONNodes(nodes []Node) ([]*jsonNode, error) {
+	jsonNodes := make([]*jsonNode, len(nodes))
+	for i, n := range nodes {
+		jn, err := toJSONNode(n)
+		if err != nil {
+			return nil, err
+		}
+		jsonNodes[i] = jn
+	}
+	return jsonNodes, nil
+}
+
+func toJSONNode(node Node) (*jsonNode, error) {
+	pos := node.Position()
+	jn := &jsonNode{Line: pos.line, Col: pos.col}
+
+	var err error
+	switch n := node.(type) {
+	case UnaryExprNode:
+		jn.Type = "UnaryExpr"
+		jn.Operator = operatorSymbol(n.operator)
+		jn.Operand, err = toJSONNode(n.operand)
+	case BinaryExprNode:
+		jn.Type = "BinaryExpr"
+		jn.Operator = operatorSymbol(n.operator)
+		jn.Left, err = toJSONNode(n.leftOperand)
+		if err != nil {
+			return nil, err
+		}
+		jn.Right, err = toJSONNode(n.rightOperand)
+	case FunctionCallNode:
+		jn.Type = "FunctionCall"
+		jn.Function, err = toJSONNode(n.function)
+		if err != nil {
+			return nil, err
+		}
+		jn.Arguments, err = toJSONNodes(n.arguments)
+	case MatchClauseNode:
+		jn.Type = "MatchClause"
+		jn.Target, err = toJSONNode(n.target)
+		if err != nil {
+			return nil, err
+		}
+		jn.Expression, err = toJSONNode(n.expression)
+	case MatchExprNode:
+		jn.Type = "MatchExpr"
+		jn.Condition, err = toJSONNode(n.condition)
+		if err != nil {
+			return nil, err
+		}
+		jn.Clauses = make([]*jsonNode, len(n.clauses))
+		for i, cl := range n.clauses {
+			jn.Clauses[i], err = toJSONNode(cl)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case ExpressionListNode:
+		jn.Type = "ExpressionList"
+		jn.Expressions, err = toJSONNodes(n.expressions)
+	case EmptyIdentifierNode:
+		jn.Type = "EmptyIdentifier"
+	case IdentifierNode:
+		jn.Type = "Identifier"
+		jn.Name = n.val
+		if n.annotation != nil {
+			jn.Annotation = n.annotation.String()
+		}
+	case NumberLiteralNode:
+		jn.Type = "NumberLiteral"
+		jn.Value, err = json.Marshal(n.val)
+	case StringLiteralNode:
+		jn.Type = "StringLiteral"
+		jn.Value, err = json.Marshal(n.val)
+	case BooleanLiteralNode:
+		jn.Type = "BooleanLiteral"
+		jn.Value, err = json.Marshal(n.val)
+	case ObjectLiteralNode:
+		jn.Type = "ObjectLiteral"
+		jn.Entries = make([]*jsonNode, len(n.entries))
+		for i, entry := range n.entries {
+			je := &jsonNode{
+				Type: "ObjectEntry",
+				Line: entry.position.line,
+				Col:  entry.position.col,
+			}
+			je.Key, err = toJSONNode(entry.key)
+			if err != nil {
+				return nil, err
+			}
+			je.Val, err = toJSONNode(entry.val)
+			if err != nil {
+				return nil, err
+			}
+			jn.Entries[i] = je
+		}
+	case ListLiteralNode:
+		jn.Type = "ListLiteral"
+		jn.Values, err = toJSONNodes(n.vals)
+	case FunctionLiteralNode:
+		jn.Type = "FunctionLiteral"
+		jn.Arguments, err = toJSONNodes(n.arguments)
+		if err != nil {
+			return nil, err
+		}
+		jn.Body, err = toJSONNode(n.body)
+	default:
+		return nil, fmt.Errorf("cannot serialize unknown node %s", node)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return jn, nil
+}
+
+func fromJSONNodes(jsonNodes []*jsonNode) ([]Node, error) {
+	nodes := make([]Node, len(jsonNodes))
+	for i, jn := range jsonNodes {
+		n, err := fromJSONNode(jn)
+		if err != nil {
+			return nil, err
+		}
+		nodes[i] = n
+	}
+	return nodes, nil
+}
+
+// fromJSONNode deserializes a JSON node, validating that it has every
+// field required for its type.
+func fromJSONNode(jn *jsonNode) (Node, error) {
+	if jn == nil {
+		return nil, fmt.Errorf("missing node")
+	}
+
+	pos := position{jn.Line, jn.Col}
+	switch jn.Type {
+	case "UnaryExpr":
+		op, err := operatorKind(jn.Operator)
+		if err != nil {
+			return nil, err
+		}
+		operand, err := fromJSONNode(jn.Operand)
+		if err != nil {
+			return nil, err
+		}
+		return UnaryExprNode{
+			operator: op,
+			operand:  operand,
+			position: pos,
+		}, nil
+	case "BinaryExpr":
+		op, err := operatorKind(jn.Operator)
+		if err != nil {
+			return nil, err
+		}
+		left, err := fromJSONNode(jn.Left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := fromJSONNode(jn.Right)
+		if err != nil {
+			return nil, err
+		}
+		return BinaryExprNode{
+			operator:     op,
+			leftOperand:  left,
+			rightOperand: right,
+			position:     pos,
+		}, nil
+	case "FunctionCall":
+		fn, err := fromJSONNode(jn.Function)
+		if err != nil {
+			return nil, err
+		}
+		args, err := fromJSONNodes(jn.Arguments)
+		if err != nil {
+			return nil, err
+		}
+		return FunctionCallNode{
+			function:  fn,
+			arguments: args,
+		}, nil
+	case "MatchClause":
+		return matchClauseFromJSON(jn)
+	case "MatchExpr":
+		condition, err := fromJSONNode(jn.Condition)
+		if err != nil {
+			return nil, err
+		}
+		clauses := make([]MatchClauseNode, len(jn.Clauses))
+		for i, jcl := range jn.Clauses {
+			clauses[i], err = matchClauseFromJSON(jcl)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return MatchExprNode{
+			condition: condition,
+			clauses:   clauses,
+			position:  pos,
+		}, nil
+	case "ExpressionList":
+		exprs, err := fromJSONNodes(jn.Expressions)
+		if err != nil {
+			return nil, err
+		}
+		return ExpressionListNode{
+			expressions: exprs,
+			position:    pos,
+		}, nil
+	case "EmptyIdentifier":
+		return EmptyIdentifierNode{pos}, nil
+	case "Identifier":
+		if jn.Name == "" {
+			return nil, fmt.Errorf("identifier at %s has no name", pos)
+		}
+		ident := IdentifierNode{val: jn.Name, position: pos}
+		if jn.Annotation != "" {
+			annotation, err := parseAnnotationString(jn.Annotation)
+			if err != nil {
+				return nil, err
+			}
+			ident.annotation = &annotation
+		}
+		return ident, nil
+	case "NumberLiteral":
+		var val float64
+		err := json.Unmarshal(jn.Value, &val)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number literal at %s: %s", pos, err)
+		}
+		return NumberLiteralNode{val, pos}, nil
+	case "StringLiteral":
+		var val string
+		err := json.Unmarshal(jn.Value, &val)
+		if err != nil {
+			return nil, fmt.Errorf("invalid string literal at %s: %s", pos, err)
+		}
+		return StringLiteralNode{val, pos}, nil
+	case "BooleanLiteral":
+		var val bool
+		err := json.Unmarshal(jn.Value, &val)
+		if err != nil {
+			return nil, fmt.Errorf("invalid boolean literal at %s: %s", pos, err)
+		}
+		return BooleanLiteralNode{val, pos}, nil
+	case "ObjectLiteral":
+		entries := make([]ObjectEntryNode, len(jn.Entries))
+		for i, je := range jn.Entries {
+			if je == nil {
+				return nil, fmt.Errorf("missing composite entry at %s", pos)
+			}
+			key, err := fromJSONNode(je.Key)
+			if err != nil {
+				return nil, err
+			}
+			val, err := fromJSONNode(je.Val)
+			if err != nil {
+				return nil, err
+			}
+			entries[i] = ObjectEntryNode{
+				key:      key,
+				val:      val,
+				position: position{je.Line, je.Col},
+			}
+		}
+		return ObjectLiteralNode{
+			entries:  entries,
+			position: pos,
+		}, nil
+	case "ListLiteral":
+		vals, err := fromJSONNodes(jn.Values)
+		if err != nil {
+			return nil, err
+		}
+		return ListLiteralNode{
+			vals:     vals,
+			position: pos,
+		}, nil
+	case "FunctionLiteral":
+		args, err := fromJSONNodes(jn.Arguments)
+		if err != nil {
+			return nil, err
+		}
+		for _, arg := range args {
+			switch arg.(type) {
+			case IdentifierNode, EmptyIdentifierNode:
+				// valid arguments
+			default:
+				return nil, fmt.Errorf("invalid function argument %s at %s", arg, pos)
+			}
+		}
+		body, err := fromJSONNode(jn.Body)
+		if err != nil {
+			return nil, err
+		}
+		return FunctionLiteralNode{
+			arguments: args,
+			body:      body,
+			position:  pos,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown node type %q at %s", jn.Type, pos)
+	}
+}
+
+func matchClauseFromJSON(jn *jsonNode) (MatchClauseNode, error) {
+	if jn == nil {
+		return MatchClauseNode{}, fmt.Errorf("missing match clause")
+	}
+	target, err := fromJSONNode(jn.Target)
+	if err != nil {
+		return MatchClauseNode{}, err
+	}
+	expr, err := fromJSONNode(jn.Expression)
+	if err != nil {
+		return MatchClauseNode{}, err
+	}
+	return MatchClauseNode{
+		target:     target,
+		expression: expr,
+	}, nil
+}
+
+// parseAnnotationString parses a type written as in a type annotation,
+// like the string representation of a Type.
+func parseAnnotationString(s string) (Type, error) {
+	tokens := make([]Tok, 0)
+	tokenStream := make(chan Tok)
+	go Tokenize(strings.NewReader("<"+s+">"), tokenStream, false, false)
+	for tok := range tokenStream {
+		tokens = append(tokens, tok)
+	}
+
+	p := parser{}
+	t, _, err := p.parseTypeAnnotation(tokens)
+	if err != nil {
+		return Type{}, fmt.Errorf("invalid type annotation <%s>: %s", s, err)
+	}
+	return t, nil
+}
@@ -0,0 +1,855 @@
+package ink
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// typeKind is a bit set of the kinds of values an Ink expression
+// may evaluate to.
+type typeKind uint8
+
+const (
+	kindNumber typeKind = 1 << iota
+	kindString
+	kindBoolean
+	kindNull
+	kindComposite
+	kindFunction
+
+	kindAny = kindNumber | kindString | kindBoolean | kindNull |
+		kindComposite | kindFunction
+)
+
+// Type is the static type of an Ink expression, inferred by the type checker.
+//
+// Ink programs often signal failure by returning (), so a function may return
+// a number or (). To model this, every Type is a sum type of one or more kinds
+// of values, like `number | ()`. A Type of every kind of value is `any`, and is
+// given to expressions whose type cannot be inferred.
+//
+// Composite types may also describe their shape, either as a list of
+// elements of one type like `{number}`, or as a record with named fields
+// like `{name: string, age: number}`.
+type Type struct {
+	kinds typeKind
+	// sig is the signature of a function type,
+	// or nil if the signature is not known
+	sig *signature
+	// elem is the type of every value in a composite type,
+	// or nil if it is not known
+	elem *Type
+	// fields are the types of the named fields of a composite type,
+	// or nil if they are not known
+	fields map[string]Type
+}
+
+// signature describes the arguments and return type of a function.
+type signature struct {
+	params []Type
+	// optional is the number of trailing params that may be omitted
+	optional int
+	ret      Type
+}
+
+var (
+	typeNumber    = Type{kinds: kindNumber}
+	typeString    = Type{kinds: kindString}
+	typeBoolean   = Type{kinds: kindBoolean}
+	typeNull      = Type{kinds: kindNull}
+	typeComposite = Type{kinds: kindComposite}
+	typeFunction  = Type{kinds: kindFunction}
+	typeAny       = Type{kinds: kindAny}
+)
+
+// typeNames are the names of types in type annotations
+var typeNames = map[string]Type{
+	"number":    typeNumber,
+	"string":    typeString,
+	"boolean":   typeBoolean,
+	"composite": typeComposite,
+	"function":  typeFunction,
+	"any":       typeAny,
+}
+
+func fnType(ret Type, params ...Type) Type {
+	return Type{
+		kinds: kindFunction,
+		sig: &signature{
+			params: params,
+			ret:    ret,
+		},
+	}
+}
+
+// withOptional returns the function type t,
+// with the last n of its params made optional.
+func withOptional(t Type, n int) Type {
+	sig := *t.sig
+	sig.optional = n
+	t.sig = &sig
+	return t
+}
+
+func (sig signature) String() string {
+	params := make([]string, len(sig.params))
+	for i, p := range sig.params {
+		params[i] = p.nestedString()
+	}
+	if len(params) == 0 {
+		return "() => " + sig.ret.String()
+	}
+	return strings.Join(params, ", ") + " => " + sig.ret.String()
+}
+
+func (t Type) String() string {
+	if t.kinds == kindAny {
+		return "any"
+	}
+
+	kinds := make([]string, 0, 1)
+	if t.kinds&kindNumber != 0 {
+		kinds = append(kinds, "number")
+	}
+	if t.kinds&kindString != 0 {
+		kinds = append(kinds, "string")
+	}
+	if t.kinds&kindBoolean != 0 {
+		kinds = append(kinds, "boolean")
+	}
+	if t.kinds&kindNull != 0 {
+		kinds = append(kinds, "()")
+	}
+	if t.kinds&kindComposite != 0 {
+		kinds = append(kinds, t.compositeString())
+	}
+	if t.kinds&kindFunction != 0 {
+		if t.sig == nil {
+			kinds = append(kinds, "function")
+		} else if t.kinds == kindFunction {
+			kinds = append(kinds, t.sig.String())
+		} else {
+			kinds = append(kinds, "("+t.sig.String()+")")
+		}
+	}
+	return strings.Join(kinds, " | ")
+}
+
+// nestedString is the string representation of a type inside another,
+// where function types are grouped in parentheses, since a => would
+// otherwise end the outer type.
+func (t Type) nestedString() string {
+	if t.kinds == kindFunction && t.sig != nil {
+		return "(" + t.sig.String() + ")"
+	}
+	return t.String()
+}
+
+func (t Type) compositeString() string {
+	if t.fields != nil {
+		names := make([]string, 0, len(t.fields))
+		for name := range t.fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		fields := make([]string, len(names))
+		for i, name := range names {
+			fields[i] = name + ": " + t.fields[name].nestedString()
+		}
+		return "{" + strings.Join(fields, ", ") + "}"
+	}
+	if t.elem != nil {
+		return "{" + t.elem.nestedString() + "}"
+	}
+	return "composite"
+}
+
+// union returns the sum type of two types
+func (t Type) union(other Type) Type {
+	u := Type{kinds: t.kinds | other.kinds}
+	if t.sig != nil && other.kinds&kindFunction == 0 {
+		u.sig = t.sig
+	} else if other.sig != nil && t.kinds&kindFunction == 0 {
+		u.sig = other.sig
+	}
+	if other.kinds&kindComposite == 0 {
+		u.elem, u.fields = t.elem, t.fields
+	} else if t.kinds&kindComposite == 0 {
+		u.elem, u.fields = other.elem, other.fields
+	}
+	return u
+}
+
+// erase returns type t without the shape of its composite values. Shapes
+// are only trusted for annotated names, because composite values may be
+// mutated after they are inferred.
+func (t Type) erase() Type {
+	t.elem, t.fields = nil, nil
+	return t
+}
+
+// assignableTo reports whether a value of type t may be bound to a name
+// annotated with the declared type. Like accepts, any overlap in kinds
+// is acceptable, but shapes of composites and signatures of functions
+// must be compatible if both are known.
+func (t Type) assignableTo(declared Type) bool {
+	if !t.accepts(declared.kinds) {
+		return false
+	}
+
+	if declared.kinds&kindComposite != 0 && t.kinds&kindComposite != 0 {
+		if declared.elem != nil && t.elem != nil && !t.elem.assignableTo(*declared.elem) {
+			return false
+		}
+		if declared.fields != nil && t.fields != nil {
+			for name, field := range declared.fields {
+				actual, ok := t.fields[name]
+				if !ok || !actual.assignableTo(field) {
+					return false
+				}
+			}
+		}
+		if declared.elem != nil && t.fields != nil {
+			for _, actual := range t.fields {
+				if !actual.assignableTo(*declared.elem) {
+					return false
+				}
+			}
+		}
+	}
+
+	if declared.sig != nil && t.sig != nil {
+		if len(t.sig.params) > len(declared.sig.params) ||
+			!t.sig.ret.assignableTo(declared.sig.ret) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// accepts reports whether a value of type t may be of some kind in kinds.
+// The type checker only reports errors for operations on values that could
+// never be valid, so any overlap is acceptable.
+func (t Type) accepts(kinds typeKind) bool {
+	return t.kinds&kinds != 0
+}
+
+// narrow returns the part of type t that is of some kind in kinds,
+// or a type of all kinds in kinds if there is no overlap.
+func (t Type) narrow(kinds typeKind) Type {
+	if t.kinds&kinds == 0 {
+		return Type{kinds: kinds}
+	}
+	n := Type{kinds: t.kinds & kinds}
+	if n.kinds&kindFunction != 0 {
+		n.sig = t.sig
+	}
+	if n.kinds&kindComposite != 0 {
+		n.elem, n.fields = t.elem, t.fields
+	}
+	return n
+}
+
+// builtinTypes are the signatures of all builtin functions
+// loaded into every Context by LoadEnvironment.
+var builtinTypes = map[string]Type{
+	"load": fnType(typeComposite, typeString),
+
+	// system interfaces
+	"args":        fnType(typeComposite),
+	"in":          fnType(typeNull, typeFunction),
+	"out":         fnType(typeNull, typeString),
+	"dir":         fnType(typeNull, typeString, typeFunction),
+	"make":        fnType(typeNull, typeString, typeFunction),
+	"stat":        fnType(typeNull, typeString, typeFunction),
+	"read":        fnType(typeNull, typeString, typeNumber, typeNumber, typeFunction),
+	"write":       fnType(typeNull, typeString, typeNumber, typeString, typeFunction),
+	"delete":      fnType(typeNull, typeString, typeFunction),
+	"open":        fnType(typeNull, typeString, typeString, typeFunction),
+	"listen":      withOptional(fnType(typeFunction, typeString, typeFunction, typeComposite), 2),
+	"req":         fnType(typeFunction, typeComposite, typeFunction),
+	"cookieJar":   fnType(typeComposite),
+	"wsConnect":   withOptional(fnType(typeComposite, typeString, typeFunction, typeComposite), 2),
+	"tcpListen":   fnType(typeFunction, typeString, typeFunction),
+	"tcpConnect":  fnType(typeComposite, typeString, typeFunction),
+	"udpBind":     fnType(typeComposite, typeString, typeFunction),
+	"udpSend":     fnType(typeNull, typeString, typeString, typeFunction),
+	"unixListen":  fnType(typeFunction, typeString, typeFunction),
+	"unixConnect": fnType(typeComposite, typeString, typeFunction),
+	"rand":        fnType(typeNumber),
+	"urand":       fnType(typeString.union(typeNull), typeNumber),
+	"time":        fnType(typeNumber),
+	"wait":        fnType(typeNull, typeNumber, typeFunction),
+	"exec":        fnType(typeFunction.union(typeComposite), typeString, typeComposite, typeString.union(typeComposite), typeFunction),
+	"env":         fnType(typeComposite),
+	"exit":        fnType(typeNull, typeNumber),
+
+	// math
+	"sin":   fnType(typeNumber, typeNumber),
+	"cos":   fnType(typeNumber, typeNumber),
+	"asin":  fnType(typeNumber, typeNumber),
+	"acos":  fnType(typeNumber, typeNumber),
+	"pow":   fnType(typeNumber, typeNumber, typeNumber),
+	"ln":    fnType(typeNumber, typeNumber),
+	"floor": fnType(typeNumber, typeNumber),
+
+	// type conversions
+	"string": fnType(typeString, typeAny),
+	"number": fnType(typeNumber.union(typeNull), typeAny),
+	"point":  fnType(typeNumber, typeString),
+	"char":   fnType(typeString, typeNumber),
+
+	// serialization
+	"jsonEncode": fnType(typeString, typeAny),
+	"jsonDecode": fnType(typeAny, typeString),
+
+	// strings
+	"index":      fnType(typeNumber, typeString, typeString),
+	"split":      fnType(typeComposite, typeString, typeString),
+	"replace":    fnType(typeString, typeString, typeString, typeString),
+	"upper":      fnType(typeString, typeString),
+	"lower":      fnType(typeString, typeString),
+	"trim":       fnType(typeString, typeString, typeString),
+	"trimPrefix": fnType(typeString, typeString, typeString),
+	"trimSuffix": fnType(typeString, typeString, typeString),
+	"hasPrefix?": fnType(typeBoolean, typeString, typeString),
+	"hasSuffix?": fnType(typeBoolean, typeString, typeString),
+	"repeat":     fnType(typeString, typeString, typeNumber),
+	"slice":      fnType(typeString.union(typeComposite), typeString.union(typeComposite), typeNumber, typeNumber),
+
+	// unicode
+	"runes":         fnType(typeComposite, typeString),
+	"runeCount":     fnType(typeNumber, typeString),
+	"codepoint":     fnType(typeNumber, typeString),
+	"fromCodepoint": fnType(typeString, typeNumber),
+	"fold":          fnType(typeString, typeString),
+	"nfc":           fnType(typeString, typeString),
+	"nfd":           fnType(typeString, typeString),
+
+	// regular expressions
+	"regex":        fnType(typeComposite, typeString),
+	"regexMatch?":  fnType(typeBoolean, typeString, typeString),
+	"regexFind":    fnType(typeComposite.union(typeNull), typeString, typeString),
+	"regexFindAll": fnType(typeComposite, typeString, typeString),
+	"regexReplace": fnType(typeString, typeString, typeString, typeString.union(typeFunction)),
+
+	// introspection
+	"type": fnType(typeString, typeAny),
+	"len":  fnType(typeNumber, typeString.union(typeComposite)),
+	"keys": fnType(typeComposite, typeComposite),
+
+	// assertions
+	"assert":      withOptional(fnType(typeNull, typeBoolean, typeString), 1),
+	"assertEqual": fnType(typeNull, typeAny, typeAny),
+	"skip":        fnType(typeNull, typeString),
+}
+
+// typeScope maps names to their types in a single lexical scope,
+// mirroring the StackFrame that the scope will have at runtime.
+type typeScope struct {
+	parent *typeScope
+	types  map[string]Type
+	// rebound names are bound more than once in the scope
+	rebound map[string]bool
+	// fn is whether the scope holds the arguments of a function
+	fn bool
+}
+
+// newTypeScope creates a scope for the expressions in nodes, noting which
+// names they bind more than once.
+func newTypeScope(parent *typeScope, nodes []Node, fn bool) *typeScope {
+	rebound := map[string]bool{}
+	for name, count := range bindingCounts(nodes) {
+		if count > 1 {
+			rebound[name] = true
+		}
+	}
+	return &typeScope{
+		parent:  parent,
+		types:   map[string]Type{},
+		rebound: rebound,
+		fn:      fn,
+	}
+}
+
+// bindingCounts counts how many times each name is bound by nodes.
+func bindingCounts(nodes []Node) map[string]int {
+	counts := map[string]int{}
+	for _, n := range nodes {
+		countBindings(n, counts)
+	}
+	return counts
+}
+
+// countBindings counts the names bound in node in its own scope, and not
+// in the nested functions and expression lists that have their own.
+func countBindings(node Node, counts map[string]int) {
+	switch n := node.(type) {
+	case FunctionLiteralNode, ExpressionListNode:
+		return
+	case BinaryExprNode:
+		if ident, isIdent := n.leftOperand.(IdentifierNode); isIdent && n.operator == DefineOp {
+			counts[ident.val]++
+		}
+	}
+
+	for _, child := range childNodes(node) {
+		countBindings(child, counts)
+	}
+}
+
+// get returns the type of a name. A function may be called after a name it
+// captures from an outer scope is rebound, and see a value of any of the
+// types bound to it, so such names are of an unknown type in functions.
+func (s *typeScope) get(name string) (Type, bool) {
+	captured := false
+	for s != nil {
+		t, ok := s.types[name]
+		if ok {
+			if captured && s.rebound[name] {
+				return typeAny, true
+			}
+			return t, true
+		}
+
+		captured = captured || s.fn
+		s = s.parent
+	}
+
+	return typeAny, false
+}
+
+// set binds a name to a type in the scope. Because a name may be rebound
+// to a value of a different type, and closures may observe either value,
+// rebinding a name widens its type to the sum of both types.
+func (s *typeScope) set(name string, t Type) {
+	if prev, ok := s.types[name]; ok {
+		t = prev.union(t)
+	}
+	s.types[name] = t
+}
+
+func newBuiltinScope() *typeScope {
+	scope := &typeScope{types: map[string]Type{}}
+	for name, t := range builtinTypes {
+		scope.types[name] = t
+	}
+	return scope
+}
+
+// checker infers the types of nodes in an Ink program,
+// and collects type errors found along the way.
+type checker struct {
+	diagnostics []Diagnostic
+}
+
+func (c *checker) errorf(n Node, format string, args ...interface{}) {
+	pos := n.Position()
+	c.diagnostics = append(c.diagnostics, Diagnostic{
+		Reason:  ErrType,
+		Message: fmt.Sprintf(format, args...) + fmt.Sprintf(" [%s]", pos),
+		Line:    pos.line,
+		Col:     pos.col,
+	})
+}
+
+// Check statically type checks a parsed Ink program, and returns every
+// type error found in the program.
+//
+// Check infers types from literals, bindings, and the signatures of builtin
+// functions, and reports operations on values that could never succeed at
+// runtime, like calling len() on a number or adding a number to a string.
+// Values whose types cannot be inferred are assumed to be valid.
+func Check(nodes []Node) []Diagnostic {
+	c := checker{}
+	scope := newTypeScope(newBuiltinScope(), nodes, false)
+	for _, n := range nodes {
+		c.typeOf(n, scope)
+	}
+	return c.diagnostics
+}
+
+// CheckInFrame infers the type of the last expression in nodes, and reports
+// type errors in them, given the values of variables already bound in a
+// stack frame, as in the REPL's :type command.
+func CheckInFrame(nodes []Node, frame *StackFrame) (Type, []Diagnostic) {
+	scope := newTypeScope(newBuiltinScope(), nodes, false)
+	// variables in the frame that nodes bind again are rebound
+	counts := bindingCounts(nodes)
+	for f := frame; f != nil; f = f.parent {
+		for name, val := range f.vt {
+			// inner variables shadow outer variables
+			if _, ok := scope.types[name]; !ok {
+				scope.types[name] = typeOfValue(val, 2)
+				if counts[name] > 0 {
+					scope.rebound[name] = true
+				}
+			}
+		}
+	}
+
+	c := checker{}
+	t := typeNull
+	for _, n := range nodes {
+		t = c.typeOf(n, scope)
+	}
+	return t, c.diagnostics
+}
+
+// typeOfValue returns the type of a value at runtime, describing the shapes
+// of composite values nested up to depth levels deep.
+func typeOfValue(v Value, depth int) Type {
+	switch v := v.(type) {
+	case NumberValue:
+		return typeNumber
+	case StringValue:
+		return typeString
+	case BooleanValue:
+		return typeBoolean
+	case NullValue, EmptyValue:
+		return typeNull
+	case NativeFunctionValue:
+		if t, ok := builtinTypes[v.name]; ok {
+			return t
+		}
+		return typeFunction
+	case FunctionValue:
+		c := checker{}
+		return c.typeOf(*v.defn, newBuiltinScope())
+	case CompositeValue:
+		if depth == 0 || len(v) == 0 {
+			return typeComposite
+		}
+
+		isList := true
+		for i := 0; i < len(v); i++ {
+			if _, ok := v[nToS(float64(i))]; !ok {
+				isList = false
+				break
+			}
+		}
+		if isList {
+			elem := typeOfValue(v["0"], depth-1)
+			for _, val := range v {
+				elem = elem.union(typeOfValue(val, depth-1))
+			}
+			return Type{kinds: kindComposite, elem: &elem}
+		}
+
+		fields := map[string]Type{}
+		for key, val := range v {
+			fields[key] = typeOfValue(val, depth-1)
+		}
+		return Type{kinds: kindComposite, fields: fields}
+	default:
+		return typeAny
+	}
+}
+
+// name of a callee, appropriate for an error message
+func calleeName(n Node) string {
+	if ident, isIdent := n.(IdentifierNode); isIdent {
+		return ident.val + "()"
+	}
+	return "function"
+}
+
+func (c *checker) typeOf(node Node, scope *typeScope) Type {
+	switch n := node.(type) {
+	case NumberLiteralNode:
+		return typeNumber
+	case StringLiteralNode:
+		return typeString
+	case BooleanLiteralNode:
+		return typeBoolean
+	case EmptyIdentifierNode:
+		return typeAny
+	case IdentifierNode:
+		t, _ := scope.get(n.val)
+		return t
+	case UnaryExprNode:
+		operand := c.typeOf(n.operand, scope)
+		if !operand.accepts(kindNumber | kindBoolean) {
+			c.errorf(n, "cannot negate non-boolean and non-number value of type %s", operand)
+		}
+		return operand.narrow(kindNumber | kindBoolean)
+	case BinaryExprNode:
+		return c.typeOfBinaryExpr(n, scope)
+	case FunctionCallNode:
+		fn := c.typeOf(n.function, scope)
+		args := make([]Type, len(n.arguments))
+		for i, arg := range n.arguments {
+			args[i] = c.typeOf(arg, scope)
+		}
+
+		if !fn.accepts(kindFunction) {
+			c.errorf(n, "cannot call a non-function value of type %s", fn)
+			return typeAny
+		}
+		if fn.sig == nil {
+			return typeAny
+		}
+
+		for i, param := range fn.sig.params {
+			if i < len(args) && !args[i].assignableTo(param) {
+				c.errorf(n.arguments[i], "argument %d to %s should be %s, but got %s",
+					i+1, calleeName(n.function), param, args[i])
+			}
+		}
+		return fn.sig.ret
+	case MatchExprNode:
+		condition := c.typeOf(n.condition, scope)
+
+		var result Type
+		exhaustive := false
+		for _, cl := range n.clauses {
+			if _, isEmpty := cl.target.(EmptyIdentifierNode); isEmpty {
+				exhaustive = true
+			}
+
+			target := c.typeOf(cl.target, scope)
+			if !target.accepts(condition.kinds) {
+				c.errorf(cl, "match target of type %s can never match a value of type %s",
+					target, condition)
+			}
+			result = result.union(c.typeOf(cl.expression, scope))
+		}
+		if !exhaustive {
+			result = result.union(typeNull)
+		}
+		return result
+	case ExpressionListNode:
+		if len(n.expressions) == 0 {
+			return typeNull
+		}
+
+		blockScope := newTypeScope(scope, n.expressions, false)
+		var last Type
+		for _, expr := range n.expressions {
+			last = c.typeOf(expr, blockScope)
+		}
+		return last
+	case ObjectLiteralNode:
+		// the fields of a composite are only known if
+		// every key is a name known before runtime
+		fields := map[string]Type{}
+		known := true
+		for _, entry := range n.entries {
+			c.typeOfKey(entry.key, scope)
+			val := c.typeOf(entry.val, scope)
+
+			switch key := entry.key.(type) {
+			case IdentifierNode:
+				fields[key.val] = val
+			case StringLiteralNode:
+				fields[key.val] = val
+			default:
+				known = false
+			}
+		}
+		if !known {
+			return typeComposite
+		}
+		return Type{kinds: kindComposite, fields: fields}
+	case ListLiteralNode:
+		if len(n.vals) == 0 {
+			return typeComposite
+		}
+
+		var elem Type
+		for _, val := range n.vals {
+			elem = elem.union(c.typeOf(val, scope))
+		}
+		return Type{kinds: kindComposite, elem: &elem}
+	case FunctionLiteralNode:
+		fnScope := newTypeScope(scope, []Node{n.body}, true)
+		params := make([]Type, len(n.arguments))
+		for i, arg := range n.arguments {
+			params[i] = typeAny
+			if ident, isIdent := arg.(IdentifierNode); isIdent {
+				if ident.annotation != nil {
+					params[i] = *ident.annotation
+				}
+				fnScope.types[ident.val] = params[i]
+			}
+		}
+
+		return fnType(c.typeOf(n.body, fnScope), params...)
+	default:
+		return typeAny
+	}
+}
+
+// typeOfKey checks the key of a composite literal or property access,
+// which is only evaluated if it is not an identifier or a literal.
+func (c *checker) typeOfKey(key Node, scope *typeScope) {
+	switch key.(type) {
+	case IdentifierNode, StringLiteralNode, NumberLiteralNode:
+		return
+	}
+
+	t := c.typeOf(key, scope)
+	if !t.accepts(kindString | kindNumber) {
+		c.errorf(key, "cannot use value of type %s as a property name", t)
+	}
+}
+
+// name of a property, appropriate for an error message
+func fieldName(key Node) string {
+	switch k := key.(type) {
+	case IdentifierNode:
+		return k.val
+	case StringLiteralNode:
+		return k.val
+	}
+	return key.String()
+}
+
+// field returns the type of the property of a composite type at the given
+// key, if the composite type is of a known shape.
+func (t Type) field(key Node) (Type, bool) {
+	if t.kinds != kindComposite {
+		return Type{}, false
+	}
+
+	if t.fields != nil {
+		var name string
+		switch k := key.(type) {
+		case IdentifierNode:
+			name = k.val
+		case StringLiteralNode:
+			name = k.val
+		default:
+			return Type{}, false
+		}
+
+		field, ok := t.fields[name]
+		return field, ok
+	}
+	if t.elem != nil {
+		// accessing a composite out of bounds returns ()
+		return t.elem.union(typeNull), true
+	}
+	return Type{}, false
+}
+
+func (c *checker) typeOfBinaryExpr(n BinaryExprNode, scope *typeScope) Type {
+	switch n.operator {
+	case DefineOp:
+		if leftIdent, okIdent := n.leftOperand.(IdentifierNode); okIdent {
+			if _, isEmpty := n.rightOperand.(EmptyIdentifierNode); isEmpty {
+				c.errorf(n, "cannot assign an empty identifier value to %s", leftIdent.val)
+				return typeAny
+			}
+
+			if leftIdent.annotation == nil {
+				right := c.typeOf(n.rightOperand, scope)
+				scope.set(leftIdent.val, right.erase())
+				return right
+			}
+
+			// bind the declared type before checking the value,
+			// so recursive functions can refer to themselves
+			declared := *leftIdent.annotation
+			_, bound := scope.types[leftIdent.val]
+			if !bound {
+				scope.types[leftIdent.val] = declared
+			}
+			right := c.typeOf(n.rightOperand, scope)
+			if !right.assignableTo(declared) {
+				c.errorf(n, "cannot assign value of type %s to %s of type %s",
+					right, leftIdent.val, declared)
+			}
+			if bound {
+				scope.set(leftIdent.val, declared)
+			}
+			return declared
+		} else if leftAccess, okAccess := n.leftOperand.(BinaryExprNode); okAccess &&
+			leftAccess.operator == AccessorOp {
+
+			left := c.typeOf(leftAccess.leftOperand, scope)
+			c.typeOfKey(leftAccess.rightOperand, scope)
+			right := c.typeOf(n.rightOperand, scope)
+
+			if !left.accepts(kindComposite | kindString) {
+				c.errorf(n, "cannot set property of a non-composite value of type %s", left)
+			} else if !left.accepts(kindComposite) && !right.accepts(kindString) {
+				c.errorf(n, "cannot set part of string to a non-string value of type %s", right)
+			} else if field, ok := left.field(leftAccess.rightOperand); ok &&
+				!right.assignableTo(field) {
+				c.errorf(n, "cannot set property %s of type %s to a value of type %s",
+					fieldName(leftAccess.rightOperand), field, right)
+			}
+			return left.narrow(kindComposite | kindString)
+		}
+
+		c.typeOf(n.leftOperand, scope)
+		c.errorf(n, "cannot assign value to non-identifier %s", n.leftOperand)
+		return c.typeOf(n.rightOperand, scope)
+	case AccessorOp:
+		left := c.typeOf(n.leftOperand, scope)
+		c.typeOfKey(n.rightOperand, scope)
+
+		if !left.accepts(kindComposite | kindString) {
+			c.errorf(n, "cannot access property %s of a non-composite value of type %s",
+				n.rightOperand, left)
+			return typeAny
+		}
+		if !left.accepts(kindComposite) {
+			// indexing into a string out of bounds returns ()
+			return typeString.union(typeNull)
+		}
+		if field, ok := left.field(n.rightOperand); ok {
+			return field
+		}
+		return typeAny
+	}
+
+	left := c.typeOf(n.leftOperand, scope)
+	right := c.typeOf(n.rightOperand, scope)
+
+	// supported kinds of operands for each operator,
+	// where both operands must be of the same kind
+	var supported typeKind
+	var opName string
+	switch n.operator {
+	case AddOp:
+		supported, opName = kindNumber|kindString|kindBoolean, "addition"
+	case SubtractOp:
+		supported, opName = kindNumber, "subtraction"
+	case MultiplyOp:
+		supported, opName = kindNumber|kindBoolean, "multiplication"
+	case DivideOp:
+		supported, opName = kindNumber, "division"
+	case ModulusOp:
+		supported, opName = kindNumber, "modulus"
+	case LogicalAndOp:
+		supported, opName = kindNumber|kindString|kindBoolean, "bitwise or logical &"
+	case LogicalOrOp:
+		supported, opName = kindNumber|kindString|kindBoolean, "bitwise or logical |"
+	case LogicalXorOp:
+		supported, opName = kindNumber|kindString|kindBoolean, "bitwise or logical ^"
+	case GreaterThanOp, LessThanOp:
+		supported, opName = kindNumber|kindString, "comparison"
+	case EqualOp:
+		return typeBoolean
+	default:
+		return typeAny
+	}
+
+	common := left.kinds & right.kinds & supported
+	if common == 0 {
+		c.errorf(n, "values of type %s and %s do not support %s", left, right, opName)
+		return typeAny
+	}
+
+	switch n.operator {
+	case GreaterThanOp, LessThanOp:
+		return typeBoolean
+	default:
+		return Type{kinds: common}
+	}
+}
@@ -0,0 +1,367 @@
+package ink
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Coverage is an EvalHook that records how many times each node in an Ink
+// program is evaluated, and how many times each match clause is taken,
+// keyed by source file and position. It is used by `ink test -cover`.
+type Coverage struct {
+	nodes   map[string]map[position]int
+	clauses map[string]map[position]int
+}
+
+// NewCoverage creates an empty Coverage, to be set as an Engine's Hook.
+// A single Coverage may be shared across many Engines.
+func NewCoverage() *Coverage {
+	return &Coverage{
+		nodes:   map[string]map[position]int{},
+		clauses: map[string]map[position]int{},
+	}
+}
+
+func (c *Coverage) EvalNode(ctx *Context, frame *StackFrame, n Node) {
+	if ctx.File == "" {
+		return
+	}
+
+	hits, prs := c.nodes[ctx.File]
+	if !prs {
+		hits = map[position]int{}
+		c.nodes[ctx.File] = hits
+	}
+	hits[n.Position()]++
+}
+
+func (c *Coverage) MatchClause(ctx *Context, frame *StackFrame, clause MatchClauseNode) {
+	if ctx.File == "" {
+		return
+	}
+
+	hits, prs := c.clauses[ctx.File]
+	if !prs {
+		hits = map[position]int{}
+		c.clauses[ctx.File] = hits
+	}
+	hits[clause.Position()]++
+}
+
+// fileCoverage is the coverage of a single source file, by line.
+type fileCoverage struct {
+	path   string
+	source []string
+	// lines maps each line containing evaluable code to the number of
+	// times code on the line was evaluated
+	lines map[int]int
+	// partial lines are lines where some, but not all code was evaluated
+	partial map[int]bool
+	// branches are the match clauses in the file, in source order
+	branches []branchCoverage
+}
+
+type branchCoverage struct {
+	line int
+	// match is the index of the match expression in the file,
+	// and clause is the index of the clause in it
+	match  int
+	clause int
+	hits   int
+}
+
+func (fc fileCoverage) linesHit() int {
+	hit := 0
+	for _, count := range fc.lines {
+		if count > 0 {
+			hit++
+		}
+	}
+	return hit
+}
+
+// files returns the paths of all source files evaluated, except
+// test files themselves, in sorted order.
+func (c *Coverage) files() []string {
+	files := make([]string, 0, len(c.nodes))
+	for file := range c.nodes {
+		if !strings.HasSuffix(file, "_test.ink") {
+			files = append(files, file)
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+func (c *Coverage) fileCoverage(file string) (fileCoverage, error) {
+	source, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fileCoverage{}, err
+	}
+
+	nodes, diagnostics := ParseAll(bytes.NewReader(source))
+	if len(diagnostics) > 0 {
+		return fileCoverage{}, fmt.Errorf("could not parse %s: %s", file, diagnostics[0])
+	}
+
+	fc := fileCoverage{
+		path:    file,
+		source:  strings.Split(string(source), "\n"),
+		lines:   map[int]int{},
+		partial: map[int]bool{},
+	}
+	hits := c.nodes[file]
+	clauseHits := c.clauses[file]
+
+	matchIndex := 0
+	for _, n := range nodes {
+		walkEvaluated(n, func(n Node) {
+			pos := n.Position()
+			count := hits[pos]
+			prev, prs := fc.lines[pos.line]
+			if prs && (prev == 0) != (count == 0) {
+				fc.partial[pos.line] = true
+			}
+			if !prs || count > prev {
+				fc.lines[pos.line] = count
+			}
+
+			if match, isMatch := n.(MatchExprNode); isMatch {
+				for i, cl := range match.clauses {
+					fc.branches = append(fc.branches, branchCoverage{
+						line:   cl.Position().line,
+						match:  matchIndex,
+						clause: i,
+						hits:   clauseHits[cl.Position()],
+					})
+				}
+				matchIndex++
+			}
+		})
+	}
+
+	return fc, nil
+}
+
+// isLiteralKey reports whether a node used as a property name is used as
+// is, rather than evaluated, as in operandToStringKey.
+func isLiteralKey(n Node) bool {
+	switch n.(type) {
+	case IdentifierNode, StringLiteralNode, NumberLiteralNode:
+		return true
+	}
+	return false
+}
+
+// walkEvaluated calls visit on every node in the tree that is evaluated
+// when the tree is evaluated, skipping names that are never evaluated
+// like function arguments and property names.
+func walkEvaluated(node Node, visit func(Node)) {
+	walk := func(n Node) {
+		walkEvaluated(n, visit)
+	}
+
+	switch n := node.(type) {
+	case BinaryExprNode:
+		visit(n)
+		if n.operator == DefineOp {
+			switch left := n.leftOperand.(type) {
+			case IdentifierNode:
+				// the name being bound is not evaluated
+			case BinaryExprNode:
+				if left.operator == AccessorOp {
+					walk(left.leftOperand)
+					if !isLiteralKey(left.rightOperand) {
+						walk(left.rightOperand)
+					}
+				} else {
+					walk(left)
+				}
+			default:
+				walk(left)
+			}
+			walk(n.rightOperand)
+			return
+		}
+
+		walk(n.leftOperand)
+		if n.operator != AccessorOp || !isLiteralKey(n.rightOperand) {
+			walk(n.rightOperand)
+		}
+	case MatchExprNode:
+		visit(n)
+		walk(n.condition)
+		for _, cl := range n.clauses {
+			walk(cl.target)
+			walk(cl.expression)
+		}
+	case ObjectLiteralNode:
+		visit(n)
+		for _, entry := range n.entries {
+			if !isLiteralKey(entry.key) {
+				walk(entry.key)
+			}
+			walk(entry.val)
+		}
+	case FunctionLiteralNode:
+		visit(n)
+		walk(n.body)
+	default:
+		visit(n)
+		for _, child := range childNodes(n) {
+			walk(child)
+		}
+	}
+}
+
+// WriteLcov writes the coverage of every source file evaluated, except
+// test files, to w in the lcov tracefile format. Lines are counted as
+// the number of times code on the line was evaluated, and every match
+// clause is reported as a branch.
+func (c *Coverage) WriteLcov(w io.Writer) error {
+	for _, file := range c.files() {
+		fc, err := c.fileCoverage(file)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(w, "TN:\nSF:%s\n", fc.path)
+
+		branchesHit := 0
+		for _, b := range fc.branches {
+			taken := "-"
+			if b.hits > 0 {
+				taken = fmt.Sprintf("%d", b.hits)
+				branchesHit++
+			}
+			fmt.Fprintf(w, "BRDA:%d,%d,%d,%s\n", b.line, b.match, b.clause, taken)
+		}
+		fmt.Fprintf(w, "BRF:%d\nBRH:%d\n", len(fc.branches), branchesHit)
+
+		lines := make([]int, 0, len(fc.lines))
+		for line := range fc.lines {
+			lines = append(lines, line)
+		}
+		sort.Ints(lines)
+		for _, line := range lines {
+			fmt.Fprintf(w, "DA:%d,%d\n", line, fc.lines[line])
+		}
+		fmt.Fprintf(w, "LF:%d\nLH:%d\nend_of_record\n", len(fc.lines), fc.linesHit())
+	}
+	return nil
+}
+
+// Summary returns a line of the percentage of lines covered
+// for each source file evaluated, except test files.
+func (c *Coverage) Summary() ([]string, error) {
+	summary := make([]string, 0)
+	for _, file := range c.files() {
+		fc, err := c.fileCoverage(file)
+		if err != nil {
+			return nil, err
+		}
+		summary = append(summary, fmt.Sprintf("%s: %.1f%% of lines covered",
+			relativePath(file), percent(fc.linesHit(), len(fc.lines))))
+	}
+	return summary, nil
+}
+
+func percent(n, total int) float64 {
+	if total == 0 {
+		return 100
+	}
+	return float64(n) / float64(total) * 100
+}
+
+// relativePath returns the path relative to the working directory,
+// if it is within the working directory.
+func relativePath(file string) string {
+	wd, err := os.Getwd()
+	if err != nil {
+		return file
+	}
+	rel, err := filepath.Rel(wd, file)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return file
+	}
+	return rel
+}
+
+const coverageHTMLHeader = `<!doctype html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Ink coverage</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 2em; }
+pre { margin: 0; font-size: 14px; line-height: 1.4; }
+table { border-collapse: collapse; margin-bottom: 3em; }
+td { padding: 0 8px; vertical-align: top; }
+td.line, td.hits { text-align: right; color: #888; user-select: none; }
+tr.covered td.source { background: #d7f5dd; }
+tr.uncovered td.source { background: #fbd9d9; }
+tr.partial td.source { background: #fdf1c7; }
+</style>
+</head>
+<body>
+<h1>Ink coverage</h1>
+`
+
+// WriteHTML writes the source of every file evaluated, except test files,
+// to w as an HTML page annotated with line hit counts. Covered lines are
+// green, lines that never ran are red, and lines where only some of the
+// code ran, like a match clause that was never taken, are yellow.
+func (c *Coverage) WriteHTML(w io.Writer) error {
+	files := make([]fileCoverage, 0)
+	for _, file := range c.files() {
+		fc, err := c.fileCoverage(file)
+		if err != nil {
+			return err
+		}
+		files = append(files, fc)
+	}
+
+	io.WriteString(w, coverageHTMLHeader)
+
+	io.WriteString(w, "<ul>\n")
+	for i, fc := range files {
+		fmt.Fprintf(w, "<li><a href=\"#file%d\">%s</a>: %.1f%%</li>\n",
+			i, html.EscapeString(relativePath(fc.path)),
+			percent(fc.linesHit(), len(fc.lines)))
+	}
+	io.WriteString(w, "</ul>\n")
+
+	for i, fc := range files {
+		fmt.Fprintf(w, "<h2 id=\"file%d\">%s</h2>\n<table>\n",
+			i, html.EscapeString(relativePath(fc.path)))
+		for idx, src := range fc.source {
+			line := idx + 1
+			class, hits := "", ""
+			if count, prs := fc.lines[line]; prs {
+				hits = fmt.Sprintf("%d", count)
+				switch {
+				case count == 0:
+					class = "uncovered"
+				case fc.partial[line]:
+					class = "partial"
+				default:
+					class = "covered"
+				}
+			}
+			fmt.Fprintf(w, "<tr class=\"%s\"><td class=\"line\">%d</td><td class=\"hits\">%s</td>"+
+				"<td class=\"source\"><pre>%s</pre></td></tr>\n",
+				class, line, hits, html.EscapeString(src))
+		}
+		io.WriteString(w, "</table>\n")
+	}
+
+	_, err := io.WriteString(w, "</body>\n</html>\n")
+	return err
+}
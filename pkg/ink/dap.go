@@ -0,0 +1,452 @@
+package ink
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// DAPServer is a DebugFrontend that lets an editor like VS Code drive a
+// Debugger over the Debug Adapter Protocol, as in `ink debug -dap`. Ink
+// programs only run on one thread at a time, so the program is presented
+// to the client as a single thread.
+type DAPServer struct {
+	conn     io.ReadWriter
+	debugger *Debugger
+
+	writeLock sync.Mutex
+	seq       int
+
+	// lock guards paused and detached
+	lock   sync.Mutex
+	paused bool
+	// detached is true once the client disconnects,
+	// after which the program runs to completion
+	detached bool
+
+	// requests are requests that inspect or resume the paused
+	// program, which are handled while the program is paused
+	requests   chan dapMessage
+	configured chan bool
+
+	// refs are the variable references given to the client
+	// while the program is paused, to values that can be
+	// expanded into variables
+	refs []ValueTable
+}
+
+// dapThreadID is the ID of the only thread in an Ink program.
+const dapThreadID = 1
+
+// dapResumeActions are the requests that resume a paused program.
+var dapResumeActions = map[string]DebugAction{
+	"continue": DebugContinue,
+	"next":     DebugStepOver,
+	"stepIn":   DebugStepIn,
+	"stepOut":  DebugStepOut,
+}
+
+// dapScopeNames are the names of kinds of DebugScopes shown in clients.
+var dapScopeNames = map[string]string{
+	"local":   "Locals",
+	"closure": "Closure",
+	"global":  "Globals",
+}
+
+type dapMessage struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+type dapResponse struct {
+	Seq        int         `json:"seq"`
+	Type       string      `json:"type"`
+	RequestSeq int         `json:"request_seq"`
+	Success    bool        `json:"success"`
+	Command    string      `json:"command"`
+	Message    string      `json:"message,omitempty"`
+	Body       interface{} `json:"body,omitempty"`
+}
+
+type dapEvent struct {
+	Seq   int         `json:"seq"`
+	Type  string      `json:"type"`
+	Event string      `json:"event"`
+	Body  interface{} `json:"body,omitempty"`
+}
+
+type dapSource struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+type dapVariable struct {
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+	VariablesReference int    `json:"variablesReference"`
+}
+
+// NewDAPServer creates a DAPServer that speaks to a client over conn, and
+// the Debugger it drives.
+func NewDAPServer(conn io.ReadWriter) *DAPServer {
+	s := &DAPServer{
+		conn:       conn,
+		requests:   make(chan dapMessage),
+		configured: make(chan bool),
+	}
+	s.debugger = NewDebugger(s, false)
+	return s
+}
+
+// Debugger returns the Debugger driven by the server, which should be set
+// as the Hook of the Engine running the program.
+func (s *DAPServer) Debugger() *Debugger {
+	return s.debugger
+}
+
+// Serve handles requests from the client on a separate goroutine, and
+// blocks until the client has finished configuring the debugger, including
+// setting breakpoints, so that the program can start running.
+func (s *DAPServer) Serve() {
+	go s.handleRequests()
+	<-s.configured
+}
+
+// Exited tells the client that the program has finished running.
+func (s *DAPServer) Exited(code int) {
+	s.event("exited", map[string]int{"exitCode": code})
+	s.event("terminated", nil)
+}
+
+func (s *DAPServer) write(msg interface{}) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	s.lock.Lock()
+	detached := s.detached
+	s.lock.Unlock()
+	if detached {
+		return
+	}
+
+	s.seq++
+	switch m := msg.(type) {
+	case *dapResponse:
+		m.Seq = s.seq
+	case *dapEvent:
+		m.Seq = s.seq
+	}
+
+	body, err := json.Marshal(msg)
+	if err != nil {
+		LogErrf(ErrAssert, "could not encode debug adapter message: %s", err)
+	}
+	fmt.Fprintf(s.conn, "Content-Length: %d\r\n\r\n", len(body))
+	s.conn.Write(body)
+}
+
+func (s *DAPServer) respond(req dapMessage, body interface{}) {
+	s.write(&dapResponse{
+		Type:       "response",
+		RequestSeq: req.Seq,
+		Success:    true,
+		Command:    req.Command,
+		Body:       body,
+	})
+}
+
+func (s *DAPServer) respondErr(req dapMessage, message string) {
+	s.write(&dapResponse{
+		Type:       "response",
+		RequestSeq: req.Seq,
+		Success:    false,
+		Command:    req.Command,
+		Message:    message,
+	})
+}
+
+func (s *DAPServer) event(event string, body interface{}) {
+	s.write(&dapEvent{
+		Type:  "event",
+		Event: event,
+		Body:  body,
+	})
+}
+
+func readDAPMessage(reader *textproto.Reader) (dapMessage, error) {
+	header, err := reader.ReadMIMEHeader()
+	if err != nil {
+		return dapMessage{}, err
+	}
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil {
+		return dapMessage{}, fmt.Errorf("invalid Content-Length header: %s", err)
+	}
+
+	body := make([]byte, length)
+	_, err = io.ReadFull(reader.R, body)
+	if err != nil {
+		return dapMessage{}, err
+	}
+
+	var msg dapMessage
+	err = json.Unmarshal(body, &msg)
+	return msg, err
+}
+
+func (s *DAPServer) handleRequests() {
+	reader := textproto.NewReader(bufio.NewReader(s.conn))
+	configured := false
+	for {
+		req, err := readDAPMessage(reader)
+		if err != nil {
+			s.detach()
+			if !configured {
+				close(s.configured)
+			}
+			return
+		}
+		if req.Type != "request" {
+			continue
+		}
+
+		switch req.Command {
+		case "initialize":
+			s.respond(req, map[string]bool{
+				"supportsConfigurationDoneRequest": true,
+				"supportsEvaluateForHovers":        true,
+			})
+			s.event("initialized", nil)
+		case "launch", "attach":
+			var args struct {
+				StopOnEntry bool `json:"stopOnEntry"`
+			}
+			json.Unmarshal(req.Arguments, &args)
+			s.debugger.stopOnEntry = args.StopOnEntry
+			s.respond(req, nil)
+		case "setBreakpoints":
+			var args struct {
+				Source      dapSource `json:"source"`
+				Breakpoints []struct {
+					Line int `json:"line"`
+				} `json:"breakpoints"`
+			}
+			json.Unmarshal(req.Arguments, &args)
+
+			lines := make([]int, len(args.Breakpoints))
+			breakpoints := make([]map[string]interface{}, len(args.Breakpoints))
+			for i, bp := range args.Breakpoints {
+				lines[i] = bp.Line
+				breakpoints[i] = map[string]interface{}{"verified": true, "line": bp.Line}
+			}
+			s.debugger.SetBreakpoints(args.Source.Path, lines)
+			s.respond(req, map[string]interface{}{"breakpoints": breakpoints})
+		case "setExceptionBreakpoints", "setFunctionBreakpoints":
+			s.respond(req, map[string]interface{}{"breakpoints": []interface{}{}})
+		case "configurationDone":
+			s.respond(req, nil)
+			if !configured {
+				configured = true
+				close(s.configured)
+			}
+		case "threads":
+			s.respond(req, map[string]interface{}{
+				"threads": []map[string]interface{}{{"id": dapThreadID, "name": "main"}},
+			})
+		case "pause":
+			s.debugger.Pause()
+			s.respond(req, nil)
+		case "disconnect", "terminate":
+			s.respond(req, nil)
+			os.Exit(0)
+		case "stackTrace", "scopes", "variables", "evaluate",
+			"continue", "next", "stepIn", "stepOut":
+			s.lock.Lock()
+			paused := s.paused
+			if _, resumes := dapResumeActions[req.Command]; paused && resumes {
+				// later requests should not be sent to the paused
+				// program once this request resumes it
+				s.paused = false
+			}
+			s.lock.Unlock()
+
+			if paused {
+				s.requests <- req
+			} else {
+				s.respondErr(req, "the program is not paused")
+			}
+		default:
+			s.respondErr(req, fmt.Sprintf("%s is not supported", req.Command))
+		}
+	}
+}
+
+// detach lets the program run to completion once the client disconnects.
+func (s *DAPServer) detach() {
+	s.lock.Lock()
+	s.detached = true
+	paused := s.paused
+	s.lock.Unlock()
+
+	s.debugger.lock.Lock()
+	s.debugger.breakpoints = map[string]map[int]bool{}
+	s.debugger.stopOnEntry = false
+	s.debugger.lock.Unlock()
+
+	if paused {
+		s.requests <- dapMessage{Command: "continue"}
+	}
+}
+
+// ref returns a variable reference for a value that can be expanded
+// into variables, or 0 if the value has no variables.
+func (s *DAPServer) ref(v Value) int {
+	comp, isComp := v.(CompositeValue)
+	if !isComp || len(comp) == 0 {
+		return 0
+	}
+	s.refs = append(s.refs, ValueTable(comp))
+	return len(s.refs)
+}
+
+func (s *DAPServer) variables(vt ValueTable) []dapVariable {
+	names := make([]string, 0, len(vt))
+	for name := range vt {
+		names = append(names, name)
+	}
+	// list indexes are sorted numerically
+	sort.Slice(names, func(i, j int) bool {
+		a, errA := strconv.Atoi(names[i])
+		b, errB := strconv.Atoi(names[j])
+		if errA == nil && errB == nil {
+			return a < b
+		}
+		return names[i] < names[j]
+	})
+
+	vars := make([]dapVariable, len(names))
+	for i, name := range names {
+		val := vt[name]
+		vstr := val.String()
+		if len(vstr) > maxPrintLen {
+			vstr = vstr[:maxPrintLen] + ".."
+		}
+		vars[i] = dapVariable{
+			Name:               name,
+			Value:              vstr,
+			VariablesReference: s.ref(val),
+		}
+	}
+	return vars
+}
+
+func (s *DAPServer) Paused(d *Debugger, stop DebugStop) DebugAction {
+	s.lock.Lock()
+	s.paused = true
+	detached := s.detached
+	s.lock.Unlock()
+
+	if detached {
+		return DebugContinue
+	}
+
+	s.refs = nil
+	s.event("stopped", map[string]interface{}{
+		"reason":            stop.Reason,
+		"threadId":          dapThreadID,
+		"allThreadsStopped": true,
+	})
+
+	for req := range s.requests {
+		switch req.Command {
+		case "stackTrace":
+			frames := d.Frames()
+			stackFrames := make([]map[string]interface{}, len(frames))
+			for i, frame := range frames {
+				stackFrames[i] = map[string]interface{}{
+					"id":     i,
+					"name":   frame.Name,
+					"source": dapSource{Name: filepath.Base(frame.File), Path: frame.File},
+					"line":   frame.Line,
+					"column": 1,
+				}
+			}
+			s.respond(req, map[string]interface{}{
+				"stackFrames": stackFrames,
+				"totalFrames": len(stackFrames),
+			})
+		case "scopes":
+			var args struct {
+				FrameID int `json:"frameId"`
+			}
+			json.Unmarshal(req.Arguments, &args)
+
+			scopes, err := d.Scopes(args.FrameID)
+			if err != nil {
+				s.respondErr(req, err.Error())
+				continue
+			}
+			dapScopes := make([]map[string]interface{}, len(scopes))
+			for i, scope := range scopes {
+				s.refs = append(s.refs, scope.Vars)
+				dapScopes[i] = map[string]interface{}{
+					"name":               dapScopeNames[scope.Name],
+					"variablesReference": len(s.refs),
+					"expensive":          scope.Name == "global",
+				}
+			}
+			s.respond(req, map[string]interface{}{"scopes": dapScopes})
+		case "variables":
+			var args struct {
+				VariablesReference int `json:"variablesReference"`
+			}
+			json.Unmarshal(req.Arguments, &args)
+
+			if args.VariablesReference < 1 || args.VariablesReference > len(s.refs) {
+				s.respondErr(req, "unknown variables reference")
+				continue
+			}
+			s.respond(req, map[string]interface{}{
+				"variables": s.variables(s.refs[args.VariablesReference-1]),
+			})
+		case "evaluate":
+			var args struct {
+				Expression string `json:"expression"`
+				FrameID    int    `json:"frameId"`
+			}
+			json.Unmarshal(req.Arguments, &args)
+
+			val, err := d.Eval(args.FrameID, args.Expression)
+			if err != nil {
+				if e, isErr := err.(Err); isErr {
+					s.respondErr(req, e.message)
+				} else {
+					s.respondErr(req, err.Error())
+				}
+				continue
+			}
+			s.respond(req, map[string]interface{}{
+				"result":             val.String(),
+				"variablesReference": s.ref(val),
+			})
+		default:
+			if req.Command == "continue" {
+				s.respond(req, map[string]bool{"allThreadsContinued": true})
+			} else {
+				s.respond(req, nil)
+			}
+			return dapResumeActions[req.Command]
+		}
+	}
+
+	return DebugContinue
+}
@@ -0,0 +1,548 @@
+package ink
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DebugAction is how a paused program resumes running in the Debugger.
+type DebugAction int
+
+const (
+	// DebugContinue runs until the next breakpoint
+	DebugContinue DebugAction = iota
+	// DebugStepIn runs until the next line, including in called functions
+	DebugStepIn
+	// DebugStepOver runs until the next line in the current function
+	// or a function that called it
+	DebugStepOver
+	// DebugStepOut runs until the current function returns
+	DebugStepOut
+)
+
+// DebugStop describes where and why a program paused in the Debugger.
+type DebugStop struct {
+	// Reason is one of "entry", "breakpoint", "step", or "pause"
+	Reason string
+	File   string
+	Line   int
+}
+
+// DebugFrontend drives a Debugger, like a terminal UI or a debug adapter.
+type DebugFrontend interface {
+	// Paused is called whenever the program pauses, and blocks until the
+	// program should resume. The program is paused for as long as Paused
+	// runs, so Paused may inspect it with the Debugger's Frames, Scopes,
+	// and Eval.
+	Paused(d *Debugger, stop DebugStop) DebugAction
+}
+
+// DebugFrame is a frame of the Ink call stack of a paused program.
+type DebugFrame struct {
+	Name string
+	File string
+	Line int
+}
+
+// DebugScope is a stack frame of variables visible from a DebugFrame.
+type DebugScope struct {
+	// Name is "local", "closure", or "global"
+	Name string
+	Vars ValueTable
+}
+
+// debugFrame is a function call in progress, or the top level of
+// a program if it is the first frame of the Debugger's stack.
+type debugFrame struct {
+	name string
+	// callFrame is the stack frame of the function's arguments, and
+	// frame the innermost stack frame of the code being run in the
+	// call, which may be an expression list in the function
+	callFrame *StackFrame
+	frame     *StackFrame
+	file      string
+	line      int
+}
+
+// Debugger is an EvalHook that pauses a program at breakpoints and while
+// stepping through it, and lets a DebugFrontend inspect the paused program.
+// A Debugger is used by `ink debug`, and should be set as the Hook of a
+// single Engine.
+type Debugger struct {
+	Frontend DebugFrontend
+
+	// lock guards breakpoints and pauseRequested,
+	// which may be changed while the program runs
+	lock           sync.Mutex
+	breakpoints    map[string]map[int]bool
+	pauseRequested bool
+	stopOnEntry    bool
+
+	stack []*debugFrame
+	// action is how the program last resumed, and stepDepth
+	// the depth of the call stack at that moment
+	action    DebugAction
+	stepDepth int
+	// returned is true if the call stack has become shallower than
+	// stepDepth while stepping out, so the program pauses at the
+	// next node evaluated
+	returned bool
+	// evaluating is true while evaluating expressions for a frontend,
+	// during which the Debugger does not pause
+	evaluating bool
+
+	absPaths map[string]string
+}
+
+// NewDebugger creates a Debugger driven by frontend. If stopOnEntry is
+// true, the program pauses before its first line runs.
+func NewDebugger(frontend DebugFrontend, stopOnEntry bool) *Debugger {
+	return &Debugger{
+		Frontend:    frontend,
+		breakpoints: map[string]map[int]bool{},
+		stopOnEntry: stopOnEntry,
+		stack:       []*debugFrame{{name: "(top level)"}},
+		absPaths:    map[string]string{},
+	}
+}
+
+func (d *Debugger) absPath(file string) string {
+	abs, prs := d.absPaths[file]
+	if !prs {
+		var err error
+		abs, err = filepath.Abs(file)
+		if err != nil {
+			abs = file
+		}
+		d.absPaths[file] = abs
+	}
+	return abs
+}
+
+// SetBreakpoints replaces all breakpoints in a file with breakpoints at the
+// given lines. It is safe to call while the program runs.
+func (d *Debugger) SetBreakpoints(file string, lines []int) {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		abs = file
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	fileBreakpoints := map[int]bool{}
+	for _, line := range lines {
+		fileBreakpoints[line] = true
+	}
+	d.breakpoints[abs] = fileBreakpoints
+}
+
+// Breakpoints returns the lines of all breakpoints in a file, in order.
+func (d *Debugger) Breakpoints(file string) []int {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		abs = file
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	lines := make([]int, 0, len(d.breakpoints[abs]))
+	for line := range d.breakpoints[abs] {
+		lines = append(lines, line)
+	}
+	sort.Ints(lines)
+	return lines
+}
+
+// Pause asks the program to pause at the next line it runs. It is safe
+// to call while the program runs.
+func (d *Debugger) Pause() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.pauseRequested = true
+}
+
+func (d *Debugger) EvalNode(ctx *Context, frame *StackFrame, n Node) {
+	if d.evaluating {
+		return
+	}
+
+	top := d.stack[len(d.stack)-1]
+	top.frame = frame
+
+	// the program only pauses when it reaches a new line
+	// in a function call, at the first node on the line
+	pos := n.Position()
+	file := d.absPath(ctx.File)
+	if file == top.file && pos.line == top.line && !d.returned {
+		return
+	}
+	top.file, top.line = file, pos.line
+
+	d.lock.Lock()
+	reason := ""
+	switch {
+	case d.stopOnEntry:
+		reason = "entry"
+		d.stopOnEntry = false
+	case d.pauseRequested:
+		reason = "pause"
+	case d.breakpoints[file][pos.line]:
+		reason = "breakpoint"
+	case d.action == DebugStepIn,
+		d.action == DebugStepOver && len(d.stack) <= d.stepDepth,
+		d.action == DebugStepOut && d.returned:
+		reason = "step"
+	}
+	d.pauseRequested = false
+	d.lock.Unlock()
+
+	if reason == "" {
+		return
+	}
+
+	d.returned = false
+	d.action = d.Frontend.Paused(d, DebugStop{
+		Reason: reason,
+		File:   file,
+		Line:   pos.line,
+	})
+	d.stepDepth = len(d.stack)
+}
+
+func (d *Debugger) MatchClause(ctx *Context, frame *StackFrame, clause MatchClauseNode) {}
+
+func (d *Debugger) CallFunction(ctx *Context, frame *StackFrame, name string, tail bool) {
+	call := &debugFrame{name: name, callFrame: frame, frame: frame}
+	if tail {
+		d.stack[len(d.stack)-1] = call
+	} else {
+		d.stack = append(d.stack, call)
+	}
+}
+
+func (d *Debugger) ReturnFunction(ctx *Context) {
+	d.stack = d.stack[:len(d.stack)-1]
+	if d.action == DebugStepOut && len(d.stack) < d.stepDepth {
+		d.returned = true
+	}
+}
+
+// Frames returns the call stack of the paused program, from the innermost
+// function call outwards to the top level of the program.
+func (d *Debugger) Frames() []DebugFrame {
+	frames := make([]DebugFrame, len(d.stack))
+	for i, call := range d.stack {
+		frames[len(d.stack)-1-i] = DebugFrame{
+			Name: call.name,
+			File: call.file,
+			Line: call.line,
+		}
+	}
+	return frames
+}
+
+func (d *Debugger) frameAt(index int) (*debugFrame, error) {
+	if index < 0 || index >= len(d.stack) {
+		return nil, fmt.Errorf("no frame %d in a call stack of %d frames", index, len(d.stack))
+	}
+	return d.stack[len(d.stack)-1-index], nil
+}
+
+// Scopes returns the variables visible from the frame at index in Frames,
+// from the innermost scope outwards to global variables. Variables in
+// the function and expression lists in it are local, and variables in
+// the functions in which it is defined are in closure scopes.
+func (d *Debugger) Scopes(index int) ([]DebugScope, error) {
+	call, err := d.frameAt(index)
+	if err != nil {
+		return nil, err
+	}
+
+	locals := ValueTable{}
+	scopes := []DebugScope{{Name: "local", Vars: locals}}
+	inCall := true
+	for frame := call.frame; frame != nil; frame = frame.parent {
+		switch {
+		case frame.parent == nil:
+			scopes = append(scopes, DebugScope{Name: "global", Vars: frame.vt})
+		case inCall:
+			for name, val := range frame.vt {
+				// inner variables shadow outer variables
+				if _, prs := locals[name]; !prs {
+					locals[name] = val
+				}
+			}
+		default:
+			scopes = append(scopes, DebugScope{Name: "closure", Vars: frame.vt})
+		}
+
+		if frame == call.callFrame {
+			inCall = false
+		}
+	}
+	return scopes, nil
+}
+
+// Eval evaluates Ink source in the frame at index in Frames of the paused
+// program, and returns the value of the last expression. Variables bound
+// in source are bound in the frame.
+func (d *Debugger) Eval(index int, source string) (Value, error) {
+	call, err := d.frameAt(index)
+	if err != nil {
+		return nil, err
+	}
+	if call.frame == nil {
+		return nil, fmt.Errorf("frame %d has not started running", index)
+	}
+
+	nodes, diagnostics := ParseAll(strings.NewReader(source))
+	if len(diagnostics) > 0 {
+		return nil, Err{diagnostics[0].Reason, diagnostics[0].Message}
+	}
+
+	d.evaluating = true
+	defer func() { d.evaluating = false }()
+
+	var val Value = Null
+	for _, n := range nodes {
+		val, err = n.Eval(call.frame, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return val, nil
+}
+
+const debugHelpMessage = `Commands:
+	c, continue          run until the next breakpoint
+	s, step              run to the next line, stepping into function calls
+	n, next              run to the next line in this function
+	o, out               run until this function returns
+	b, break [file:]line set a breakpoint
+	d, delete [file:]line
+	                     delete a breakpoint
+	bt, backtrace        print the call stack
+	up, down             select the calling or called frame
+	f, frame [n]         select frame n, or print the selected frame
+	l, locals            print variables in the selected frame
+	p, print expr        evaluate an expression in the selected frame
+	list                 print source around the selected line
+	q, quit              stop debugging and exit
+	h, help              print this message`
+
+// TerminalDebugger is a DebugFrontend that is driven by commands typed
+// at a terminal, as in `ink debug`.
+type TerminalDebugger struct {
+	in  *bufio.Reader
+	out io.Writer
+	// file is the program being debugged, where breakpoints
+	// given without a file name are set
+	file     string
+	selected int
+	sources  map[string][]string
+}
+
+// NewTerminalDebugger creates a TerminalDebugger that reads commands from
+// in and prints to out, to debug the program at file.
+func NewTerminalDebugger(in io.Reader, out io.Writer, file string) *TerminalDebugger {
+	return &TerminalDebugger{
+		in:      bufio.NewReader(in),
+		out:     out,
+		file:    file,
+		sources: map[string][]string{},
+	}
+}
+
+func (t *TerminalDebugger) sourceLine(file string, line int) string {
+	lines, prs := t.sources[file]
+	if !prs {
+		source, err := ioutil.ReadFile(file)
+		if err == nil {
+			lines = strings.Split(string(source), "\n")
+		}
+		t.sources[file] = lines
+	}
+
+	if line < 1 || line > len(lines) {
+		return ""
+	}
+	return lines[line-1]
+}
+
+func (t *TerminalDebugger) printFrame(d *Debugger) {
+	frames := d.Frames()
+	frame := frames[t.selected]
+	fmt.Fprintf(t.out, "#%d %s at %s:%d\n", t.selected, frame.Name,
+		relativePath(frame.File), frame.Line)
+	fmt.Fprintf(t.out, "%5d\t%s\n", frame.Line, t.sourceLine(frame.File, frame.Line))
+}
+
+// parseLocation parses a breakpoint location of the form [file:]line.
+func (t *TerminalDebugger) parseLocation(arg string) (string, int, error) {
+	file := t.file
+	if idx := strings.LastIndexByte(arg, ':'); idx >= 0 {
+		file, arg = arg[:idx], arg[idx+1:]
+	}
+	line, err := strconv.Atoi(arg)
+	if err != nil || line < 1 {
+		return "", 0, fmt.Errorf("%s is not a line number", arg)
+	}
+	return file, line, nil
+}
+
+func (t *TerminalDebugger) Paused(d *Debugger, stop DebugStop) DebugAction {
+	t.selected = 0
+	fmt.Fprintf(t.out, "paused (%s)\n", stop.Reason)
+	t.printFrame(d)
+
+	for {
+		fmt.Fprintf(t.out, AnsiBlueBold+"(debug) "+AnsiReset)
+		text, err := t.in.ReadString('\n')
+		if err == io.EOF && text == "" {
+			// without more commands, run to the end
+			return DebugContinue
+		}
+
+		text = strings.TrimSpace(text)
+		cmd, arg := text, ""
+		if idx := strings.IndexByte(text, ' '); idx >= 0 {
+			cmd, arg = text[:idx], strings.TrimSpace(text[idx+1:])
+		}
+
+		switch cmd {
+		case "":
+			continue
+		case "c", "continue":
+			return DebugContinue
+		case "s", "step":
+			return DebugStepIn
+		case "n", "next":
+			return DebugStepOver
+		case "o", "out":
+			return DebugStepOut
+		case "b", "break", "d", "delete":
+			file, line, err := t.parseLocation(arg)
+			if err != nil {
+				fmt.Fprintln(t.out, err)
+				continue
+			}
+
+			lines := d.Breakpoints(file)
+			if cmd == "b" || cmd == "break" {
+				lines = append(lines, line)
+				fmt.Fprintf(t.out, "breakpoint at %s:%d\n", relativePath(file), line)
+			} else {
+				for i, l := range lines {
+					if l == line {
+						lines = append(lines[:i], lines[i+1:]...)
+						break
+					}
+				}
+			}
+			d.SetBreakpoints(file, lines)
+		case "bt", "backtrace":
+			for i, frame := range d.Frames() {
+				marker := " "
+				if i == t.selected {
+					marker = "*"
+				}
+				fmt.Fprintf(t.out, "%s#%d %s at %s:%d\n", marker, i, frame.Name,
+					relativePath(frame.File), frame.Line)
+			}
+		case "up", "down", "f", "frame":
+			selected := t.selected
+			switch cmd {
+			case "up":
+				selected++
+			case "down":
+				selected--
+			default:
+				if arg != "" {
+					selected, err = strconv.Atoi(arg)
+					if err != nil {
+						fmt.Fprintf(t.out, "%s is not a frame number\n", arg)
+						continue
+					}
+				}
+			}
+
+			if selected < 0 || selected >= len(d.Frames()) {
+				fmt.Fprintf(t.out, "no frame %d\n", selected)
+				continue
+			}
+			t.selected = selected
+			t.printFrame(d)
+		case "l", "locals":
+			scopes, err := d.Scopes(t.selected)
+			if err != nil {
+				fmt.Fprintln(t.out, err)
+				continue
+			}
+			for _, scope := range scopes {
+				// globals include every builtin, so only the
+				// innermost scopes are printed in full
+				if scope.Name == "global" && len(scopes) > 1 {
+					fmt.Fprintf(t.out, "%s: %d variables, print them by name\n",
+						scope.Name, len(scope.Vars))
+					continue
+				}
+
+				names := make([]string, 0, len(scope.Vars))
+				for name := range scope.Vars {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+
+				fmt.Fprintf(t.out, "%s:\n", scope.Name)
+				for _, name := range names {
+					vstr := scope.Vars[name].String()
+					if len(vstr) > maxPrintLen {
+						vstr = vstr[:maxPrintLen] + ".."
+					}
+					fmt.Fprintf(t.out, "\t%s = %s\n", name, vstr)
+				}
+			}
+		case "p", "print":
+			val, err := d.Eval(t.selected, arg)
+			if err != nil {
+				if e, isErr := err.(Err); isErr {
+					fmt.Fprintln(t.out, e.message)
+				} else {
+					fmt.Fprintln(t.out, err)
+				}
+				continue
+			}
+			fmt.Fprintln(t.out, val)
+		case "list":
+			frame := d.Frames()[t.selected]
+			for line := frame.Line - 5; line <= frame.Line+5; line++ {
+				if line < 1 {
+					continue
+				}
+				marker := " "
+				if line == frame.Line {
+					marker = ">"
+				}
+				fmt.Fprintf(t.out, "%s%4d\t%s\n", marker, line, t.sourceLine(frame.File, line))
+			}
+		case "q", "quit":
+			fmt.Fprintln(t.out, "quit")
+			os.Exit(0)
+		case "h", "help":
+			fmt.Fprintln(t.out, debugHelpMessage)
+		default:
+			fmt.Fprintf(t.out, "unknown command %s, type help for a list of commands\n", cmd)
+		}
+	}
+}
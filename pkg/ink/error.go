@@ -6,8 +6,13 @@ const (
 	ErrUnknown = 0
 	ErrSyntax  = 1
 	ErrRuntime = 2
-	ErrSystem  = 40
-	ErrAssert  = 100
+	ErrType    = 3
+	ErrVet     = 4
+	// ErrAssertion is a failed assertion in an Ink program,
+	// unlike ErrAssert, which is an internal invariant violation
+	ErrAssertion = 5
+	ErrSystem    = 40
+	ErrAssert    = 100
 )
 
 // Err constants represent possible errors that Ink interpreter
@@ -20,3 +25,19 @@ type Err struct {
 func (e Err) Error() string {
 	return e.message
 }
+
+// Diagnostic is an error found in an Ink program without running it, like
+// a syntax error found by the parser, along with its position in the source.
+type Diagnostic struct {
+	Reason  int
+	Message string
+	// Rule is the ID of the VetRule that reported the diagnostic,
+	// or empty if it was not reported by Vet
+	Rule string
+	Line int
+	Col  int
+}
+
+func (d Diagnostic) String() string {
+	return d.Message
+}
@@ -6,9 +6,11 @@ import (
 	"io"
 	"os"
 	"path"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 const maxPrintLen = 120
@@ -167,33 +169,60 @@ func (v NullValue) Equals(other Value) bool {
 type CompositeValue ValueTable
 
 func (v CompositeValue) String() string {
-	entries := make([]string, 0, len(v))
-	for key, val := range v {
-		entries = append(entries, fmt.Sprintf("%s: %s", key, val))
-	}
-	return "{" + strings.Join(entries, ", ") + "}"
+	return Pretty(v, PrettyConfig{})
 }
 
 func (v CompositeValue) Equals(other Value) bool {
+	return compositeEquals(v, other, nil)
+}
+
+// compositePair is a pair of composites being compared, by identity
+type compositePair [2]uintptr
+
+// compositeID identifies a composite by reference, since composites
+// are maps and so cannot be compared directly.
+func compositeID(v CompositeValue) uintptr {
+	return reflect.ValueOf(v).Pointer()
+}
+
+// compositeEquals compares composites deeply. Composites may contain
+// themselves, so visited records pairs of composites already being compared,
+// which are assumed equal when they recur. visited is only allocated once
+// nested composites are found, so flat lists compare without allocating.
+func compositeEquals(v CompositeValue, other Value, visited map[compositePair]bool) bool {
 	if _, isEmpty := other.(EmptyValue); isEmpty {
 		return true
 	}
 
-	if ov, ok := other.(CompositeValue); ok {
-		if len(v) != len(ov) {
+	ov, ok := other.(CompositeValue)
+	if !ok || len(v) != len(ov) {
+		return false
+	}
+
+	pair := compositePair{compositeID(v), compositeID(ov)}
+	if pair[0] == pair[1] || visited[pair] {
+		return true
+	}
+
+	for key, val := range v {
+		otherVal, prs := ov[key]
+		if !prs {
 			return false
 		}
 
-		for key, val := range v {
-			otherVal, prs := ov[key]
-			if !prs || prs && !val.Equals(otherVal) {
+		if comp, isComposite := val.(CompositeValue); isComposite {
+			if visited == nil {
+				visited = map[compositePair]bool{}
+			}
+			visited[pair] = true
+			if !compositeEquals(comp, otherVal, visited) {
 				return false
 			}
+		} else if !val.Equals(otherVal) {
+			return false
 		}
-		return true
 	}
-
-	return false
+	return true
 }
 
 // FunctionValue is the value of any variables referencing functions
@@ -232,6 +261,9 @@ func (v FunctionValue) Equals(other Value) bool {
 type FunctionCallThunkValue struct {
 	vt       ValueTable
 	function FunctionValue
+	// call is the call site of the function, only when profiling
+	// or when the Engine has a Hook
+	call *profileCall
 }
 
 func (v FunctionCallThunkValue) String() string {
@@ -255,23 +287,56 @@ func (v FunctionCallThunkValue) Equals(other Value) bool {
 // unwrapThunk expands out a recursive structure of thunks
 // 	into a flat for loop control structure
 func unwrapThunk(thunk FunctionCallThunkValue) (v Value, err error) {
+	p := thunk.function.parentFrame.profiler()
+	if p != nil {
+		p.push(inkCall(thunk.function, thunk.call))
+		defer p.pop()
+	}
+
+	if t := thunk.function.parentFrame.tracer(); t != nil && t.Calls {
+		defer t.span("call", inkCall(thunk.function, thunk.call).fn.name, time.Now(), nil)
+	}
+
+	var calls CallHook
+	if parent := thunk.function.parentFrame; parent.hooked() {
+		calls, _ = parent.ctx.Engine.Hook.(CallHook)
+		if calls != nil {
+			defer calls.ReturnFunction(parent.ctx)
+		}
+	}
+
 	isThunk := true
+	tail := false
 	for isThunk {
 		frame := &StackFrame{
 			parent: thunk.function.parentFrame,
 			vt:     thunk.vt,
+			ctx:    thunk.function.parentFrame.ctx,
 		}
+		if calls != nil {
+			calls.CallFunction(frame.ctx, frame, inkCall(thunk.function, thunk.call).fn.name, tail)
+		}
+		tail = true
+
 		v, err = thunk.function.defn.body.Eval(frame, true)
 		if err != nil {
 			return
 		}
 		thunk, isThunk = v.(FunctionCallThunkValue)
+		if isThunk && p != nil {
+			// tail calls replace the caller's frame
+			p.replace(inkCall(thunk.function, thunk.call))
+		}
 	}
 
 	return
 }
 
 func (n UnaryExprNode) Eval(frame *StackFrame, allowThunk bool) (Value, error) {
+	if frame.hooked() {
+		frame.ctx.Engine.Hook.EvalNode(frame.ctx, frame, n)
+	}
+
 	switch n.operator {
 	case NegationOp:
 		operand, err := n.operand.Eval(frame, false)
@@ -330,6 +395,10 @@ func operandToStringKey(rightOperand Node, frame *StackFrame) (string, error) {
 }
 
 func (n BinaryExprNode) Eval(frame *StackFrame, allowThunk bool) (Value, error) {
+	if frame.hooked() {
+		frame.ctx.Engine.Hook.EvalNode(frame.ctx, frame, n)
+	}
+
 	if n.operator == DefineOp {
 		if leftIdent, okIdent := n.leftOperand.(IdentifierNode); okIdent {
 			if _, isEmpty := n.rightOperand.(EmptyIdentifierNode); isEmpty {
@@ -737,6 +806,10 @@ func (n BinaryExprNode) Eval(frame *StackFrame, allowThunk bool) (Value, error)
 }
 
 func (n FunctionCallNode) Eval(frame *StackFrame, allowThunk bool) (Value, error) {
+	if frame.hooked() {
+		frame.ctx.Engine.Hook.EvalNode(frame.ctx, frame, n)
+	}
+
 	fn, err := n.function.Eval(frame, false)
 	if err != nil {
 		return nil, err
@@ -749,11 +822,40 @@ func (n FunctionCallNode) Eval(frame *StackFrame, allowThunk bool) (Value, error
 			return nil, err
 		}
 	}
-	return evalInkFunction(fn, allowThunk, argResults...)
+
+	var site *profileCall
+	if frame.callSites() {
+		site = callSite(n)
+	}
+
+	val, err := callFunction(fn, allowThunk, site, argResults...)
+	if e, isErr := err.(Err); isErr && e.reason == ErrAssertion && frame.testing() {
+		// assert builtins do not know where they were called, so when
+		// running tests, failures are annotated with the call site
+		e.message = withPosition(e.message, n)
+		return nil, e
+	}
+	return val, err
+}
+
+// withPosition adds the position of a node to the first line of an error
+// message, to follow the format of other error messages.
+func withPosition(message string, n Node) string {
+	pos := " [" + poss(n) + "]"
+	if idx := strings.IndexByte(message, '\n'); idx >= 0 {
+		return message[:idx] + pos + message[idx:]
+	}
+	return message + pos
 }
 
 // call into an Ink callback function synchronously
 func evalInkFunction(fn Value, allowThunk bool, args ...Value) (Value, error) {
+	return callFunction(fn, allowThunk, nil, args...)
+}
+
+// callFunction calls a function from a call site in an Ink program, which
+// is only given when profiling or when the Engine has a Hook.
+func callFunction(fn Value, allowThunk bool, site *profileCall, args ...Value) (Value, error) {
 	if fnt, isFunc := fn.(FunctionValue); isFunc {
 		argValueTable := ValueTable{}
 		for i, argNode := range fnt.defn.arguments {
@@ -770,6 +872,7 @@ func evalInkFunction(fn Value, allowThunk bool, args ...Value) (Value, error) {
 		returnThunk := FunctionCallThunkValue{
 			vt:       argValueTable,
 			function: fnt,
+			call:     site,
 		}
 
 		if allowThunk {
@@ -777,7 +880,19 @@ func evalInkFunction(fn Value, allowThunk bool, args ...Value) (Value, error) {
 		}
 		return unwrapThunk(returnThunk)
 	} else if fnt, isNativeFunc := fn.(NativeFunctionValue); isNativeFunc {
-		return fnt.exec(fnt.ctx, args)
+		if p := fnt.ctx.Engine.Profiler; site != nil && p != nil {
+			p.push(nativeCall(fnt, site))
+			defer p.pop()
+		}
+
+		ctx := fnt.ctx
+		if ctx.Engine.Tracer != nil {
+			// callbacks queued by the builtin are traced with its name
+			traced := *ctx
+			traced.builtin = fnt.name
+			ctx = &traced
+		}
+		return fnt.exec(ctx, args)
 	} else {
 		return nil, Err{
 			ErrRuntime,
@@ -792,6 +907,10 @@ func (n MatchClauseNode) Eval(frame *StackFrame, allowThunk bool) (Value, error)
 }
 
 func (n MatchExprNode) Eval(frame *StackFrame, allowThunk bool) (Value, error) {
+	if frame.hooked() {
+		frame.ctx.Engine.Hook.EvalNode(frame.ctx, frame, n)
+	}
+
 	conditionVal, err := n.condition.Eval(frame, false)
 	if err != nil {
 		return nil, err
@@ -804,6 +923,10 @@ func (n MatchExprNode) Eval(frame *StackFrame, allowThunk bool) (Value, error) {
 		}
 
 		if conditionVal.Equals(targetVal) {
+			if frame.hooked() {
+				frame.ctx.Engine.Hook.MatchClause(frame.ctx, frame, cl)
+			}
+
 			rv, err := cl.expression.Eval(frame, allowThunk)
 			if err != nil {
 				return nil, err
@@ -819,6 +942,10 @@ func (n MatchExprNode) Eval(frame *StackFrame, allowThunk bool) (Value, error) {
 }
 
 func (n ExpressionListNode) Eval(frame *StackFrame, allowThunk bool) (Value, error) {
+	if frame.hooked() {
+		frame.ctx.Engine.Hook.EvalNode(frame.ctx, frame, n)
+	}
+
 	length := len(n.expressions)
 
 	if length == 0 {
@@ -828,6 +955,7 @@ func (n ExpressionListNode) Eval(frame *StackFrame, allowThunk bool) (Value, err
 	callFrame := &StackFrame{
 		parent: frame,
 		vt:     ValueTable{},
+		ctx:    frame.ctx,
 	}
 	for _, expr := range n.expressions[:length-1] {
 		_, err := expr.Eval(callFrame, false)
@@ -842,10 +970,18 @@ func (n ExpressionListNode) Eval(frame *StackFrame, allowThunk bool) (Value, err
 }
 
 func (n EmptyIdentifierNode) Eval(frame *StackFrame, allowThunk bool) (Value, error) {
+	if frame.hooked() {
+		frame.ctx.Engine.Hook.EvalNode(frame.ctx, frame, n)
+	}
+
 	return EmptyValue{}, nil
 }
 
 func (n IdentifierNode) Eval(frame *StackFrame, allowThunk bool) (Value, error) {
+	if frame.hooked() {
+		frame.ctx.Engine.Hook.EvalNode(frame.ctx, frame, n)
+	}
+
 	val, prs := frame.Get(n.val)
 	if !prs {
 		return nil, Err{
@@ -857,18 +993,34 @@ func (n IdentifierNode) Eval(frame *StackFrame, allowThunk bool) (Value, error)
 }
 
 func (n NumberLiteralNode) Eval(frame *StackFrame, allowThunk bool) (Value, error) {
+	if frame.hooked() {
+		frame.ctx.Engine.Hook.EvalNode(frame.ctx, frame, n)
+	}
+
 	return NumberValue(n.val), nil
 }
 
 func (n StringLiteralNode) Eval(frame *StackFrame, allowThunk bool) (Value, error) {
+	if frame.hooked() {
+		frame.ctx.Engine.Hook.EvalNode(frame.ctx, frame, n)
+	}
+
 	return StringValue(n.val), nil
 }
 
 func (n BooleanLiteralNode) Eval(frame *StackFrame, allowThunk bool) (Value, error) {
+	if frame.hooked() {
+		frame.ctx.Engine.Hook.EvalNode(frame.ctx, frame, n)
+	}
+
 	return BooleanValue(n.val), nil
 }
 
 func (n ObjectLiteralNode) Eval(frame *StackFrame, allowThunk bool) (Value, error) {
+	if frame.hooked() {
+		frame.ctx.Engine.Hook.EvalNode(frame.ctx, frame, n)
+	}
+
 	obj := CompositeValue{}
 	for _, entry := range n.entries {
 		keyStr, err := operandToStringKey(entry.key, frame)
@@ -890,6 +1042,10 @@ func (n ObjectEntryNode) Eval(frame *StackFrame, allowThunk bool) (Value, error)
 }
 
 func (n ListLiteralNode) Eval(frame *StackFrame, allowThunk bool) (Value, error) {
+	if frame.hooked() {
+		frame.ctx.Engine.Hook.EvalNode(frame.ctx, frame, n)
+	}
+
 	listVal := CompositeValue{}
 	for i, n := range n.vals {
 		var err error
@@ -903,6 +1059,10 @@ func (n ListLiteralNode) Eval(frame *StackFrame, allowThunk bool) (Value, error)
 }
 
 func (n FunctionLiteralNode) Eval(frame *StackFrame, allowThunk bool) (Value, error) {
+	if frame.hooked() {
+		frame.ctx.Engine.Hook.EvalNode(frame.ctx, frame, n)
+	}
+
 	return FunctionValue{
 		defn:        &n,
 		parentFrame: frame,
@@ -918,6 +1078,47 @@ type ValueTable map[string]Value
 type StackFrame struct {
 	parent *StackFrame
 	vt     ValueTable
+	// ctx is the Context in which the frame's code was defined
+	ctx *Context
+}
+
+// hooked reports whether evaluation in the frame should be reported to an
+// EvalHook. Callers check it before converting nodes to the Node interface
+// for the hook, which would allocate on every evaluation otherwise.
+func (frame *StackFrame) hooked() bool {
+	return frame.ctx != nil && frame.ctx.Engine.Hook != nil
+}
+
+// testing reports whether the frame belongs to a test run by the test
+// runner, which handles errors itself.
+func (frame *StackFrame) testing() bool {
+	return frame.ctx != nil && frame.ctx.Engine.errHandler != nil
+}
+
+// callSites reports whether function calls in the frame should keep track
+// of where they were called, to name functions in profiles, traces and hooks.
+func (frame *StackFrame) callSites() bool {
+	if frame.ctx == nil {
+		return false
+	}
+	eng := frame.ctx.Engine
+	return eng.Profiler != nil || eng.Hook != nil || (eng.Tracer != nil && eng.Tracer.Calls)
+}
+
+// tracer returns the Tracer of the frame's Engine, if any.
+func (frame *StackFrame) tracer() *Tracer {
+	if frame.ctx == nil {
+		return nil
+	}
+	return frame.ctx.Engine.Tracer
+}
+
+// profiler returns the Profiler sampling the frame's Engine, if any.
+func (frame *StackFrame) profiler() *Profiler {
+	if frame.ctx == nil {
+		return nil
+	}
+	return frame.ctx.Engine.Profiler
 }
 
 // Get a value from the stack frame chain
@@ -960,8 +1161,8 @@ func (frame *StackFrame) Up(name string, val Value) {
 
 func (frame *StackFrame) String() string {
 	entries := make([]string, 0, len(frame.vt))
-	for k, v := range frame.vt {
-		vstr := v.String()
+	for _, k := range sortedKeys(CompositeValue(frame.vt)) {
+		vstr := Pretty(frame.vt[k], PrettyConfig{Depth: 2})
 		if len(vstr) > maxPrintLen {
 			vstr = vstr[:maxPrintLen] + ".."
 		}
@@ -971,6 +1172,29 @@ func (frame *StackFrame) String() string {
 	return fmt.Sprintf("{\n\t%s\n} -prnt-> %s", strings.Join(entries, "\n\t"), frame.parent)
 }
 
+// EvalHook observes the evaluation of Ink programs in an Engine. Hooks are
+// called with the Engine's execution lock held, so they are never called
+// concurrently.
+type EvalHook interface {
+	// EvalNode is called before a node is evaluated in a stack frame.
+	EvalNode(ctx *Context, frame *StackFrame, n Node)
+	// MatchClause is called when a match expression takes a clause, after
+	// its target matched and before its expression is evaluated.
+	MatchClause(ctx *Context, frame *StackFrame, clause MatchClauseNode)
+}
+
+// CallHook may be implemented by an EvalHook to also observe calls to Ink
+// functions, as used by the debugger to keep track of the call stack.
+type CallHook interface {
+	// CallFunction is called when a function begins evaluating its body in
+	// a new stack frame. name is the name by which the function was called,
+	// like `std.map`. If tail is true, the call is a tail call, which replaces
+	// the frame of the function that made the call.
+	CallFunction(ctx *Context, frame *StackFrame, name string, tail bool)
+	// ReturnFunction is called when a function returns, or fails with an error.
+	ReturnFunction(ctx *Context)
+}
+
 // Engine is a single global context of Ink program execution.
 //
 // A single thread of execution may run within an Engine at any given moment,
@@ -997,9 +1221,26 @@ type Engine struct {
 	// nice functionality.
 	Contexts map[string]*Context
 
+	// If set, Hook observes the evaluation of every node in the Engine,
+	// as used for test coverage
+	Hook EvalHook
+
+	// If set, Profiler keeps track of the Ink call stack for profiling
+	Profiler *Profiler
+
+	// If set, Tracer records a timeline of execution in the Engine
+	Tracer *Tracer
+
 	// Only a single function may write to the stack frames
 	// at any moment.
 	evalLock sync.Mutex
+
+	// If set, errors from Contexts in the Engine are passed to
+	// errHandler instead of being logged, as in the test runner
+	errHandler func(Err)
+
+	// If set, skip() passes its reason to skipHandler, as in the test runner
+	skipHandler func(string)
 }
 
 // CreateContext creates and initializes a new Context tied to a given Engine.
@@ -1011,6 +1252,7 @@ func (eng *Engine) CreateContext() *Context {
 			vt:     ValueTable{},
 		},
 	}
+	ctx.Frame.ctx = ctx
 
 	// If first time creating Context in this Engine,
 	// initialize the Contexts map
@@ -1034,11 +1276,20 @@ type Context struct {
 	Engine *Engine
 	// Frame represents the Context's global heap
 	Frame *StackFrame
+
+	// builtin is the name of the builtin function called with this
+	// Context, if any, only when tracing
+	builtin string
 }
 
 // LogErr logs an Err (interpreter error) according to the configurations
 // specified in the Context's Engine.
 func (ctx *Context) LogErr(e Err) {
+	if ctx.Engine.errHandler != nil {
+		ctx.Engine.errHandler(e)
+		return
+	}
+
 	msg := e.message
 	if ctx.File != "" {
 		msg = e.message + " in " + ctx.File
@@ -1087,11 +1338,34 @@ func (ctx *Context) resetWd() {
 // in the syntax tree. Eval returns the last value of the last expression in the AST,
 // or an error if there was a runtime error.
 func (ctx *Context) Eval(nodes <-chan Node, dumpFrame bool) (val Value, err error) {
+	t := ctx.Engine.Tracer
+	var waitStart time.Time
+	if t != nil {
+		waitStart = time.Now()
+	}
+
 	ctx.Engine.evalLock.Lock()
 	defer ctx.Engine.evalLock.Unlock()
 
+	if t != nil {
+		t.wait("eval", waitStart)
+	}
+
+	if p := ctx.Engine.Profiler; p != nil {
+		p.push(topLevelCall(ctx))
+		defer p.pop()
+	}
+
 	for node := range nodes {
+		var start time.Time
+		if t != nil {
+			start = time.Now()
+		}
+
 		val, err = node.Eval(ctx.Frame, false)
+		if t != nil {
+			t.span("eval", traceName(ctx.File, node.Position()), start, nil)
+		}
 		if err != nil {
 			if e, isErr := err.(Err); isErr {
 				ctx.LogErr(e)
@@ -1114,13 +1388,50 @@ func (ctx *Context) ExecListener(callback func()) {
 	go func() {
 		defer ctx.Engine.Listeners.Done()
 
+		t := ctx.Engine.Tracer
+		var waitStart time.Time
+		if t != nil {
+			waitStart = time.Now()
+		}
+
 		ctx.Engine.evalLock.Lock()
 		defer ctx.Engine.evalLock.Unlock()
 
+		if t != nil {
+			name := "callback from " + ctx.builtin + "()"
+			t.wait(name, waitStart)
+
+			start := time.Now()
+			defer t.span("callback", name, start, map[string]interface{}{
+				"builtin": ctx.builtin,
+			})
+		}
+
 		callback()
 	}()
 }
 
+// ExecListenerAndWait queues a callback like ExecListener, but blocks until
+// the callback has run. Builtins that send many events to the same callback
+// use it to deliver events in order.
+func (ctx *Context) ExecListenerAndWait(callback func()) {
+	done := make(chan struct{})
+	ctx.ExecListener(func() {
+		defer close(done)
+		callback()
+	})
+	<-done
+}
+
+// WithLock runs fn while holding the Engine's execution lock, so fn can
+// safely read variables in the Engine while callbacks may be running.
+func (eng *Engine) WithLock(fn func()) {
+	eng.evalLock.Lock()
+	defer eng.evalLock.Unlock()
+
+	fn()
+}
+
 // Exec runs an Ink program defined by an io.Reader.
 // This is the main way to invoke Ink programs from Go.
 // Exec blocks until the Ink program exits.
@@ -0,0 +1,308 @@
+package ink
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// execChunkSize is the most bytes of output sent in one event by exec()
+// when streaming output.
+const execChunkSize = 4096
+
+// execOptions are the options exec() takes in place of stdin to stream the
+// output of a command.
+type execOptions struct {
+	stdin    StringValue
+	hasStdin bool
+	env      []string
+	dir      string
+	timeout  time.Duration
+}
+
+// parseExecOptions validates the options composite given to exec().
+func parseExecOptions(opts CompositeValue) (execOptions, error) {
+	parsed := execOptions{}
+	optErr := func(msg string) (execOptions, error) {
+		return execOptions{}, Err{
+			ErrRuntime,
+			fmt.Sprintf("invalid options to exec(), %s", msg),
+		}
+	}
+
+	if v, ok := opts["stdin"]; ok && v != Null {
+		stdin, isString := v.(StringValue)
+		if !isString {
+			return optErr(fmt.Sprintf("stdin must be a string, got %s", v))
+		}
+		// copied, since strings are mutable
+		parsed.stdin = append(StringValue{}, stdin...)
+		parsed.hasStdin = true
+	}
+
+	if v, ok := opts["env"]; ok && v != Null {
+		env, isComposite := v.(CompositeValue)
+		if !isComposite {
+			return optErr(fmt.Sprintf("env must be a composite, got %s", v))
+		}
+		names := make([]string, 0, len(env))
+		for name := range env {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		// variables given in env are added to the environment of the
+		// current process, and later entries override earlier ones
+		parsed.env = os.Environ()
+		for _, name := range names {
+			val, isString := env[name].(StringValue)
+			if !isString {
+				return optErr(fmt.Sprintf("env.%s must be a string, got %s", name, env[name]))
+			}
+			parsed.env = append(parsed.env, name+"="+string(val))
+		}
+	}
+
+	if v, ok := opts["dir"]; ok && v != Null {
+		dir, isString := v.(StringValue)
+		if !isString {
+			return optErr(fmt.Sprintf("dir must be a string, got %s", v))
+		}
+		parsed.dir = string(dir)
+	}
+
+	if v, ok := opts["timeout"]; ok && v != Null {
+		timeout, isNumber := v.(NumberValue)
+		if !isNumber || timeout <= 0 {
+			return optErr(fmt.Sprintf("timeout must be a positive number of seconds, got %s", v))
+		}
+		parsed.timeout = time.Duration(float64(timeout) * float64(time.Second))
+	}
+
+	return parsed, nil
+}
+
+// exitSignal returns the name of the signal that ended a process, or () if
+// it exited by itself or the platform does not report signals.
+func exitSignal(state *os.ProcessState) Value {
+	status, isSignalStatus := state.Sys().(interface {
+		Signaled() bool
+		Signal() syscall.Signal
+	})
+	if !isSignalStatus || !status.Signaled() {
+		return Null
+	}
+	return StringValue(status.Signal().String())
+}
+
+// inkExecStream is exec() called with an options composite, which runs a
+// command and sends its stdout and stderr to cb as they are written, then
+// its exit status. It returns functions to write to the command's stdin, to
+// close its stdin, and to kill the command.
+func inkExecStream(ctx *Context, path string, args []string, opts CompositeValue, cb FunctionValue) (Value, error) {
+	options, err := parseExecOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	send := func(event Value) {
+		ctx.ExecListenerAndWait(func() {
+			_, err := evalInkFunction(cb, false, event)
+			if err != nil {
+				ctx.LogErr(Err{
+					ErrRuntime,
+					fmt.Sprintf("error in callback to exec(), %s", err.Error()),
+				})
+			}
+		})
+	}
+	sendErr := func(msg string) {
+		send(errMsg(msg))
+	}
+	controls := func(write, end, close func(ctx *Context, in []Value) (Value, error)) CompositeValue {
+		return CompositeValue{
+			"write": NativeFunctionValue{name: "write", exec: write, ctx: ctx},
+			"end":   NativeFunctionValue{name: "end", exec: end, ctx: ctx},
+			"close": NativeFunctionValue{name: "close", exec: close, ctx: ctx},
+		}
+	}
+	checkWrite := func(in []Value) (StringValue, error) {
+		if len(in) < 1 {
+			return nil, Err{
+				ErrRuntime,
+				"write() takes 1 argument",
+			}
+		}
+		data, isString := in[0].(StringValue)
+		if !isString {
+			return nil, Err{
+				ErrRuntime,
+				fmt.Sprintf("write() takes a string argument, got %s", in[0]),
+			}
+		}
+		// copied, since strings are mutable
+		return append(StringValue{}, data...), nil
+	}
+
+	noop := func(ctx *Context, in []Value) (Value, error) {
+		return Null, nil
+	}
+	// controls of a command that never runs
+	noopControls := controls(func(ctx *Context, in []Value) (Value, error) {
+		_, err := checkWrite(in)
+		return Null, err
+	}, noop, noop)
+
+	if !ctx.Engine.Permissions.Exec {
+		// faked exit with no output
+		ctx.Engine.Listeners.Add(1)
+		go func() {
+			defer ctx.Engine.Listeners.Done()
+
+			send(CompositeValue{
+				"type":     StringValue("end"),
+				"exitCode": NumberValue(0),
+				"signal":   Null,
+			})
+		}()
+		return noopControls, nil
+	}
+
+	var cmdCtx context.Context
+	var cancel context.CancelFunc
+	if options.timeout > 0 {
+		cmdCtx, cancel = context.WithTimeout(context.Background(), options.timeout)
+	} else {
+		cmdCtx, cancel = context.WithCancel(context.Background())
+	}
+	cmd := exec.CommandContext(cmdCtx, path, args...)
+	cmd.Env = options.env
+	cmd.Dir = options.dir
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		cancel()
+		return nil, Err{ErrSystem, fmt.Sprintf("error creating stdin for exec(), %s", err.Error())}
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return nil, Err{ErrSystem, fmt.Sprintf("error creating stdout for exec(), %s", err.Error())}
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		cancel()
+		return nil, Err{ErrSystem, fmt.Sprintf("error creating stderr for exec(), %s", err.Error())}
+	}
+
+	ctx.Engine.Listeners.Add(1)
+	if err := cmd.Start(); err != nil {
+		cancel()
+		go func() {
+			defer ctx.Engine.Listeners.Done()
+
+			sendErr(fmt.Sprintf("error starting command in exec(), %s", err.Error()))
+		}()
+		return noopControls, nil
+	}
+
+	// writes to stdin happen in the order they were called, without
+	// blocking the Ink program while the command is busy
+	stdinQueue := serialQueue{}
+	stdinClosed := false
+	writeStdin := func(data StringValue) {
+		ctx.Engine.Listeners.Add(1)
+		stdinQueue.queue(func() {
+			defer ctx.Engine.Listeners.Done()
+
+			if stdinClosed {
+				return
+			}
+			if _, err := stdin.Write(data); err != nil {
+				// the command may have exited or closed its stdin, which
+				// is not an error in the Ink program
+				stdinClosed = true
+				stdin.Close()
+			}
+		})
+	}
+	closeStdin := func() {
+		ctx.Engine.Listeners.Add(1)
+		stdinQueue.queue(func() {
+			defer ctx.Engine.Listeners.Done()
+
+			if !stdinClosed {
+				stdinClosed = true
+				stdin.Close()
+			}
+		})
+	}
+	if options.hasStdin {
+		writeStdin(options.stdin)
+		closeStdin()
+	}
+
+	streamWg := sync.WaitGroup{}
+	stream := func(r io.Reader, name string) {
+		defer streamWg.Done()
+
+		buf := make([]byte, execChunkSize)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				send(CompositeValue{
+					"type": StringValue(name),
+					"data": StringValue(append([]byte{}, buf[:n]...)),
+				})
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	streamWg.Add(2)
+	go stream(stdout, "stdout")
+	go stream(stderr, "stderr")
+
+	go func() {
+		defer ctx.Engine.Listeners.Done()
+		defer cancel()
+
+		// all output must be read before waiting for the command
+		streamWg.Wait()
+		err := cmd.Wait()
+		if _, isExitErr := err.(*exec.ExitError); err != nil && !isExitErr {
+			sendErr(fmt.Sprintf("error waiting for command to exit in exec(), %s", err.Error()))
+			return
+		}
+
+		send(CompositeValue{
+			"type":     StringValue("end"),
+			"exitCode": NumberValue(cmd.ProcessState.ExitCode()),
+			"signal":   exitSignal(cmd.ProcessState),
+		})
+	}()
+
+	return controls(func(ctx *Context, in []Value) (Value, error) {
+		data, err := checkWrite(in)
+		if err != nil {
+			return nil, err
+		}
+		writeStdin(data)
+		return Null, nil
+	}, func(ctx *Context, in []Value) (Value, error) {
+		closeStdin()
+		return Null, nil
+	}, func(ctx *Context, in []Value) (Value, error) {
+		// killing the command ends it with a signal, which is
+		// reported to the callback
+		cancel()
+		return Null, nil
+	}), nil
+}
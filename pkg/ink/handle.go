@@ -0,0 +1,304 @@
+package ink
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// fileModes are the modes accepted by open(), like those of C's fopen, and
+// the flags they open files with.
+var fileModes = map[string]int{
+	"r":  os.O_RDONLY,
+	"w":  os.O_WRONLY | os.O_CREATE | os.O_TRUNC,
+	"a":  os.O_WRONLY | os.O_CREATE | os.O_APPEND,
+	"r+": os.O_RDWR,
+	"w+": os.O_RDWR | os.O_CREATE | os.O_TRUNC,
+	"a+": os.O_RDWR | os.O_CREATE | os.O_APPEND,
+}
+
+// seekWhence maps the names of positions accepted by a handle's seek() to
+// the whence argument of os.File.Seek.
+var seekWhence = map[string]int{
+	"start":   io.SeekStart,
+	"current": io.SeekCurrent,
+	"end":     io.SeekEnd,
+}
+
+// fileHandle is an open file returned by open(). Operations on a handle run
+// in the background in the order they were called, so a program can call
+// read() or write() many times without waiting for each callback.
+//
+// If the Engine does not have permission to read the file, reads return no
+// data, and if it does not have permission to write, writes do nothing, as
+// with read() and write().
+type fileHandle struct {
+	ctx  *Context
+	path string
+
+	// readable and writable are whether the mode allows reading and
+	// writing, and canRead and canWrite whether the Engine has permission
+	// to do so. file is nil if the handle has no permission to access the
+	// file at all.
+	file     *os.File
+	readable bool
+	writable bool
+	canRead  bool
+	canWrite bool
+
+	ops    serialQueue
+	closed bool
+}
+
+// openFile opens a file for a handle with the given mode, dropping the
+// parts of the mode that the Engine does not have permission for.
+func openFile(ctx *Context, path, mode string) (*fileHandle, error) {
+	flag := fileModes[mode]
+	h := &fileHandle{
+		ctx:      ctx,
+		path:     path,
+		readable: flag&(os.O_WRONLY|os.O_RDWR) != os.O_WRONLY,
+		writable: flag&(os.O_WRONLY|os.O_RDWR) != 0,
+	}
+	h.canRead = h.readable && ctx.Engine.Permissions.Read
+	h.canWrite = h.writable && ctx.Engine.Permissions.Write
+
+	if !h.canWrite && flag&os.O_TRUNC != 0 {
+		// without permission to write, a file opened to be truncated
+		// should read as empty, like a newly truncated file
+		h.canRead = false
+	}
+
+	switch {
+	case h.canRead && h.canWrite:
+		flag = flag&^os.O_WRONLY | os.O_RDWR
+	case h.canRead:
+		flag = os.O_RDONLY
+	case h.canWrite:
+		flag = flag&^os.O_RDWR | os.O_WRONLY
+	default:
+		return h, nil
+	}
+
+	file, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		if os.IsNotExist(err) && !h.canWrite && fileModes[mode]&os.O_CREATE != 0 {
+			// the file would have been created empty
+			h.canRead = false
+			return h, nil
+		}
+		return nil, err
+	}
+	h.file = file
+	return h, nil
+}
+
+// serialQueue runs functions in the background one after another, in the
+// order they were queued, without keeping a goroutine alive while idle.
+type serialQueue struct {
+	mu      sync.Mutex
+	running bool
+	pending []func()
+}
+
+// queue runs op after all operations queued before it have finished.
+func (q *serialQueue) queue(op func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.pending = append(q.pending, op)
+	if q.running {
+		return
+	}
+	q.running = true
+	go func() {
+		for {
+			q.mu.Lock()
+			if len(q.pending) == 0 {
+				q.running = false
+				q.mu.Unlock()
+				return
+			}
+			next := q.pending[0]
+			q.pending = q.pending[1:]
+			q.mu.Unlock()
+
+			next()
+		}
+	}()
+}
+
+// callback sends an event to an Ink callback, and logs any error the
+// callback raises as coming from the named method. It waits for the callback
+// to return, so callbacks are called in the order of their operations.
+func (h *fileHandle) callback(name string, cb FunctionValue, event Value) {
+	h.ctx.ExecListenerAndWait(func() {
+		_, err := evalInkFunction(cb, false, event)
+		if err != nil {
+			h.ctx.LogErr(Err{
+				ErrRuntime,
+				fmt.Sprintf("error in callback to %s(), %s", name, err.Error()),
+			})
+		}
+	})
+}
+
+// do queues an operation of the named method, which sends its callback an
+// error event if the handle is closed or if op returns an error, and
+// otherwise the event returned by op.
+func (h *fileHandle) do(name string, cb FunctionValue, op func() (Value, error)) {
+	h.ctx.Engine.Listeners.Add(1)
+	h.ops.queue(func() {
+		defer h.ctx.Engine.Listeners.Done()
+
+		var event Value
+		if h.closed {
+			event = errMsg(fmt.Sprintf("error in %s(), file %s is closed", name, h.path))
+		} else if ev, err := op(); err != nil {
+			event = errMsg(fmt.Sprintf("error in %s(), %s", name, err.Error()))
+		} else {
+			event = ev
+		}
+		h.callback(name, cb, event)
+	})
+}
+
+// method returns a handle method as a native function, checking that it is
+// called with a callback after its other arguments. run returns false if the
+// other arguments are of the wrong types.
+func (h *fileHandle) method(name string, argc int, usage string,
+	run func(args []Value, cb FunctionValue) bool) NativeFunctionValue {
+	name = "handle." + name
+	return NativeFunctionValue{
+		name: name,
+		exec: func(ctx *Context, in []Value) (Value, error) {
+			if len(in) < argc+1 {
+				return nil, Err{
+					ErrRuntime,
+					fmt.Sprintf("%s() takes %d arguments: %s, but got %d", name, argc+1, usage, len(in)),
+				}
+			}
+			cb, isCbFunction := in[argc].(FunctionValue)
+			if !isCbFunction || !run(in[:argc], cb) {
+				return nil, Err{
+					ErrRuntime,
+					fmt.Sprintf("unsupported combination of argument types in %s()", name),
+				}
+			}
+			return Null, nil
+		},
+		ctx: h.ctx,
+	}
+}
+
+// value returns the composite that represents the handle in Ink programs.
+func (h *fileHandle) value(mode string) CompositeValue {
+	return CompositeValue{
+		"path": StringValue(h.path),
+		"mode": StringValue(mode),
+		"read": h.method("read", 1, "length and callback", func(args []Value, cb FunctionValue) bool {
+			length, isNumber := args[0].(NumberValue)
+			if !isNumber || length < 0 {
+				return false
+			}
+			h.do("handle.read", cb, func() (Value, error) {
+				if !h.readable {
+					return nil, fmt.Errorf("file %s is not open for reading", h.path)
+				}
+				if !h.canRead {
+					return CompositeValue{
+						"type": StringValue("data"),
+						"data": StringValue{},
+					}, nil
+				}
+
+				buf := make([]byte, int64(length))
+				count, err := io.ReadFull(h.file, buf)
+				if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+					return nil, err
+				}
+				return CompositeValue{
+					"type": StringValue("data"),
+					"data": StringValue(buf[:count]),
+				}, nil
+			})
+			return true
+		}),
+		"write": h.method("write", 1, "data and callback", func(args []Value, cb FunctionValue) bool {
+			data, isString := args[0].(StringValue)
+			if !isString {
+				return false
+			}
+			// copied, since strings are mutable
+			data = append(StringValue{}, data...)
+			h.do("handle.write", cb, func() (Value, error) {
+				if !h.writable {
+					return nil, fmt.Errorf("file %s is not open for writing", h.path)
+				}
+				if h.canWrite {
+					if _, err := h.file.Write(data); err != nil {
+						return nil, err
+					}
+				}
+				return CompositeValue{
+					"type": StringValue("end"),
+				}, nil
+			})
+			return true
+		}),
+		"seek": h.method("seek", 2, "offset, whence ('start', 'current', or 'end'), and callback", func(args []Value, cb FunctionValue) bool {
+			offset, isNumber := args[0].(NumberValue)
+			whenceName, isString := args[1].(StringValue)
+			whence, isWhence := seekWhence[string(whenceName)]
+			if !isNumber || !isString || !isWhence {
+				return false
+			}
+			h.do("handle.seek", cb, func() (Value, error) {
+				if h.file == nil {
+					return CompositeValue{
+						"type": StringValue("data"),
+						"data": NumberValue(0),
+					}, nil
+				}
+
+				pos, err := h.file.Seek(int64(offset), whence)
+				if err != nil {
+					return nil, err
+				}
+				return CompositeValue{
+					"type": StringValue("data"),
+					"data": NumberValue(pos),
+				}, nil
+			})
+			return true
+		}),
+		"sync": h.method("sync", 0, "callback", func(args []Value, cb FunctionValue) bool {
+			h.do("handle.sync", cb, func() (Value, error) {
+				if h.canWrite {
+					if err := h.file.Sync(); err != nil {
+						return nil, err
+					}
+				}
+				return CompositeValue{
+					"type": StringValue("end"),
+				}, nil
+			})
+			return true
+		}),
+		"close": h.method("close", 0, "callback", func(args []Value, cb FunctionValue) bool {
+			h.do("handle.close", cb, func() (Value, error) {
+				h.closed = true
+				if h.file != nil {
+					if err := h.file.Close(); err != nil {
+						return nil, err
+					}
+				}
+				return CompositeValue{
+					"type": StringValue("end"),
+				}, nil
+			})
+			return true
+		}),
+	}
+}
@@ -0,0 +1,748 @@
+package ink
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// httpChunkSize is the most bytes of a body sent in one event when
+// streaming request and response bodies.
+const httpChunkSize = 4096
+
+// stringValues returns the strings in a value that is either a string or a
+// list of strings, as header values and query parameters may be.
+func stringValues(v Value) ([]string, bool) {
+	switch val := v.(type) {
+	case StringValue:
+		return []string{string(val)}, true
+	case CompositeValue:
+		values := make([]string, len(val))
+		for i := range values {
+			str, isStr := val[strconv.Itoa(i)].(StringValue)
+			if !isStr {
+				return nil, false
+			}
+			values[i] = string(str)
+		}
+		return values, true
+	default:
+		return nil, false
+	}
+}
+
+// setHeaders sets headers given by Ink, where each header is a string, or a
+// list of strings to send the header several times.
+func setHeaders(header http.Header, headers CompositeValue) error {
+	for k, v := range headers {
+		values, ok := stringValues(v)
+		if !ok {
+			return Err{
+				ErrRuntime,
+				fmt.Sprintf("could not set header %s, value %s was not a string or list of strings", k, v),
+			}
+		}
+
+		header.Del(k)
+		for _, value := range values {
+			header.Add(k, value)
+		}
+	}
+	return nil
+}
+
+// headersValue returns headers for Ink in two forms. In headers, each header
+// is a string, with the values of a header sent several times joined by ", "
+// as HTTP allows. In values, each header is a list of all of its values,
+// which keeps headers like Set-Cookie that cannot be joined intact.
+func headersValue(header http.Header) (headers CompositeValue, values CompositeValue) {
+	headers, values = CompositeValue{}, CompositeValue{}
+	for k, vs := range header {
+		headers[k] = StringValue(strings.Join(vs, ", "))
+
+		list := CompositeValue{}
+		for i, v := range vs {
+			list[strconv.Itoa(i)] = StringValue(v)
+		}
+		values[k] = list
+	}
+	return headers, values
+}
+
+// parseResponse validates a response composite {status, headers, body} given
+// to end() by a listen() handler.
+func parseResponse(resp Value) (int, http.Header, StringValue, error) {
+	rsp, isComposite := resp.(CompositeValue)
+	if !isComposite {
+		return 0, nil, nil, Err{
+			ErrRuntime,
+			fmt.Sprintf("callback to listen() should return a response, got %s", resp),
+		}
+	}
+
+	resStatus, okStatus := rsp["status"].(NumberValue)
+	resHeaders, okHeaders := rsp["headers"].(CompositeValue)
+	resBody, okBody := rsp["body"].(StringValue)
+	if !okStatus || !okHeaders || !okBody {
+		return 0, nil, nil, Err{
+			ErrRuntime,
+			fmt.Sprintf("callback to listen() returned malformed response, %s", rsp),
+		}
+	}
+
+	code, header, err := parseResponseHead(resStatus, resHeaders)
+	return code, header, resBody, err
+}
+
+// parseResponseHead validates the status and headers of a response from a
+// listen() handler.
+func parseResponseHead(status NumberValue, headers CompositeValue) (int, http.Header, error) {
+	header := http.Header{}
+	if err := setHeaders(header, headers); err != nil {
+		return 0, nil, err
+	}
+
+	code := int(status)
+	// guard against invalid HTTP codes, which cause Go panics.
+	// https://golang.org/src/net/http/server.go
+	if code < 100 || code > 599 {
+		return 0, nil, Err{
+			ErrRuntime,
+			fmt.Sprintf("could not set response status code, code %d is not valid", code),
+		}
+	}
+
+	return code, header, nil
+}
+
+// streamBody reads a request or response body and sends it to cb in chunks
+// as {type: 'data', data} events, followed by {type: 'end'}. It blocks until
+// the last event has been handled.
+func streamBody(ctx *Context, name string, body io.Reader, cb Value) {
+	send := func(event Value) {
+		ctx.ExecListenerAndWait(func() {
+			_, err := evalInkFunction(cb, false, event)
+			if err != nil {
+				ctx.LogErr(Err{
+					ErrRuntime,
+					fmt.Sprintf("error in callback to %s(), %s", name, err.Error()),
+				})
+			}
+		})
+	}
+
+	buf := make([]byte, httpChunkSize)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			send(CompositeValue{
+				"type": StringValue("data"),
+				"data": StringValue(append([]byte{}, buf[:n]...)),
+			})
+		}
+		if err == io.EOF {
+			send(CompositeValue{
+				"type": StringValue("end"),
+			})
+			return
+		} else if err != nil {
+			send(errMsg(fmt.Sprintf("error reading body in %s(), %s", name, err.Error())))
+			return
+		}
+	}
+}
+
+// serveStream handles a request to a listen() server started with the
+// stream option. Rather than reading the whole request body before calling
+// the handler and taking a whole response, it gives the handler functions
+// to read the body in chunks and to write the response in parts.
+func (h inkHTTPHandler) serveStream(w http.ResponseWriter, r *http.Request, request CompositeValue) {
+	ctx := h.ctx
+	cb := h.inkCallback
+
+	sendErr := func(msg string) {
+		ctx.ExecListener(func() {
+			_, err := evalInkFunction(cb, false, errMsg(msg))
+			if err != nil {
+				ctx.LogErr(Err{
+					ErrRuntime,
+					fmt.Sprintf("error in callback to listen(), %s", err.Error()),
+				})
+			}
+		})
+	}
+
+	// these are only read and changed by native functions called from
+	// Ink, which hold the Engine's eval lock
+	bodyRead := false
+	headWritten := false
+	ended := false
+	upgradeCalled := false
+	// after upgrade(), the connection belongs to the WebSocket
+	checkUpgraded := func(name string) error {
+		if upgradeCalled {
+			return Err{
+				ErrRuntime,
+				fmt.Sprintf("%s() callback to listen() was called after upgrade()", name),
+			}
+		}
+		return nil
+	}
+
+	// writes to the response happen in the order they were called, in the
+	// background, and this handler returns once the response has ended
+	writes := serialQueue{}
+	done := make(chan struct{})
+	writeFailed := false
+	flusher, canFlush := w.(http.Flusher)
+
+	// the handler also returns if the client goes away first, after which
+	// queued writes must not touch the response
+	var returnedLock sync.Mutex
+	returned := false
+	respond := func(op func()) {
+		writes.queue(func() {
+			returnedLock.Lock()
+			defer returnedLock.Unlock()
+
+			if !returned {
+				op()
+			}
+		})
+	}
+
+	// the server closes the request body once the handler returns, so the
+	// handler waits for a read() in progress to reach the end of the body
+	var reads sync.WaitGroup
+
+	writeHead := func(code int, header http.Header) {
+		headWritten = true
+		respond(func() {
+			for k, v := range header {
+				w.Header()[k] = v
+			}
+			// status code write must follow all other header writes,
+			// since it sends the status
+			w.WriteHeader(code)
+		})
+	}
+	write := func(data StringValue) {
+		respond(func() {
+			if writeFailed {
+				return
+			}
+			if _, err := w.Write(data); err != nil {
+				writeFailed = true
+				sendErr(fmt.Sprintf("error writing response body in listen(), %s", err.Error()))
+				return
+			}
+			if canFlush {
+				flusher.Flush()
+			}
+		})
+	}
+
+	readFn := func(ctx *Context, in []Value) (Value, error) {
+		if len(in) < 1 {
+			return nil, Err{
+				ErrRuntime,
+				"read() callback to listen() takes 1 argument",
+			}
+		}
+		readCb, isCbFunction := in[0].(FunctionValue)
+		if !isCbFunction {
+			return nil, Err{
+				ErrRuntime,
+				fmt.Sprintf("read() callback to listen() takes a callback, got %s", in[0]),
+			}
+		}
+		if bodyRead {
+			return nil, Err{
+				ErrRuntime,
+				"read() callback to listen() was called more than once",
+			}
+		}
+		if ended {
+			return nil, Err{
+				ErrRuntime,
+				"read() callback to listen() was called after end()",
+			}
+		}
+		if err := checkUpgraded("read"); err != nil {
+			return nil, err
+		}
+		bodyRead = true
+
+		reads.Add(1)
+		ctx.Engine.Listeners.Add(1)
+		go func() {
+			defer ctx.Engine.Listeners.Done()
+			defer reads.Done()
+
+			streamBody(ctx, "listen", r.Body, readCb)
+		}()
+		return Null, nil
+	}
+
+	writeHeadFn := func(ctx *Context, in []Value) (Value, error) {
+		if len(in) < 2 {
+			return nil, Err{
+				ErrRuntime,
+				"writeHead() callback to listen() takes 2 arguments: status and headers",
+			}
+		}
+		status, isNumber := in[0].(NumberValue)
+		headers, isComposite := in[1].(CompositeValue)
+		if !isNumber || !isComposite {
+			return nil, Err{
+				ErrRuntime,
+				"unsupported combination of argument types in writeHead() callback to listen()",
+			}
+		}
+		if headWritten || ended {
+			return nil, Err{
+				ErrRuntime,
+				"writeHead() callback to listen() was called after the response started",
+			}
+		}
+		if err := checkUpgraded("writeHead"); err != nil {
+			return nil, err
+		}
+
+		code, header, err := parseResponseHead(status, headers)
+		if err != nil {
+			return nil, err
+		}
+		writeHead(code, header)
+		return Null, nil
+	}
+
+	writeFn := func(ctx *Context, in []Value) (Value, error) {
+		if len(in) < 1 {
+			return nil, Err{
+				ErrRuntime,
+				"write() callback to listen() takes 1 argument",
+			}
+		}
+		data, isString := in[0].(StringValue)
+		if !isString {
+			return nil, Err{
+				ErrRuntime,
+				fmt.Sprintf("write() callback to listen() takes a string, got %s", in[0]),
+			}
+		}
+		if ended {
+			return nil, Err{
+				ErrRuntime,
+				"write() callback to listen() was called after end()",
+			}
+		}
+		if err := checkUpgraded("write"); err != nil {
+			return nil, err
+		}
+
+		// writing without writeHead() sends status 200
+		headWritten = true
+		// copied, since strings are mutable
+		write(append(StringValue{}, data...))
+		return Null, nil
+	}
+
+	endFn := func(ctx *Context, in []Value) (Value, error) {
+		if ended {
+			return nil, Err{
+				ErrRuntime,
+				"end() callback to listen() was called more than once",
+			}
+		}
+		if err := checkUpgraded("end"); err != nil {
+			return nil, err
+		}
+
+		// end() may also be given a whole response, as without streaming
+		if len(in) > 0 {
+			if headWritten {
+				return nil, Err{
+					ErrRuntime,
+					"end() callback to listen() was given a response after the response started",
+				}
+			}
+
+			code, header, body, err := parseResponse(in[0])
+			if err != nil {
+				return nil, err
+			}
+			writeHead(code, header)
+			write(append(StringValue{}, body...))
+		}
+
+		ended = true
+		writes.queue(func() {
+			close(done)
+		})
+		return Null, nil
+	}
+
+	// the handler may instead upgrade the request to a WebSocket
+	upgraded := make(chan struct{})
+	upgradeFn := wsUpgradeFn(w, r, &upgradeCalled, func() bool {
+		return headWritten || ended
+	}, func() { close(upgraded) })
+
+	ctx.ExecListener(func() {
+		_, err := evalInkFunction(cb, false, CompositeValue{
+			"type":      StringValue("req"),
+			"data":      request,
+			"read":      NativeFunctionValue{name: "read", exec: readFn, ctx: ctx},
+			"writeHead": NativeFunctionValue{name: "writeHead", exec: writeHeadFn, ctx: ctx},
+			"write":     NativeFunctionValue{name: "write", exec: writeFn, ctx: ctx},
+			"end":       NativeFunctionValue{name: "end", exec: endFn, ctx: ctx},
+			"upgrade": NativeFunctionValue{
+				name: "upgrade",
+				exec: upgradeFn,
+				ctx:  ctx,
+			},
+		})
+		if err != nil {
+			ctx.LogErr(Err{
+				ErrRuntime,
+				fmt.Sprintf("error in callback to listen(), %s", err.Error()),
+			})
+		}
+	})
+
+	select {
+	case <-done:
+		drained := make(chan struct{})
+		go func() {
+			reads.Wait()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case <-r.Context().Done():
+		}
+	case <-upgraded:
+		return
+	case <-r.Context().Done():
+	}
+
+	returnedLock.Lock()
+	returned = true
+	returnedLock.Unlock()
+}
+
+// reqOptions are the options to req() that configure how a request is sent,
+// rather than the request itself.
+type reqOptions struct {
+	// timeout limits the whole request, including reading the response
+	// body, if it is not zero
+	timeout time.Duration
+	// maxRedirects is the number of redirects followed before returning a
+	// redirect response, by default none
+	maxRedirects int
+	jar          http.CookieJar
+	proxy        *url.URL
+	query        url.Values
+	tls          *tlsOptions
+}
+
+// parseReqOptions validates the options to a req() request.
+func parseReqOptions(ctx *Context, data CompositeValue) (reqOptions, error) {
+	options := reqOptions{}
+	malformed := func(name string, v Value) error {
+		return Err{
+			ErrRuntime,
+			fmt.Sprintf("%s option to req() is malformed, got %s", name, v),
+		}
+	}
+
+	if v, ok := data["timeout"]; ok {
+		timeout, isNumber := v.(NumberValue)
+		if !isNumber || timeout < 0 {
+			return options, malformed("timeout", v)
+		}
+		options.timeout = time.Duration(float64(timeout) * float64(time.Second))
+	}
+
+	if v, ok := data["maxRedirects"]; ok {
+		maxRedirects, isNumber := v.(NumberValue)
+		if !isNumber || maxRedirects < 0 {
+			return options, malformed("maxRedirects", v)
+		}
+		options.maxRedirects = int(maxRedirects)
+	}
+
+	if v, ok := data["jar"]; ok {
+		jar, isComposite := v.(CompositeValue)
+		if !isComposite || !isFunctionValue(jar["cookies"]) || !isFunctionValue(jar["setCookies"]) {
+			return options, malformed("jar", v)
+		}
+		options.jar = inkJar{ctx: ctx, jar: jar}
+	}
+
+	if v, ok := data["proxy"]; ok {
+		proxy, isString := v.(StringValue)
+		if !isString {
+			return options, malformed("proxy", v)
+		}
+		proxyURL, err := url.Parse(string(proxy))
+		if err != nil {
+			return options, malformed("proxy", v)
+		}
+		options.proxy = proxyURL
+	}
+
+	if v, ok := data["query"]; ok {
+		query, isComposite := v.(CompositeValue)
+		if !isComposite {
+			return options, malformed("query", v)
+		}
+		options.query = url.Values{}
+		for k, param := range query {
+			values, ok := stringValues(param)
+			if !ok {
+				return options, malformed("query", v)
+			}
+			options.query[k] = values
+		}
+	}
+
+	tlsOpts, err := parseTLSOptions(ctx, "req", data)
+	if err != nil {
+		return options, err
+	}
+	options.tls = tlsOpts
+
+	return options, nil
+}
+
+func isFunctionValue(v Value) bool {
+	switch v.(type) {
+	case FunctionValue, NativeFunctionValue:
+		return true
+	default:
+		return false
+	}
+}
+
+// cookieValue returns a cookie for Ink, as
+// {name, value, path, domain, expires, maxAge, secure, httpOnly}, leaving
+// out attributes that are not set.
+func cookieValue(c *http.Cookie) CompositeValue {
+	cookie := CompositeValue{
+		"name":     StringValue(c.Name),
+		"value":    StringValue(c.Value),
+		"secure":   BooleanValue(c.Secure),
+		"httpOnly": BooleanValue(c.HttpOnly),
+	}
+	if c.Path != "" {
+		cookie["path"] = StringValue(c.Path)
+	}
+	if c.Domain != "" {
+		cookie["domain"] = StringValue(c.Domain)
+	}
+	if !c.Expires.IsZero() {
+		cookie["expires"] = NumberValue(c.Expires.Unix())
+	}
+	if c.MaxAge != 0 {
+		cookie["maxAge"] = NumberValue(c.MaxAge)
+	}
+	return cookie
+}
+
+// httpCookie reads a cookie given by Ink in the form returned by
+// cookieValue. Only name and value are required.
+func httpCookie(v Value) (*http.Cookie, bool) {
+	cookie, isComposite := v.(CompositeValue)
+	if !isComposite {
+		return nil, false
+	}
+	name, okName := cookie["name"].(StringValue)
+	value, okValue := cookie["value"].(StringValue)
+	if !okName || !okValue {
+		return nil, false
+	}
+
+	c := &http.Cookie{
+		Name:  string(name),
+		Value: string(value),
+	}
+	for k, attr := range cookie {
+		ok := true
+		switch k {
+		case "path":
+			var path StringValue
+			path, ok = attr.(StringValue)
+			c.Path = string(path)
+		case "domain":
+			var domain StringValue
+			domain, ok = attr.(StringValue)
+			c.Domain = string(domain)
+		case "expires":
+			var expires NumberValue
+			expires, ok = attr.(NumberValue)
+			c.Expires = time.Unix(int64(expires), 0)
+		case "maxAge":
+			var maxAge NumberValue
+			maxAge, ok = attr.(NumberValue)
+			c.MaxAge = int(maxAge)
+		case "secure":
+			var secure BooleanValue
+			secure, ok = attr.(BooleanValue)
+			c.Secure = bool(secure)
+		case "httpOnly":
+			var httpOnly BooleanValue
+			httpOnly, ok = attr.(BooleanValue)
+			c.HttpOnly = bool(httpOnly)
+		}
+		if !ok {
+			return nil, false
+		}
+	}
+	return c, true
+}
+
+// cookieList returns cookies for Ink as a list.
+func cookieList(cookies []*http.Cookie) CompositeValue {
+	list := CompositeValue{}
+	for i, c := range cookies {
+		list[strconv.Itoa(i)] = cookieValue(c)
+	}
+	return list
+}
+
+// httpCookies reads a list of cookies given by Ink.
+func httpCookies(v Value) ([]*http.Cookie, bool) {
+	list, isComposite := v.(CompositeValue)
+	if !isComposite {
+		return nil, false
+	}
+
+	cookies := make([]*http.Cookie, len(list))
+	for i := range cookies {
+		c, ok := httpCookie(list[strconv.Itoa(i)])
+		if !ok {
+			return nil, false
+		}
+		cookies[i] = c
+	}
+	return cookies, true
+}
+
+// inkJar is a cookie jar for req() kept by an Ink program, as a
+// composite with functions cookies(url) => list, returning the cookies to
+// send to a URL, and setCookies(url, list), storing cookies sent by it. The
+// functions are called on the Ink thread, in between other callbacks.
+type inkJar struct {
+	ctx *Context
+	jar CompositeValue
+}
+
+func (j inkJar) call(fn string, args ...Value) Value {
+	var result Value = Null
+	j.ctx.ExecListenerAndWait(func() {
+		var err error
+		result, err = evalInkFunction(j.jar[fn], false, args...)
+		if err != nil {
+			j.ctx.LogErr(Err{
+				ErrRuntime,
+				fmt.Sprintf("error in %s() of cookie jar given to req(), %s", fn, err.Error()),
+			})
+		}
+	})
+	return result
+}
+
+func (j inkJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.call("setCookies", StringValue(u.String()), cookieList(cookies))
+}
+
+func (j inkJar) Cookies(u *url.URL) []*http.Cookie {
+	result := j.call("cookies", StringValue(u.String()))
+	cookies, ok := httpCookies(result)
+	if !ok {
+		j.ctx.LogErr(Err{
+			ErrRuntime,
+			fmt.Sprintf("cookies() of cookie jar given to req() should return a list of cookies, got %s", result),
+		})
+		return nil
+	}
+	return cookies
+}
+
+// cookieJarValue returns a new cookie jar for req(), which keeps cookies in
+// memory following the usual rules for which cookies are sent where.
+func cookieJarValue(ctx *Context) CompositeValue {
+	// cookiejar.New only fails given bad options
+	jar, _ := cookiejar.New(nil)
+
+	urlArg := func(name string, in []Value) (*url.URL, error) {
+		if len(in) < 1 {
+			return nil, Err{
+				ErrRuntime,
+				fmt.Sprintf("%s() of cookie jar takes a URL", name),
+			}
+		}
+		str, isString := in[0].(StringValue)
+		if !isString {
+			return nil, Err{
+				ErrRuntime,
+				fmt.Sprintf("%s() of cookie jar takes a URL string, got %s", name, in[0]),
+			}
+		}
+		u, err := url.Parse(string(str))
+		if err != nil {
+			return nil, Err{
+				ErrRuntime,
+				fmt.Sprintf("%s() of cookie jar got an invalid URL, %s", name, err.Error()),
+			}
+		}
+		return u, nil
+	}
+
+	return CompositeValue{
+		"cookies": NativeFunctionValue{
+			name: "cookies",
+			exec: func(ctx *Context, in []Value) (Value, error) {
+				u, err := urlArg("cookies", in)
+				if err != nil {
+					return nil, err
+				}
+				return cookieList(jar.Cookies(u)), nil
+			},
+			ctx: ctx,
+		},
+		"setCookies": NativeFunctionValue{
+			name: "setCookies",
+			exec: func(ctx *Context, in []Value) (Value, error) {
+				u, err := urlArg("setCookies", in)
+				if err != nil {
+					return nil, err
+				}
+				if len(in) < 2 {
+					return nil, Err{
+						ErrRuntime,
+						"setCookies() of cookie jar takes 2 arguments: url and cookies",
+					}
+				}
+				cookies, ok := httpCookies(in[1])
+				if !ok {
+					return nil, Err{
+						ErrRuntime,
+						fmt.Sprintf("setCookies() of cookie jar takes a list of cookies, got %s", in[1]),
+					}
+				}
+				jar.SetCookies(u, cookies)
+				return Null, nil
+			},
+			ctx: ctx,
+		},
+	}
+}
@@ -0,0 +1,286 @@
+package ink
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// errInterrupted is returned by lineEditor.readLine when the user cancels
+// the line being edited with Ctrl-C.
+var errInterrupted = errors.New("interrupted")
+
+// lineEditor reads lines of input from a terminal, with support for moving
+// the cursor, recalling history, and completing names with Tab. If input is
+// not a terminal, it reads lines as they are.
+type lineEditor struct {
+	file     *os.File
+	in       *bufio.Reader
+	out      io.Writer
+	terminal bool
+
+	history []string
+	// complete returns the possible completions of the word ending at the
+	// end of text, and the index in text at which the word begins
+	complete func(text string) ([]string, int)
+}
+
+func newLineEditor(in *os.File, out io.Writer) *lineEditor {
+	stat, err := in.Stat()
+	return &lineEditor{
+		file:     in,
+		in:       bufio.NewReader(in),
+		out:      out,
+		terminal: err == nil && stat.Mode()&os.ModeCharDevice != 0,
+	}
+}
+
+// stty runs the stty command on the terminal, which is the most portable
+// way to change terminal modes without depending on the platform.
+func (e *lineEditor) stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = e.file
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// rawMode puts the terminal in a mode where each key press can be read as
+// it is typed and is not printed, and returns a function to restore the
+// terminal's previous mode.
+func (e *lineEditor) rawMode() (func(), error) {
+	state, err := e.stty("-g")
+	if err != nil {
+		return nil, err
+	}
+	_, err = e.stty("-icanon", "-echo", "-isig", "-ixon", "min", "1")
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		e.stty(state)
+	}, nil
+}
+
+// readLine reads a line of input after printing prompt. It returns io.EOF
+// when input ends, and errInterrupted if the user cancels the line.
+func (e *lineEditor) readLine(prompt string) (string, error) {
+	if !e.terminal {
+		return e.readPlainLine(prompt)
+	}
+
+	restore, err := e.rawMode()
+	if err != nil {
+		e.terminal = false
+		return e.readPlainLine(prompt)
+	}
+	defer restore()
+
+	line := []rune{}
+	cursor := 0
+	// historyIdx is the index in history of the line being edited,
+	// and draft the new line being written before recalling history
+	historyIdx := len(e.history)
+	draft := []rune{}
+
+	redraw := func() {
+		fmt.Fprintf(e.out, "\r%s%s\x1b[K", prompt, string(line))
+		if back := len(line) - cursor; back > 0 {
+			fmt.Fprintf(e.out, "\x1b[%dD", back)
+		}
+	}
+	recall := func(idx int) {
+		if idx < 0 || idx > len(e.history) {
+			return
+		}
+		if historyIdx == len(e.history) {
+			draft = line
+		}
+		historyIdx = idx
+		if idx == len(e.history) {
+			line = draft
+		} else {
+			line = []rune(e.history[idx])
+		}
+		cursor = len(line)
+		redraw()
+	}
+
+	fmt.Fprint(e.out, prompt)
+	for {
+		char, _, err := e.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+
+		switch char {
+		case '\r', '\n':
+			fmt.Fprint(e.out, "\n")
+			return string(line), nil
+		case 3: // Ctrl-C
+			fmt.Fprint(e.out, "^C\n")
+			return "", errInterrupted
+		case 4: // Ctrl-D
+			if len(line) == 0 {
+				fmt.Fprint(e.out, "\n")
+				return "", io.EOF
+			}
+			if cursor < len(line) {
+				line = append(line[:cursor], line[cursor+1:]...)
+			}
+		case 127, 8: // Backspace
+			if cursor > 0 {
+				line = append(line[:cursor-1], line[cursor:]...)
+				cursor--
+			}
+		case 1: // Ctrl-A
+			cursor = 0
+		case 5: // Ctrl-E
+			cursor = len(line)
+		case 2: // Ctrl-B
+			if cursor > 0 {
+				cursor--
+			}
+		case 6: // Ctrl-F
+			if cursor < len(line) {
+				cursor++
+			}
+		case 11: // Ctrl-K
+			line = line[:cursor]
+		case 21: // Ctrl-U
+			line = line[cursor:]
+			cursor = 0
+		case 23: // Ctrl-W
+			start := cursor
+			for start > 0 && line[start-1] == ' ' {
+				start--
+			}
+			for start > 0 && line[start-1] != ' ' {
+				start--
+			}
+			line = append(line[:start], line[cursor:]...)
+			cursor = start
+		case 12: // Ctrl-L
+			fmt.Fprint(e.out, "\x1b[2J\x1b[H")
+		case 16: // Ctrl-P
+			recall(historyIdx - 1)
+			continue
+		case 14: // Ctrl-N
+			recall(historyIdx + 1)
+			continue
+		case '\t':
+			line, cursor = e.completeAt(line, cursor)
+		case 27: // escape sequences for arrow and editing keys
+			seq := e.readEscape()
+			switch seq {
+			case "[A", "OA":
+				recall(historyIdx - 1)
+				continue
+			case "[B", "OB":
+				recall(historyIdx + 1)
+				continue
+			case "[C", "OC":
+				if cursor < len(line) {
+					cursor++
+				}
+			case "[D", "OD":
+				if cursor > 0 {
+					cursor--
+				}
+			case "[H", "OH", "[1~", "[7~":
+				cursor = 0
+			case "[F", "OF", "[4~", "[8~":
+				cursor = len(line)
+			case "[3~":
+				if cursor < len(line) {
+					line = append(line[:cursor], line[cursor+1:]...)
+				}
+			}
+		default:
+			if char < 32 {
+				continue
+			}
+			line = append(line[:cursor], append([]rune{char}, line[cursor:]...)...)
+			cursor++
+		}
+		redraw()
+	}
+}
+
+// readEscape reads the rest of an escape sequence after the escape key.
+func (e *lineEditor) readEscape() string {
+	seq := []rune{}
+	for {
+		char, _, err := e.in.ReadRune()
+		if err != nil {
+			return string(seq)
+		}
+		seq = append(seq, char)
+
+		// sequences end in a letter or ~, after the leading [ or O
+		if len(seq) > 1 && (char == '~' || char >= 'A' && char <= 'Z' || char >= 'a' && char <= 'z') {
+			return string(seq)
+		}
+		if len(seq) == 1 && char != '[' && char != 'O' {
+			return string(seq)
+		}
+	}
+}
+
+func (e *lineEditor) readPlainLine(prompt string) (string, error) {
+	fmt.Fprint(e.out, prompt)
+	text, err := e.in.ReadString('\n')
+	if err == io.EOF && text != "" {
+		err = nil
+	}
+	return strings.TrimRight(text, "\r\n"), err
+}
+
+// completeAt completes the word before the cursor, and returns the new
+// line and cursor. If there are many completions, the longest common prefix
+// of all completions is inserted, or if there is none, all completions are
+// listed below the line.
+func (e *lineEditor) completeAt(line []rune, cursor int) ([]rune, int) {
+	if e.complete == nil {
+		return line, cursor
+	}
+
+	before := string(line[:cursor])
+	candidates, start := e.complete(before)
+	if len(candidates) == 0 {
+		fmt.Fprint(e.out, "\a")
+		return line, cursor
+	}
+	sort.Strings(candidates)
+
+	prefix := candidates[0]
+	for _, c := range candidates[1:] {
+		for !strings.HasPrefix(c, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+
+	word := before[start:]
+	if len(prefix) > len(word) {
+		insert := []rune(prefix[len(word):])
+		line = append(line[:cursor:cursor], append(insert, line[cursor:]...)...)
+		return line, cursor + len(insert)
+	}
+
+	if len(candidates) > 1 {
+		fmt.Fprintf(e.out, "\n%s\n", strings.Join(candidates, "  "))
+	}
+	return line, cursor
+}
+
+// addHistory adds a line to the history recalled with the arrow keys.
+func (e *lineEditor) addHistory(line string) {
+	if len(e.history) > 0 && e.history[len(e.history)-1] == line {
+		return
+	}
+	e.history = append(e.history, line)
+}
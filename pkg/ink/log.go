@@ -12,6 +12,8 @@ const (
 	AnsiBlue      = "[34;22m"
 	AnsiGreen     = "[32;22m"
 	AnsiRed       = "[31;22m"
+	AnsiYellow    = "[33;22m"
+	AnsiGray      = "[90;22m"
 	AnsiBlueBold  = "[34;1m"
 	AnsiGreenBold = "[32;1m"
 	AnsiRedBold   = "[31;1m"
@@ -41,6 +43,12 @@ func LogSafeErr(reason int, args ...string) {
 		errStr = "syntax error"
 	case ErrRuntime:
 		errStr = "runtime error"
+	case ErrType:
+		errStr = "type error"
+	case ErrVet:
+		errStr = "vet"
+	case ErrAssertion:
+		errStr = "assertion error"
 	case ErrSystem:
 		errStr = "system error"
 	case ErrAssert:
@@ -0,0 +1,438 @@
+package ink
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// netChunkSize is the most bytes of data sent in one event when reading
+// from a socket.
+const netChunkSize = 4096
+
+// netCallback sends events to an Ink callback, in order, logging errors
+// raised by the callback as coming from the named builtin.
+func netCallback(ctx *Context, name string, cb FunctionValue) func(Value) {
+	return func(event Value) {
+		ctx.ExecListenerAndWait(func() {
+			_, err := evalInkFunction(cb, false, event)
+			if err != nil {
+				ctx.LogErr(Err{
+					ErrRuntime,
+					fmt.Sprintf("error in callback to %s(), %s", name, err.Error()),
+				})
+			}
+		})
+	}
+}
+
+// unixPrefix marks addresses given to listen() that are paths to Unix
+// domain sockets rather than TCP addresses.
+const unixPrefix = "unix:"
+
+// netListener listens on a network address. Before listening on a Unix
+// domain socket, it removes a socket file left at the path by a server that
+// did not shut down cleanly, but never any other kind of file.
+func netListener(network, addr string) (net.Listener, error) {
+	if network == "unix" {
+		if info, err := os.Lstat(addr); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if conn, err := net.Dial("unix", addr); err == nil {
+				conn.Close()
+			} else {
+				os.Remove(addr)
+			}
+		}
+	}
+	return net.Listen(network, addr)
+}
+
+// httpListener listens for listen() on a TCP address, or on a Unix domain
+// socket if the address starts with "unix:".
+func httpListener(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, unixPrefix) {
+		return netListener("unix", strings.TrimPrefix(addr, unixPrefix))
+	}
+	if addr == "" {
+		addr = ":http"
+	}
+	return netListener("tcp", addr)
+}
+
+// unixDialer dials a Unix domain socket for an HTTP transport, whatever the
+// address it is asked to dial.
+func unixDialer(path string) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, _, _ string) (net.Conn, error) {
+		dialer := net.Dialer{}
+		return dialer.DialContext(ctx, "unix", path)
+	}
+}
+
+// netAddrs describes the two ends of a stream connection.
+func netAddrs(conn net.Conn) CompositeValue {
+	return CompositeValue{
+		"local":  StringValue(conn.LocalAddr().String()),
+		"remote": StringValue(conn.RemoteAddr().String()),
+	}
+}
+
+// netRead reads from a stream connection until it ends, sending each chunk
+// read as {type: 'data', data} and then {type: 'end'}, or an error event.
+func netRead(name string, conn net.Conn, send func(Value)) {
+	buf := make([]byte, netChunkSize)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			send(CompositeValue{
+				"type": StringValue("data"),
+				"data": StringValue(append([]byte{}, buf[:n]...)),
+			})
+		}
+		if err == io.EOF || isClosedErr(err) {
+			send(CompositeValue{
+				"type": StringValue("end"),
+			})
+			return
+		} else if err != nil {
+			send(errMsg(fmt.Sprintf("error reading in %s(), %s", name, err.Error())))
+			return
+		}
+	}
+}
+
+// isClosedErr reports whether err comes from using a connection after this
+// end has closed it, which is how reads started before close() end.
+func isClosedErr(err error) bool {
+	opErr, isOpErr := err.(*net.OpError)
+	// net.ErrClosed is not available before Go 1.16
+	return isOpErr && opErr.Err.Error() == "use of closed network connection"
+}
+
+// netControls returns the {write, close} functions of a stream connection
+// for Ink. They may be called before the connection is open, in which case
+// they take effect once it is. conn receives the connection when it is open,
+// or nil if it could not be opened, and errors writing are sent with sendErr.
+func netControls(ctx *Context, name string, conn <-chan net.Conn, sendErr func(string)) CompositeValue {
+	// writes happen in the order they were called, in the background
+	writes := serialQueue{}
+	var c net.Conn
+	opened := false
+	open := func() net.Conn {
+		if !opened {
+			c = <-conn
+			opened = true
+		}
+		return c
+	}
+	writeFailed := false
+
+	return CompositeValue{
+		"write": NativeFunctionValue{
+			name: "write",
+			exec: func(ctx *Context, in []Value) (Value, error) {
+				if len(in) < 1 {
+					return nil, Err{
+						ErrRuntime,
+						fmt.Sprintf("write() callback to %s() takes 1 argument", name),
+					}
+				}
+				data, isString := in[0].(StringValue)
+				if !isString {
+					return nil, Err{
+						ErrRuntime,
+						fmt.Sprintf("write() callback to %s() takes a string, got %s", name, in[0]),
+					}
+				}
+				// copied, since strings are mutable
+				data = append(StringValue{}, data...)
+
+				ctx.Engine.Listeners.Add(1)
+				writes.queue(func() {
+					defer ctx.Engine.Listeners.Done()
+
+					c := open()
+					if c == nil || writeFailed {
+						return
+					}
+					if _, err := c.Write(data); err != nil {
+						writeFailed = true
+						if !isClosedErr(err) {
+							sendErr(fmt.Sprintf("error writing in %s(), %s", name, err.Error()))
+						}
+					}
+				})
+				return Null, nil
+			},
+			ctx: ctx,
+		},
+		"close": NativeFunctionValue{
+			name: "close",
+			exec: func(ctx *Context, in []Value) (Value, error) {
+				ctx.Engine.Listeners.Add(1)
+				writes.queue(func() {
+					defer ctx.Engine.Listeners.Done()
+
+					if c := open(); c != nil {
+						c.Close()
+					}
+				})
+				return Null, nil
+			},
+			ctx: ctx,
+		},
+	}
+}
+
+// netListen accepts stream connections on a network address, and sends
+// each to cb as {type: 'conn', data: {local, remote}, read, write, close}.
+// It returns a function that stops accepting connections.
+func netListen(ctx *Context, name, network, addr string, cb FunctionValue) (Value, error) {
+	send := netCallback(ctx, name, cb)
+	closeFn := NativeFunctionValue{
+		name: "close",
+		exec: func(ctx *Context, in []Value) (Value, error) {
+			// fake close callback
+			return Null, nil
+		},
+		ctx: ctx,
+	}
+
+	if !ctx.Engine.Permissions.Net {
+		return closeFn, nil
+	}
+
+	listener, err := netListener(network, addr)
+	if err != nil {
+		ctx.Engine.Listeners.Add(1)
+		go func() {
+			defer ctx.Engine.Listeners.Done()
+
+			send(errMsg(fmt.Sprintf("error listening in %s(), %s", name, err.Error())))
+		}()
+		return closeFn, nil
+	}
+
+	ctx.Engine.Listeners.Add(1)
+	go func() {
+		defer ctx.Engine.Listeners.Done()
+
+		for {
+			conn, err := listener.Accept()
+			if isClosedErr(err) {
+				return
+			} else if err != nil {
+				send(errMsg(fmt.Sprintf("error accepting connection in %s(), %s", name, err.Error())))
+				return
+			}
+
+			opened := make(chan net.Conn, 1)
+			opened <- conn
+			event := netControls(ctx, name, opened, func(msg string) {
+				send(errMsg(msg))
+			})
+			event["type"] = StringValue("conn")
+			event["data"] = netAddrs(conn)
+			event["read"] = NativeFunctionValue{
+				name: "read",
+				exec: netReadFn(ctx, name, conn),
+				ctx:  ctx,
+			}
+			send(event)
+		}
+	}()
+
+	closeFn.exec = func(ctx *Context, in []Value) (Value, error) {
+		listener.Close()
+		return Null, nil
+	}
+	return closeFn, nil
+}
+
+// netReadFn returns the read() function of an accepted connection, which
+// starts reading from the connection and sends its data to a callback.
+func netReadFn(ctx *Context, name string, conn net.Conn) func(*Context, []Value) (Value, error) {
+	reading := false
+	return func(ctx *Context, in []Value) (Value, error) {
+		if len(in) < 1 {
+			return nil, Err{
+				ErrRuntime,
+				fmt.Sprintf("read() callback to %s() takes 1 argument", name),
+			}
+		}
+		cb, isCbFunction := in[0].(FunctionValue)
+		if !isCbFunction {
+			return nil, Err{
+				ErrRuntime,
+				fmt.Sprintf("read() callback to %s() takes a callback, got %s", name, in[0]),
+			}
+		}
+		if reading {
+			return nil, Err{
+				ErrRuntime,
+				fmt.Sprintf("read() callback to %s() was called more than once", name),
+			}
+		}
+		reading = true
+
+		ctx.Engine.Listeners.Add(1)
+		go func() {
+			defer ctx.Engine.Listeners.Done()
+
+			netRead(name, conn, netCallback(ctx, name, cb))
+		}()
+		return Null, nil
+	}
+}
+
+// netConnect opens a stream connection to a network address, sends data
+// read from it to cb, and returns its {write, close} functions.
+func netConnect(ctx *Context, name, network, addr string, cb FunctionValue) (Value, error) {
+	send := netCallback(ctx, name, cb)
+	sendErr := func(msg string) {
+		send(errMsg(msg))
+	}
+
+	opened := make(chan net.Conn, 1)
+	if !ctx.Engine.Permissions.Net {
+		// fake connection that never opens
+		opened <- nil
+		return netControls(ctx, name, opened, sendErr), nil
+	}
+
+	ctx.Engine.Listeners.Add(1)
+	go func() {
+		defer ctx.Engine.Listeners.Done()
+
+		conn, err := net.Dial(network, addr)
+		if err != nil {
+			opened <- nil
+			sendErr(fmt.Sprintf("error connecting in %s(), %s", name, err.Error()))
+			return
+		}
+		opened <- conn
+
+		netRead(name, conn, send)
+		conn.Close()
+	}()
+
+	return netControls(ctx, name, opened, sendErr), nil
+}
+
+// udpBind receives datagrams on a local address, and sends each to cb as
+// {type: 'data', data, from}. It returns functions to send datagrams from
+// the same address and to stop receiving.
+func udpBind(ctx *Context, addr string, cb FunctionValue) (Value, error) {
+	send := netCallback(ctx, "udpBind", cb)
+
+	sends := serialQueue{}
+	var conn net.PacketConn
+	if ctx.Engine.Permissions.Net {
+		var err error
+		conn, err = net.ListenPacket("udp", addr)
+		if err != nil {
+			ctx.Engine.Listeners.Add(1)
+			go func() {
+				defer ctx.Engine.Listeners.Done()
+
+				send(errMsg(fmt.Sprintf("error binding in udpBind(), %s", err.Error())))
+			}()
+		} else {
+			ctx.Engine.Listeners.Add(1)
+			go func() {
+				defer ctx.Engine.Listeners.Done()
+
+				buf := make([]byte, 65536)
+				for {
+					n, from, err := conn.ReadFrom(buf)
+					if isClosedErr(err) {
+						return
+					} else if err != nil {
+						send(errMsg(fmt.Sprintf("error receiving in udpBind(), %s", err.Error())))
+						return
+					}
+					send(CompositeValue{
+						"type": StringValue("data"),
+						"data": StringValue(append([]byte{}, buf[:n]...)),
+						"from": StringValue(from.String()),
+					})
+				}
+			}()
+		}
+	}
+
+	return CompositeValue{
+		"send": NativeFunctionValue{
+			name: "send",
+			exec: func(ctx *Context, in []Value) (Value, error) {
+				args, err := stringArgs("send", in, 2)
+				if err != nil {
+					return nil, err
+				}
+				to, data := string(args[0]), append(StringValue{}, args[1]...)
+
+				if conn == nil {
+					return Null, nil
+				}
+				ctx.Engine.Listeners.Add(1)
+				sends.queue(func() {
+					defer ctx.Engine.Listeners.Done()
+
+					toAddr, err := net.ResolveUDPAddr("udp", to)
+					if err == nil {
+						_, err = conn.WriteTo(data, toAddr)
+					}
+					if err != nil && !isClosedErr(err) {
+						send(errMsg(fmt.Sprintf("error sending in udpBind(), %s", err.Error())))
+					}
+				})
+				return Null, nil
+			},
+			ctx: ctx,
+		},
+		"close": NativeFunctionValue{
+			name: "close",
+			exec: func(ctx *Context, in []Value) (Value, error) {
+				if conn == nil {
+					return Null, nil
+				}
+				ctx.Engine.Listeners.Add(1)
+				sends.queue(func() {
+					defer ctx.Engine.Listeners.Done()
+
+					conn.Close()
+				})
+				return Null, nil
+			},
+			ctx: ctx,
+		},
+	}, nil
+}
+
+// udpSend sends a single datagram from an unbound local address, then
+// sends {type: 'end'} to cb.
+func udpSend(ctx *Context, addr string, data StringValue, cb FunctionValue) {
+	send := netCallback(ctx, "udpSend", cb)
+
+	ctx.Engine.Listeners.Add(1)
+	go func() {
+		defer ctx.Engine.Listeners.Done()
+
+		if ctx.Engine.Permissions.Net {
+			conn, err := net.Dial("udp", addr)
+			if err == nil {
+				_, err = conn.Write(data)
+				conn.Close()
+			}
+			if err != nil {
+				send(errMsg(fmt.Sprintf("error sending in udpSend(), %s", err.Error())))
+				return
+			}
+		}
+
+		send(CompositeValue{
+			"type": StringValue("end"),
+		})
+	}()
+}
@@ -2,6 +2,9 @@ package ink
 
 import (
 	"fmt"
+	"io"
+	"os"
+	"sort"
 	"strings"
 )
 
@@ -128,10 +131,16 @@ func (n EmptyIdentifierNode) Position() position {
 
 type IdentifierNode struct {
 	val string
+	// annotation is the optional type annotation on the identifier, which
+	// is read by the type checker and ignored at runtime
+	annotation *Type
 	position
 }
 
 func (n IdentifierNode) String() string {
+	if n.annotation != nil {
+		return fmt.Sprintf("Identifier '%s' <%s>", n.val, n.annotation)
+	}
 	return fmt.Sprintf("Identifier '%s'", n.val)
 }
 
@@ -241,26 +250,216 @@ func (n FunctionLiteralNode) Position() position {
 	return n.position
 }
 
+// parseErr is a syntax error raised by the parser, annotated with the
+// position of the token at which parsing failed, so the parser can
+// report the error and recover from it.
+type parseErr struct {
+	Err
+	pos position
+	// atEnd is true when the error was caused by the program ending early,
+	// in which case there is nothing left to recover with.
+	atEnd bool
+}
+
+func newParseErr(tok Tok, message string) parseErr {
+	return parseErr{
+		Err: Err{ErrSyntax, message},
+		pos: tok.position,
+	}
+}
+
+func (e parseErr) diagnostic() Diagnostic {
+	return Diagnostic{
+		Reason:  e.reason,
+		Message: e.message,
+		Line:    e.pos.line,
+		Col:     e.pos.col,
+	}
+}
+
 func guardUnexpectedInputEnd(tokens []Tok, idx int) error {
 	if idx >= len(tokens) {
 		if len(tokens) > 0 {
-			return Err{
-				ErrSyntax,
-				fmt.Sprintf("unexpected end of input at %s", tokens[len(tokens)-1]),
-			}
+			lastTok := tokens[len(tokens)-1]
+			e := newParseErr(lastTok,
+				fmt.Sprintf("unexpected end of input at %s", lastTok))
+			e.atEnd = true
+			return e
 		}
 
-		return Err{
-			ErrSyntax,
-			fmt.Sprintf("unexpected end of input"),
+		return parseErr{
+			Err:   Err{ErrSyntax, fmt.Sprintf("unexpected end of input")},
+			atEnd: true,
 		}
 	}
 
 	return nil
 }
 
+// parser holds the state of a single parse of a program, so that the parser
+// can record a syntax error, recover from it, and keep parsing to find more.
+type parser struct {
+	diagnostics []Diagnostic
+	// atEnd is true if parsing stopped because the program ended early
+	atEnd bool
+}
+
+// recoverFrom records a syntax error raised while parsing an item in a
+// delimited list of items (expressions, arguments, entries, or clauses) that
+// begins at tokens[start], and returns the index at which to resume parsing.
+//
+// The parser resynchronizes at the end of the failed item, which is the next
+// Separator or closing delimiter found after the error, at the nesting depth
+// of the start of the item. The closing delimiter is left for the list to
+// consume. A mismatched closing delimiter is skipped. Errors at the end of
+// input cannot be recovered from, and are returned unchanged.
+func (p *parser) recoverFrom(err error, tokens []Tok, start int, closer Kind) (int, error) {
+	e, isParseErr := err.(parseErr)
+	if !isParseErr || e.atEnd {
+		return 0, err
+	}
+	p.diagnostics = append(p.diagnostics, e.diagnostic())
+
+	depth := 0
+	reachedErr := false
+	for idx := start; idx < len(tokens); idx++ {
+		tok := tokens[idx]
+		if tok.position == e.pos {
+			reachedErr = true
+		}
+
+		switch tok.kind {
+		case LeftParen, LeftBracket, LeftBrace:
+			depth++
+		case RightParen, RightBracket, RightBrace:
+			if depth > 0 {
+				depth--
+			} else if tok.kind == closer {
+				return idx, nil
+			}
+		case Separator:
+			if depth == 0 && reachedErr {
+				return idx + 1, nil
+			}
+		}
+	}
+
+	return len(tokens), nil
+}
+
+// parseTokens parses a complete program from its tokens, recovering from
+// syntax errors, and returns all parsed nodes and any errors found.
+func parseTokens(tokens []Tok) ([]Node, []Diagnostic) {
+	p := parser{}
+	nodes := p.parseProgram(tokens)
+	return nodes, p.diagnostics
+}
+
+// parseProgram parses all top-level expressions in tokens, recording
+// syntax errors in the parser.
+func (p *parser) parseProgram(tokens []Tok) []Node {
+	nodes := make([]Node, 0)
+
+	idx, length := 0, len(tokens)
+	for idx < length {
+		if tokens[idx].kind == Separator {
+			// this sometimes happens when the repl receives comment inputs
+			idx++
+			continue
+		}
+
+		expr, incr, err := p.parseExpression(tokens[idx:])
+		if err != nil {
+			// top-level expressions have no closing delimiter,
+			// so any stray closing delimiter is skipped
+			idx, err = p.recoverFrom(err, tokens, idx, Separator)
+			if err != nil {
+				e, isParseErr := err.(parseErr)
+				if !isParseErr {
+					LogErrf(ErrAssert, "err raised that was not of Err type -> %s",
+						err.Error())
+				}
+				p.diagnostics = append(p.diagnostics, e.diagnostic())
+				p.atEnd = e.atEnd
+				break
+			}
+			continue
+		}
+		idx += incr
+
+		nodes = append(nodes, expr)
+	}
+
+	sort.SliceStable(p.diagnostics, func(i, j int) bool {
+		a, b := p.diagnostics[i], p.diagnostics[j]
+		return a.Line < b.Line || a.Line == b.Line && a.Col < b.Col
+	})
+
+	return nodes
+}
+
+// incompleteInput reports whether source is the beginning of a program
+// that ends early, like a function literal missing its closing paren,
+// so that an interactive prompt can read more input to complete it.
+func incompleteInput(source string) bool {
+	// unterminated strings and comments are not reported by the lexer
+	inString, inComment := false, false
+	for i := 0; i < len(source); i++ {
+		switch {
+		case inString && source[i] == '\\':
+			i++
+		case inString:
+			inString = source[i] != '\''
+		case inComment:
+			inComment = source[i] != '`'
+		case source[i] == '\'':
+			inString = true
+		case strings.HasPrefix(source[i:], "``"):
+			// single-line comment
+			for i < len(source) && source[i] != '\n' {
+				i++
+			}
+		case source[i] == '`':
+			inComment = true
+		}
+	}
+	if inString || inComment {
+		return true
+	}
+
+	tokenStream := make(chan Tok)
+	go Tokenize(strings.NewReader(source), tokenStream, false, false)
+	tokens := make([]Tok, 0)
+	for tok := range tokenStream {
+		tokens = append(tokens, tok)
+	}
+
+	p := parser{}
+	p.parseProgram(tokens)
+	return p.atEnd
+}
+
+// ParseAll reads and parses a complete Ink program, and returns all of its
+// top-level AST nodes along with every syntax error found in the program.
+// Unlike Parse, ParseAll does not log errors, which makes it suitable for
+// tools that analyze Ink programs without running them.
+func ParseAll(input io.Reader) ([]Node, []Diagnostic) {
+	tokenStream := make(chan Tok)
+	go Tokenize(input, tokenStream, false, false)
+
+	tokens := make([]Tok, 0)
+	for tok := range tokenStream {
+		tokens = append(tokens, tok)
+	}
+
+	return parseTokens(tokens)
+}
+
 // Parse concurrently transforms a stream of Tok (tokens) to Node (AST nodes).
 // This implementation uses recursive descent parsing.
+//
+// Parse reports every syntax error in the program. If there are any, none
+// of the program is sent to be evaluated.
 func Parse(
 	tokenStream <-chan Tok,
 	nodes chan<- Node,
@@ -274,32 +473,18 @@ func Parse(
 		tokens = append(tokens, tok)
 	}
 
-	idx, length := 0, len(tokens)
-	for idx < length {
-		if tokens[idx].kind == Separator {
-			// this sometimes happens when the repl receives comment inputs
-			idx++
-			continue
+	exprs, diagnostics := parseTokens(tokens)
+	if len(diagnostics) > 0 {
+		for _, d := range diagnostics {
+			LogSafeErr(d.Reason, d.Message)
 		}
-
-		expr, incr, err := parseExpression(tokens[idx:])
-		idx += incr
-
-		if err != nil {
-			e, isErr := err.(Err)
-			if isErr {
-				if fatalError {
-					LogErr(e.reason, e.message)
-				} else {
-					LogSafeErr(e.reason, e.message)
-				}
-			} else {
-				LogErrf(ErrAssert, "err raised that was not of Err type -> %s",
-					err.Error())
-			}
-			return
+		if fatalError {
+			os.Exit(diagnostics[0].Reason)
 		}
+		return
+	}
 
+	for _, expr := range exprs {
 		if debugParser {
 			LogDebug("parse ->", expr.String())
 		}
@@ -348,13 +533,13 @@ func isBinaryOp(t Tok) bool {
 	}
 }
 
-func parseBinaryExpression(
+func (p *parser) parseBinaryExpression(
 	leftOperand Node,
 	operator Tok,
 	tokens []Tok,
 	previousPriority int,
 ) (Node, int, error) {
-	rightAtom, idx, err := parseAtom(tokens)
+	rightAtom, idx, err := p.parseAtom(tokens)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -384,7 +569,7 @@ func parseBinaryExpression(
 				return nil, 0, err
 			}
 
-			rightAtom, incr, err = parseAtom(tokens[idx:])
+			rightAtom, incr, err = p.parseAtom(tokens[idx:])
 			if err != nil {
 				return nil, 0, err
 			}
@@ -398,7 +583,7 @@ func parseBinaryExpression(
 
 			// Priority is higher than previous ops,
 			// so make it a right-heavy tree
-			subtree, incr, err := parseBinaryExpression(
+			subtree, incr, err := p.parseBinaryExpression(
 				nodes[len(nodes)-1],
 				tokens[idx],
 				tokens[idx+1:],
@@ -429,7 +614,7 @@ func parseBinaryExpression(
 	return tree, idx, nil
 }
 
-func parseExpression(tokens []Tok) (Node, int, error) {
+func (p *parser) parseExpression(tokens []Tok) (Node, int, error) {
 	idx := 0
 
 	consumeDanglingSeparator := func() {
@@ -440,7 +625,7 @@ func parseExpression(tokens []Tok) (Node, int, error) {
 		}
 	}
 
-	atom, incr, err := parseAtom(tokens[idx:])
+	atom, incr, err := p.parseAtom(tokens[idx:])
 	if err != nil {
 		return nil, 0, err
 	}
@@ -466,7 +651,7 @@ func parseExpression(tokens []Tok) (Node, int, error) {
 	case AddOp, SubtractOp, MultiplyOp, DivideOp, ModulusOp,
 		LogicalAndOp, LogicalOrOp, LogicalXorOp,
 		GreaterThanOp, LessThanOp, EqualOp, DefineOp, AccessorOp:
-		binExpr, incr, err := parseBinaryExpression(atom, nextTok, tokens[idx:], -1)
+		binExpr, incr, err := p.parseBinaryExpression(atom, nextTok, tokens[idx:], -1)
 		if err != nil {
 			return nil, 0, err
 		}
@@ -477,7 +662,7 @@ func parseExpression(tokens []Tok) (Node, int, error) {
 			colonPos := tokens[idx].position
 			idx++ // MatchColon
 
-			clauses, incr, err := parseMatchBody(tokens[idx:])
+			clauses, incr, err := p.parseMatchBody(tokens[idx:])
 			if err != nil {
 				return nil, 0, err
 			}
@@ -495,7 +680,7 @@ func parseExpression(tokens []Tok) (Node, int, error) {
 		return binExpr, idx, nil
 
 	case MatchColon:
-		clauses, incr, err := parseMatchBody(tokens[idx:])
+		clauses, incr, err := p.parseMatchBody(tokens[idx:])
 		if err != nil {
 			return nil, 0, err
 		}
@@ -509,14 +694,12 @@ func parseExpression(tokens []Tok) (Node, int, error) {
 		}, idx, nil
 
 	default:
-		return nil, 0, Err{
-			ErrSyntax,
-			fmt.Sprintf("unexpected token %s following an expression", nextTok),
-		}
+		return nil, 0, newParseErr(nextTok,
+			fmt.Sprintf("unexpected token %s following an expression", nextTok))
 	}
 }
 
-func parseAtom(tokens []Tok) (Node, int, error) {
+func (p *parser) parseAtom(tokens []Tok) (Node, int, error) {
 	err := guardUnexpectedInputEnd(tokens, 0)
 	if err != nil {
 		return nil, 0, err
@@ -525,7 +708,7 @@ func parseAtom(tokens []Tok) (Node, int, error) {
 	tok, idx := tokens[0], 1
 
 	if tok.kind == NegationOp {
-		atom, idx, err := parseAtom(tokens[idx:])
+		atom, idx, err := p.parseAtom(tokens[idx:])
 		if err != nil {
 			return nil, 0, err
 		}
@@ -552,9 +735,25 @@ func parseAtom(tokens []Tok) (Node, int, error) {
 	case FalseLiteral:
 		return BooleanLiteralNode{false, tok.position}, idx, nil
 	case Identifier:
+		identNode := IdentifierNode{val: tok.str, position: tok.position}
+
+		// an identifier followed by '<' may be a type annotation, or the
+		// start of a comparison. It is an annotation only if what follows is
+		// a valid type, and the identifier is being bound to a value.
+		if tokens[idx].kind == LessThanOp {
+			annotation, incr, err := p.parseTypeAnnotation(tokens[idx:])
+			if err == nil && idx+incr < len(tokens) {
+				switch tokens[idx+incr].kind {
+				case DefineOp, FunctionArrow, Separator, RightParen:
+					identNode.annotation = &annotation
+					idx += incr
+				}
+			}
+		}
+
 		if tokens[idx].kind == FunctionArrow {
 			var err error
-			atom, idx, err = parseFunctionLiteral(tokens)
+			atom, idx, err = p.parseFunctionLiteral(tokens)
 			if err != nil {
 				return nil, 0, err
 			}
@@ -564,14 +763,14 @@ func parseAtom(tokens []Tok) (Node, int, error) {
 			// 	so we backtrack one token.
 			idx--
 		} else {
-			atom = IdentifierNode{tok.str, tok.position}
+			atom = identNode
 		}
 		// may be called as a function, so flows beyond
 		// switch block
 	case EmptyIdentifier:
 		if tokens[idx].kind == FunctionArrow {
 			var err error
-			atom, idx, err = parseFunctionLiteral(tokens)
+			atom, idx, err = p.parseFunctionLiteral(tokens)
 			if err != nil {
 				return nil, 0, err
 			}
@@ -587,14 +786,17 @@ func parseAtom(tokens []Tok) (Node, int, error) {
 		// grouped expression or function literal
 		exprs := make([]Node, 0)
 		for tokens[idx].kind != RightParen {
-			expr, incr, err := parseExpression(tokens[idx:])
+			expr, incr, err := p.parseExpression(tokens[idx:])
 			if err != nil {
-				return nil, 0, err
+				idx, err = p.recoverFrom(err, tokens, idx, RightParen)
+				if err != nil {
+					return nil, 0, err
+				}
+			} else {
+				idx += incr
+				exprs = append(exprs, expr)
 			}
 
-			idx += incr
-			exprs = append(exprs, expr)
-
 			err = guardUnexpectedInputEnd(tokens, idx)
 			if err != nil {
 				return nil, 0, err
@@ -609,7 +811,7 @@ func parseAtom(tokens []Tok) (Node, int, error) {
 
 		if tokens[idx].kind == FunctionArrow {
 			var err error
-			atom, idx, err = parseFunctionLiteral(tokens)
+			atom, idx, err = p.parseFunctionLiteral(tokens)
 			if err != nil {
 				return nil, 0, err
 			}
@@ -629,48 +831,21 @@ func parseAtom(tokens []Tok) (Node, int, error) {
 	case LeftBrace:
 		entries := make([]ObjectEntryNode, 0)
 		for tokens[idx].kind != RightBrace {
-			keyExpr, keyIncr, err := parseExpression(tokens[idx:])
-			if err != nil {
-				return nil, 0, err
-			}
-
-			idx += keyIncr
-			err = guardUnexpectedInputEnd(tokens, idx)
+			entry, incr, err := p.parseObjectEntry(tokens[idx:])
 			if err != nil {
-				return nil, 0, err
-			}
-			if tokens[idx].kind == KeyValueSeparator {
-				idx++
-			} else {
-				return nil, 0, Err{
-					ErrSyntax,
-					fmt.Sprintf("expected %s after composite key, found %s",
-						KeyValueSeparator.String(), tokens[idx]),
+				idx, err = p.recoverFrom(err, tokens, idx, RightBrace)
+				if err != nil {
+					return nil, 0, err
 				}
+			} else {
+				idx += incr
+				entries = append(entries, entry)
 			}
 
 			err = guardUnexpectedInputEnd(tokens, idx)
 			if err != nil {
 				return nil, 0, err
 			}
-
-			valExpr, valIncr, err := parseExpression(tokens[idx:])
-			if err != nil {
-				return nil, 0, err
-			}
-
-			// Separator consumed by parseExpression
-			idx += valIncr
-			entries = append(entries, ObjectEntryNode{
-				key:      keyExpr,
-				val:      valExpr,
-				position: keyExpr.Position(),
-			})
-
-			err = guardUnexpectedInputEnd(tokens, idx)
-			if err != nil {
-				return nil, 0, err
-			}
 		}
 		idx++ // RightBrace
 
@@ -681,14 +856,17 @@ func parseAtom(tokens []Tok) (Node, int, error) {
 	case LeftBracket:
 		vals := make([]Node, 0)
 		for tokens[idx].kind != RightBracket {
-			expr, incr, err := parseExpression(tokens[idx:])
+			expr, incr, err := p.parseExpression(tokens[idx:])
 			if err != nil {
-				return nil, 0, err
+				idx, err = p.recoverFrom(err, tokens, idx, RightBracket)
+				if err != nil {
+					return nil, 0, err
+				}
+			} else {
+				idx += incr
+				vals = append(vals, expr)
 			}
 
-			idx += incr
-			vals = append(vals, expr)
-
 			err = guardUnexpectedInputEnd(tokens, idx)
 			if err != nil {
 				return nil, 0, err
@@ -701,10 +879,8 @@ func parseAtom(tokens []Tok) (Node, int, error) {
 			position: tok.position,
 		}, idx, nil
 	default:
-		return nil, 0, Err{
-			ErrSyntax,
-			fmt.Sprintf("unexpected start of atom, found %s", tok),
-		}
+		return nil, 0, newParseErr(tok,
+			fmt.Sprintf("unexpected start of atom, found %s", tok))
 	}
 
 	// bounds check here because parseExpression may have
@@ -712,7 +888,7 @@ func parseAtom(tokens []Tok) (Node, int, error) {
 	for idx < len(tokens) && tokens[idx].kind == LeftParen {
 		var incr int
 		var err error
-		atom, incr, err = parseFunctionCall(atom, tokens[idx:])
+		atom, incr, err = p.parseFunctionCall(atom, tokens[idx:])
 		if err != nil {
 			return nil, 0, err
 		}
@@ -727,9 +903,49 @@ func parseAtom(tokens []Tok) (Node, int, error) {
 	return atom, idx, nil
 }
 
+// parses a single key: value entry in a composite literal,
+// including the Separator that follows the value
+func (p *parser) parseObjectEntry(tokens []Tok) (ObjectEntryNode, int, error) {
+	keyExpr, idx, err := p.parseExpression(tokens)
+	if err != nil {
+		return ObjectEntryNode{}, 0, err
+	}
+
+	err = guardUnexpectedInputEnd(tokens, idx)
+	if err != nil {
+		return ObjectEntryNode{}, 0, err
+	}
+	if tokens[idx].kind == KeyValueSeparator {
+		idx++
+	} else {
+		return ObjectEntryNode{}, 0, newParseErr(tokens[idx],
+			fmt.Sprintf("expected %s after composite key, found %s",
+				KeyValueSeparator.String(), tokens[idx]))
+	}
+
+	err = guardUnexpectedInputEnd(tokens, idx)
+	if err != nil {
+		return ObjectEntryNode{}, 0, err
+	}
+
+	valExpr, valIncr, err := p.parseExpression(tokens[idx:])
+	if err != nil {
+		return ObjectEntryNode{}, 0, err
+	}
+
+	// Separator consumed by parseExpression
+	idx += valIncr
+
+	return ObjectEntryNode{
+		key:      keyExpr,
+		val:      valExpr,
+		position: keyExpr.Position(),
+	}, idx, nil
+}
+
 // parses everything that follows MatchColon
 // 	does not consume dangling separator -- that's for parseExpression
-func parseMatchBody(tokens []Tok) ([]MatchClauseNode, int, error) {
+func (p *parser) parseMatchBody(tokens []Tok) ([]MatchClauseNode, int, error) {
 	idx := 1 // LeftBrace
 	clauses := make([]MatchClauseNode, 0)
 
@@ -739,13 +955,16 @@ func parseMatchBody(tokens []Tok) ([]MatchClauseNode, int, error) {
 	}
 
 	for tokens[idx].kind != RightBrace {
-		clauseNode, incr, err := parseMatchClause(tokens[idx:])
+		clauseNode, incr, err := p.parseMatchClause(tokens[idx:])
 		if err != nil {
-			return nil, 0, err
+			idx, err = p.recoverFrom(err, tokens, idx, RightBrace)
+			if err != nil {
+				return nil, 0, err
+			}
+		} else {
+			idx += incr
+			clauses = append(clauses, clauseNode)
 		}
-		idx += incr
-
-		clauses = append(clauses, clauseNode)
 
 		err = guardUnexpectedInputEnd(tokens, idx)
 		if err != nil {
@@ -757,8 +976,8 @@ func parseMatchBody(tokens []Tok) ([]MatchClauseNode, int, error) {
 	return clauses, idx, nil
 }
 
-func parseMatchClause(tokens []Tok) (MatchClauseNode, int, error) {
-	atom, idx, err := parseExpression(tokens)
+func (p *parser) parseMatchClause(tokens []Tok) (MatchClauseNode, int, error) {
+	atom, idx, err := p.parseExpression(tokens)
 	if err != nil {
 		return MatchClauseNode{}, 0, err
 	}
@@ -769,10 +988,8 @@ func parseMatchClause(tokens []Tok) (MatchClauseNode, int, error) {
 	}
 
 	if tokens[idx].kind != CaseArrow {
-		return MatchClauseNode{}, 0, Err{
-			ErrSyntax,
-			fmt.Sprintf("expected %s, but got %s", CaseArrow, tokens[idx]),
-		}
+		return MatchClauseNode{}, 0, newParseErr(tokens[idx],
+			fmt.Sprintf("expected %s, but got %s", CaseArrow, tokens[idx]))
 	}
 	idx++ // CaseArrow
 
@@ -781,7 +998,7 @@ func parseMatchClause(tokens []Tok) (MatchClauseNode, int, error) {
 		return MatchClauseNode{}, 0, err
 	}
 
-	expr, incr, err := parseExpression(tokens[idx:])
+	expr, incr, err := p.parseExpression(tokens[idx:])
 	if err != nil {
 		return MatchClauseNode{}, 0, err
 	}
@@ -793,7 +1010,7 @@ func parseMatchClause(tokens []Tok) (MatchClauseNode, int, error) {
 	}, idx, nil
 }
 
-func parseFunctionLiteral(tokens []Tok) (FunctionLiteralNode, int, error) {
+func (p *parser) parseFunctionLiteral(tokens []Tok) (FunctionLiteralNode, int, error) {
 
 	tok, idx := tokens[0], 1
 	arguments := make([]Node, 0)
@@ -808,8 +1025,12 @@ func parseFunctionLiteral(tokens []Tok) (FunctionLiteralNode, int, error) {
 		for {
 			tk := tokens[idx]
 			if tk.kind == Identifier {
-				idNode := IdentifierNode{tk.str, tk.position}
+				idNode, incr, err := p.parseArgument(tokens[idx:])
+				if err != nil {
+					return FunctionLiteralNode{}, 0, err
+				}
 				arguments = append(arguments, idNode)
+				idx += incr - 1
 			} else if tk.kind == EmptyIdentifier {
 				idNode := EmptyIdentifierNode{tk.position}
 				arguments = append(arguments, idNode)
@@ -823,12 +1044,16 @@ func parseFunctionLiteral(tokens []Tok) (FunctionLiteralNode, int, error) {
 				return FunctionLiteralNode{}, 0, err
 			}
 
+			// the lexer does not insert a Separator after the closing '>'
+			// of a type annotation, so the last argument may be followed
+			// directly by RightParen.
+			if tokens[idx].kind == RightParen {
+				break
+			}
 			if tokens[idx].kind != Separator {
-				return FunctionLiteralNode{}, 0, Err{
-					ErrSyntax,
+				return FunctionLiteralNode{}, 0, newParseErr(tokens[idx],
 					fmt.Sprintf("expected arguments in a list separated by %s, found %s",
-						Separator, tokens[idx]),
-				}
+						Separator, tokens[idx]))
 			}
 			idx++ // Separator
 		}
@@ -838,24 +1063,24 @@ func parseFunctionLiteral(tokens []Tok) (FunctionLiteralNode, int, error) {
 			return FunctionLiteralNode{}, 0, err
 		}
 		if tokens[idx].kind != RightParen {
-			return FunctionLiteralNode{}, 0, Err{
-				ErrSyntax,
+			return FunctionLiteralNode{}, 0, newParseErr(tokens[idx],
 				fmt.Sprintf("expected arguments list to terminate with %s, found %s",
-					RightParen, tokens[idx]),
-			}
+					RightParen, tokens[idx]))
 		}
 		idx++ // RightParen
 	case Identifier:
-		idNode := IdentifierNode{tok.str, tok.position}
+		idNode, incr, err := p.parseArgument(tokens)
+		if err != nil {
+			return FunctionLiteralNode{}, 0, err
+		}
 		arguments = append(arguments, idNode)
+		idx = incr
 	case EmptyIdentifier:
 		idNode := EmptyIdentifierNode{tok.position}
 		arguments = append(arguments, idNode)
 	default:
-		return FunctionLiteralNode{}, 0, Err{
-			ErrSyntax,
-			fmt.Sprintf("malformed arguments list in function at %s", tok),
-		}
+		return FunctionLiteralNode{}, 0, newParseErr(tok,
+			fmt.Sprintf("malformed arguments list in function at %s", tok))
 	}
 
 	err = guardUnexpectedInputEnd(tokens, idx)
@@ -864,14 +1089,12 @@ func parseFunctionLiteral(tokens []Tok) (FunctionLiteralNode, int, error) {
 	}
 
 	if tokens[idx].kind != FunctionArrow {
-		return FunctionLiteralNode{}, 0, Err{
-			ErrSyntax,
-			fmt.Sprintf("expected %s but found %s", FunctionArrow, tokens[idx]),
-		}
+		return FunctionLiteralNode{}, 0, newParseErr(tokens[idx],
+			fmt.Sprintf("expected %s but found %s", FunctionArrow, tokens[idx]))
 	}
 	idx++ // FunctionArrow
 
-	body, incr, err := parseExpression(tokens[idx:])
+	body, incr, err := p.parseExpression(tokens[idx:])
 	if err != nil {
 		return FunctionLiteralNode{}, 0, err
 	}
@@ -884,7 +1107,273 @@ func parseFunctionLiteral(tokens []Tok) (FunctionLiteralNode, int, error) {
 	}, idx, nil
 }
 
-func parseFunctionCall(function Node, tokens []Tok) (FunctionCallNode, int, error) {
+// parseArgument parses a function argument, which is an identifier
+// with an optional type annotation.
+func (p *parser) parseArgument(tokens []Tok) (IdentifierNode, int, error) {
+	tok, idx := tokens[0], 1
+	idNode := IdentifierNode{val: tok.str, position: tok.position}
+
+	if idx < len(tokens) && tokens[idx].kind == LessThanOp {
+		annotation, incr, err := p.parseTypeAnnotation(tokens[idx:])
+		if err != nil {
+			return IdentifierNode{}, 0, err
+		}
+		idNode.annotation = &annotation
+		idx += incr
+	}
+
+	return idNode, idx, nil
+}
+
+// parseTypeAnnotation parses a type annotation of the form <type>.
+func (p *parser) parseTypeAnnotation(tokens []Tok) (Type, int, error) {
+	idx := 1 // LessThanOp
+
+	err := guardUnexpectedInputEnd(tokens, idx)
+	if err != nil {
+		return Type{}, 0, err
+	}
+
+	t, incr, err := p.parseType(tokens[idx:])
+	if err != nil {
+		return Type{}, 0, err
+	}
+	idx += incr
+
+	err = guardUnexpectedInputEnd(tokens, idx)
+	if err != nil {
+		return Type{}, 0, err
+	}
+	if tokens[idx].kind != GreaterThanOp {
+		return Type{}, 0, newParseErr(tokens[idx],
+			fmt.Sprintf("expected type annotation to terminate with %s, found %s",
+				GreaterThanOp, tokens[idx]))
+	}
+	idx++ // GreaterThanOp
+
+	return t, idx, nil
+}
+
+// parseType parses a type, which is either a sum type or a function
+// type of the form `param, param => return`.
+func (p *parser) parseType(tokens []Tok) (Type, int, error) {
+	idx := 0
+	params := make([]Type, 0)
+
+	// () => T is a function type taking no arguments
+	if len(tokens) > 2 && tokens[0].kind == LeftParen &&
+		tokens[1].kind == RightParen && tokens[2].kind == FunctionArrow {
+		idx = 2
+	} else {
+		for {
+			t, incr, err := p.parseSumType(tokens[idx:])
+			if err != nil {
+				return Type{}, 0, err
+			}
+			idx += incr
+			params = append(params, t)
+
+			err = guardUnexpectedInputEnd(tokens, idx)
+			if err != nil {
+				return Type{}, 0, err
+			}
+			if tokens[idx].kind != Separator {
+				break
+			}
+			idx++ // Separator
+
+			err = guardUnexpectedInputEnd(tokens, idx)
+			if err != nil {
+				return Type{}, 0, err
+			}
+
+			// the lexer inserts a Separator before every closing
+			// delimiter, which does not begin another argument type
+			if kind := tokens[idx].kind; kind == RightParen || kind == RightBrace {
+				idx--
+				break
+			}
+		}
+	}
+
+	if tokens[idx].kind != FunctionArrow {
+		if len(params) != 1 {
+			return Type{}, 0, newParseErr(tokens[idx],
+				fmt.Sprintf("expected %s after list of argument types, found %s",
+					FunctionArrow, tokens[idx]))
+		}
+		return params[0], idx, nil
+	}
+	idx++ // FunctionArrow
+
+	err := guardUnexpectedInputEnd(tokens, idx)
+	if err != nil {
+		return Type{}, 0, err
+	}
+
+	ret, incr, err := p.parseType(tokens[idx:])
+	if err != nil {
+		return Type{}, 0, err
+	}
+	idx += incr
+
+	return fnType(ret, params...), idx, nil
+}
+
+// parseSumType parses one or more type atoms separated by '|'.
+func (p *parser) parseSumType(tokens []Tok) (Type, int, error) {
+	t, idx, err := p.parseTypeAtom(tokens)
+	if err != nil {
+		return Type{}, 0, err
+	}
+
+	for idx < len(tokens) && tokens[idx].kind == LogicalOrOp {
+		idx++ // LogicalOrOp
+
+		err = guardUnexpectedInputEnd(tokens, idx)
+		if err != nil {
+			return Type{}, 0, err
+		}
+
+		other, incr, err := p.parseTypeAtom(tokens[idx:])
+		if err != nil {
+			return Type{}, 0, err
+		}
+		idx += incr
+		t = t.union(other)
+	}
+
+	return t, idx, nil
+}
+
+func (p *parser) parseTypeAtom(tokens []Tok) (Type, int, error) {
+	err := guardUnexpectedInputEnd(tokens, 1)
+	if err != nil {
+		return Type{}, 0, err
+	}
+
+	tok, idx := tokens[0], 1
+	switch tok.kind {
+	case Identifier:
+		t, prs := typeNames[tok.str]
+		if !prs {
+			return Type{}, 0, newParseErr(tok,
+				fmt.Sprintf("unknown type %s", tok.str))
+		}
+		return t, idx, nil
+	case LeftParen:
+		// () is the null type, otherwise a grouped type
+		if tokens[idx].kind == RightParen {
+			return typeNull, idx + 1, nil
+		}
+
+		t, incr, err := p.parseType(tokens[idx:])
+		if err != nil {
+			return Type{}, 0, err
+		}
+		idx += incr
+
+		err = guardUnexpectedInputEnd(tokens, idx+1)
+		if err != nil {
+			return Type{}, 0, err
+		}
+		if tokens[idx].kind == Separator {
+			idx++
+		}
+		if tokens[idx].kind != RightParen {
+			return Type{}, 0, newParseErr(tokens[idx],
+				fmt.Sprintf("expected %s after grouped type, found %s",
+					RightParen, tokens[idx]))
+		}
+		return t, idx + 1, nil
+	case LeftBrace:
+		// {T} is a composite of values of type T, and
+		// {key: T, ...} is a record with the given fields
+		if tokens[idx].kind == RightBrace {
+			return typeComposite, idx + 1, nil
+		}
+		if tokens[idx].kind == Identifier && idx+2 < len(tokens) &&
+			tokens[idx+1].kind == Separator && tokens[idx+2].kind == KeyValueSeparator {
+			return p.parseRecordType(tokens)
+		}
+
+		elem, incr, err := p.parseSumType(tokens[idx:])
+		if err != nil {
+			return Type{}, 0, err
+		}
+		idx += incr
+
+		err = guardUnexpectedInputEnd(tokens, idx+1)
+		if err != nil {
+			return Type{}, 0, err
+		}
+		if tokens[idx].kind == Separator {
+			idx++
+		}
+		if tokens[idx].kind != RightBrace {
+			return Type{}, 0, newParseErr(tokens[idx],
+				fmt.Sprintf("expected %s after composite element type, found %s",
+					RightBrace, tokens[idx]))
+		}
+		return Type{kinds: kindComposite, elem: &elem}, idx + 1, nil
+	default:
+		return Type{}, 0, newParseErr(tok,
+			fmt.Sprintf("expected a type, found %s", tok))
+	}
+}
+
+func (p *parser) parseRecordType(tokens []Tok) (Type, int, error) {
+	idx := 1 // LeftBrace
+	fields := make(map[string]Type)
+
+	for tokens[idx].kind != RightBrace {
+		tok := tokens[idx]
+		if tok.kind == Separator {
+			// records may span multiple lines
+			idx++
+		} else if tok.kind == Identifier {
+			idx++ // Identifier
+
+			err := guardUnexpectedInputEnd(tokens, idx+1)
+			if err != nil {
+				return Type{}, 0, err
+			}
+			if tokens[idx].kind == Separator {
+				idx++
+			}
+			if tokens[idx].kind != KeyValueSeparator {
+				return Type{}, 0, newParseErr(tokens[idx],
+					fmt.Sprintf("expected %s after field name in record type, found %s",
+						KeyValueSeparator, tokens[idx]))
+			}
+			idx++ // KeyValueSeparator
+
+			err = guardUnexpectedInputEnd(tokens, idx)
+			if err != nil {
+				return Type{}, 0, err
+			}
+			t, incr, err := p.parseSumType(tokens[idx:])
+			if err != nil {
+				return Type{}, 0, err
+			}
+			idx += incr
+			fields[tok.str] = t
+		} else {
+			return Type{}, 0, newParseErr(tok,
+				fmt.Sprintf("expected field name in record type, found %s", tok))
+		}
+
+		err := guardUnexpectedInputEnd(tokens, idx)
+		if err != nil {
+			return Type{}, 0, err
+		}
+	}
+	idx++ // RightBrace
+
+	return Type{kinds: kindComposite, fields: fields}, idx, nil
+}
+
+func (p *parser) parseFunctionCall(function Node, tokens []Tok) (FunctionCallNode, int, error) {
 	idx := 1
 	arguments := make([]Node, 0)
 
@@ -894,14 +1383,17 @@ func parseFunctionCall(function Node, tokens []Tok) (FunctionCallNode, int, erro
 	}
 
 	for tokens[idx].kind != RightParen {
-		expr, incr, err := parseExpression(tokens[idx:])
+		expr, incr, err := p.parseExpression(tokens[idx:])
 		if err != nil {
-			return FunctionCallNode{}, 0, err
+			idx, err = p.recoverFrom(err, tokens, idx, RightParen)
+			if err != nil {
+				return FunctionCallNode{}, 0, err
+			}
+		} else {
+			idx += incr
+			arguments = append(arguments, expr)
 		}
 
-		idx += incr
-		arguments = append(arguments, expr)
-
 		err = guardUnexpectedInputEnd(tokens, idx)
 		if err != nil {
 			return FunctionCallNode{}, 0, err
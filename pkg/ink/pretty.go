@@ -0,0 +1,190 @@
+package ink
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PrettyConfig configures how Pretty formats values.
+type PrettyConfig struct {
+	// Indent is the indentation of each level of composites printed across
+	// many lines. If empty, values are always printed on one line.
+	Indent string
+	// Width is the length of line within which a composite is printed on
+	// one line, rather than one entry per line. If 0, composites are
+	// always printed one entry per line when Indent is set.
+	Width int
+	// Depth is the number of levels of nested composites to print, after
+	// which composites are shown as {...}. If 0, all levels are printed.
+	Depth int
+	// MaxLen is the length after which strings and functions are truncated.
+	// If 0, they are never truncated.
+	MaxLen int
+	// Color colors values by their type with ANSI escape codes.
+	Color bool
+}
+
+// ReplPrettyConfig is the format of values printed by the repl.
+var ReplPrettyConfig = PrettyConfig{
+	Indent: "\t",
+	Width:  80,
+	Depth:  8,
+	MaxLen: maxPrintLen,
+}
+
+// Pretty formats a value for display. Keys of composites are sorted, with
+// list indexes in numeric order, and composites that contain themselves
+// are marked <circular> where they recur.
+func Pretty(v Value, cfg PrettyConfig) string {
+	p := prettyPrinter{
+		cfg:       cfg,
+		ancestors: map[uintptr]bool{},
+	}
+	return p.format(v, 0, 0)
+}
+
+type prettyPrinter struct {
+	cfg PrettyConfig
+	// ancestors are the composites being printed that contain the
+	// current value, by identity, to detect cycles
+	ancestors map[uintptr]bool
+}
+
+func (p *prettyPrinter) color(s, color string) string {
+	if !p.cfg.Color {
+		return s
+	}
+	return color + s + AnsiReset
+}
+
+func (p *prettyPrinter) truncate(s string) string {
+	if p.cfg.MaxLen > 0 && len(s) > p.cfg.MaxLen {
+		return s[:p.cfg.MaxLen] + ".."
+	}
+	return s
+}
+
+// format formats v at a nesting level, starting at column col of a line.
+func (p *prettyPrinter) format(v Value, level, col int) string {
+	switch v := v.(type) {
+	case StringValue:
+		return p.color(p.truncate(v.String()), AnsiGreen)
+	case NumberValue, BooleanValue:
+		return p.color(v.String(), AnsiYellow)
+	case NullValue, EmptyValue:
+		return p.color(v.String(), AnsiGray)
+	case FunctionValue, NativeFunctionValue:
+		return p.color(p.truncate(v.String()), AnsiBlue)
+	case CompositeValue:
+		return p.formatComposite(v, level, col)
+	default:
+		return v.String()
+	}
+}
+
+func (p *prettyPrinter) formatComposite(v CompositeValue, level, col int) string {
+	if len(v) == 0 {
+		return "{}"
+	}
+
+	id := compositeID(v)
+	if p.ancestors[id] {
+		return p.color("<circular>", AnsiRed)
+	}
+	if p.cfg.Depth > 0 && level >= p.cfg.Depth {
+		return "{...}"
+	}
+
+	p.ancestors[id] = true
+	defer delete(p.ancestors, id)
+
+	keys := sortedKeys(v)
+	if p.cfg.Indent != "" {
+		// print on one line if it fits, measured without colors
+		flat := prettyPrinter{
+			cfg:       p.cfg,
+			ancestors: p.ancestors,
+		}
+		flat.cfg.Indent = ""
+		flat.cfg.Color = false
+		line := flat.formatEntries(v, keys, level)
+		if p.cfg.Width > 0 && col+len(line) <= p.cfg.Width {
+			if p.cfg.Color {
+				flat.cfg.Color = true
+				line = flat.formatEntries(v, keys, level)
+			}
+			return line
+		}
+
+		indent := strings.Repeat(p.cfg.Indent, level+1)
+		// tabs are counted as one column each, which is close
+		// enough for deciding where to break lines
+		indentCol := len(indent)
+		entries := make([]string, len(keys))
+		for i, key := range keys {
+			entries[i] = indent + key + ": " +
+				p.format(v[key], level+1, indentCol+len(key)+2)
+		}
+		return "{\n" + strings.Join(entries, "\n") + "\n" +
+			strings.Repeat(p.cfg.Indent, level) + "}"
+	}
+
+	return p.formatEntries(v, keys, level)
+}
+
+// formatEntries formats a composite on one line.
+func (p *prettyPrinter) formatEntries(v CompositeValue, keys []string, level int) string {
+	entries := make([]string, len(keys))
+	for i, key := range keys {
+		entries[i] = key + ": " + p.format(v[key], level+1, 0)
+	}
+	return "{" + strings.Join(entries, ", ") + "}"
+}
+
+// sortedKeys returns the keys of a composite with integer keys first, in
+// numeric order, so lists print in order, followed by other keys sorted.
+func sortedKeys(v CompositeValue) []string {
+	// lists, which are most composites, have keys 0 to len - 1
+	// and need no sorting
+	keys := make([]string, len(v))
+	isList := true
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+		if _, ok := v[keys[i]]; !ok {
+			isList = false
+			break
+		}
+	}
+	if isList {
+		return keys
+	}
+
+	// parse each key once, rather than on every comparison
+	type sortKey struct {
+		key       string
+		n         int
+		isNumeric bool
+	}
+	sortKeys := make([]sortKey, 0, len(v))
+	for key := range v {
+		n, err := strconv.Atoi(key)
+		sortKeys = append(sortKeys, sortKey{key, n, err == nil})
+	}
+	sort.Slice(sortKeys, func(i, j int) bool {
+		a, b := sortKeys[i], sortKeys[j]
+		switch {
+		case a.isNumeric && b.isNumeric:
+			return a.n < b.n
+		case a.isNumeric || b.isNumeric:
+			return a.isNumeric
+		default:
+			return a.key < b.key
+		}
+	})
+
+	for i, k := range sortKeys {
+		keys[i] = k.key
+	}
+	return keys
+}
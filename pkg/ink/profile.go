@@ -0,0 +1,417 @@
+package ink
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultProfileRate is the number of samples a Profiler takes per second,
+// which is the same as the Go runtime's CPU profiler.
+const defaultProfileRate = 100
+
+// Profiler samples the Ink call stack of a running Engine, attributing
+// time and memory allocations to Ink functions and the positions at
+// which they were called. It is used by `ink -profile`, and writes
+// profiles that can be read by `go tool pprof`.
+//
+// A Profiler keeps track of the call stack of a single Engine, so
+// it should not be shared across Engines.
+type Profiler struct {
+	// lock guards the stack and samples, since the stack is
+	// sampled from a separate goroutine while the program runs
+	lock    sync.Mutex
+	stack   []*profileCall
+	samples map[string]*profileSample
+
+	period time.Duration
+	start  time.Time
+	// last is the time of the last sample, since samples may be taken
+	// less often than the period when the process is busy
+	last     time.Time
+	duration time.Duration
+	stop     chan bool
+	done     chan bool
+
+	// mallocs and allocBytes are the Go runtime's allocation totals
+	// at the last sample, so each sample counts allocations made
+	// since the previous sample
+	mallocs    uint64
+	allocBytes uint64
+}
+
+// profileFunc identifies an Ink function in a profile. Functions in Ink
+// do not have names, so functions are named by how they were called.
+type profileFunc struct {
+	name      string
+	file      string
+	startLine int
+}
+
+// profileCall is a frame of the Ink call stack.
+type profileCall struct {
+	fn profileFunc
+	// site is the position at which the function was called, in the
+	// calling function, if the function was called from Ink code
+	site    position
+	hasSite bool
+}
+
+// profileLocation is a position in the program in one frame of a sample.
+type profileLocation struct {
+	fn   profileFunc
+	line int
+}
+
+type profileSample struct {
+	// stack is ordered from the innermost call outwards
+	stack        []profileLocation
+	count        int64
+	wall         int64
+	allocObjects int64
+	allocBytes   int64
+}
+
+// NewProfiler creates a Profiler, to be set as an Engine's Profiler
+// before the Engine runs a program.
+func NewProfiler() *Profiler {
+	return &Profiler{
+		samples: map[string]*profileSample{},
+		period:  time.Second / defaultProfileRate,
+	}
+}
+
+// Start begins sampling the call stack on a separate goroutine.
+func (p *Profiler) Start() {
+	p.start = time.Now()
+	p.last = p.start
+	p.stop = make(chan bool)
+	p.done = make(chan bool)
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	p.mallocs, p.allocBytes = mem.Mallocs, mem.TotalAlloc
+
+	go func() {
+		defer close(p.done)
+
+		ticker := time.NewTicker(p.period)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.sample()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops sampling. A Profiler should be stopped before its profile
+// is written.
+func (p *Profiler) Stop() {
+	close(p.stop)
+	<-p.done
+	p.duration = time.Since(p.start)
+}
+
+func (p *Profiler) sample() {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(p.last)
+	p.last = now
+
+	mallocs, allocBytes := mem.Mallocs-p.mallocs, mem.TotalAlloc-p.allocBytes
+	p.mallocs, p.allocBytes = mem.Mallocs, mem.TotalAlloc
+
+	// the program is idle, waiting on callbacks
+	if len(p.stack) == 0 {
+		return
+	}
+
+	stack := make([]profileLocation, len(p.stack))
+	keys := make([]string, len(p.stack))
+	for i, call := range p.stack {
+		// each frame is positioned at the call into the next frame,
+		// and the innermost frame at the start of its function
+		line := call.fn.startLine
+		if i+1 < len(p.stack) && p.stack[i+1].hasSite {
+			line = p.stack[i+1].site.line
+		}
+
+		idx := len(p.stack) - 1 - i
+		stack[idx] = profileLocation{fn: call.fn, line: line}
+		keys[idx] = fmt.Sprintf("%s\x00%s\x00%d\x00%d",
+			call.fn.name, call.fn.file, call.fn.startLine, line)
+	}
+
+	key := strings.Join(keys, "\n")
+	s, prs := p.samples[key]
+	if !prs {
+		s = &profileSample{stack: stack}
+		p.samples[key] = s
+	}
+	s.count++
+	s.wall += int64(elapsed)
+	s.allocObjects += int64(mallocs)
+	s.allocBytes += int64(allocBytes)
+}
+
+func (p *Profiler) push(call *profileCall) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.stack = append(p.stack, call)
+}
+
+// replace replaces the innermost frame of the call stack, as in a tail call.
+func (p *Profiler) replace(call *profileCall) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.stack[len(p.stack)-1] = call
+}
+
+func (p *Profiler) pop() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.stack = p.stack[:len(p.stack)-1]
+}
+
+// topLevelCall is the frame of a program's top level in a Context.
+func topLevelCall(ctx *Context) *profileCall {
+	name := "(main)"
+	if ctx.File != "" {
+		name = relativePath(ctx.File)
+	}
+	return &profileCall{
+		fn: profileFunc{name: name, file: ctx.File, startLine: 1},
+	}
+}
+
+// inkCall returns the frame of a call to an Ink function. The call site,
+// if any, names the function, and other functions are named by where
+// they are defined.
+func inkCall(fn FunctionValue, site *profileCall) *profileCall {
+	call := &profileCall{}
+	if site != nil {
+		*call = *site
+	}
+
+	call.fn.startLine = fn.defn.line
+	if ctx := fn.parentFrame.ctx; ctx != nil {
+		call.fn.file = ctx.File
+	}
+	if call.fn.name == "" {
+		call.fn.name = fmt.Sprintf("anonymous fn [%s]", fn.defn.position)
+	}
+	return call
+}
+
+// nativeCall returns the frame of a call to a builtin function.
+func nativeCall(fn NativeFunctionValue, site *profileCall) *profileCall {
+	return &profileCall{
+		fn:      profileFunc{name: fn.name},
+		site:    site.site,
+		hasSite: site.hasSite,
+	}
+}
+
+// callSite returns the frame of a function called at a call site, missing
+// the function's definition, which is only known once it is called.
+func callSite(n FunctionCallNode) *profileCall {
+	return &profileCall{
+		fn:      profileFunc{name: profileName(n.function)},
+		site:    n.Position(),
+		hasSite: true,
+	}
+}
+
+// profileName returns the name by which a function is called, like `log`
+// or `std.map`, or "" if it is not called by name.
+func profileName(n Node) string {
+	switch n := n.(type) {
+	case IdentifierNode:
+		return n.val
+	case BinaryExprNode:
+		if n.operator != AccessorOp {
+			return ""
+		}
+		left := profileName(n.leftOperand)
+		if left == "" {
+			return ""
+		}
+		switch right := n.rightOperand.(type) {
+		case IdentifierNode:
+			return left + "." + right.val
+		case StringLiteralNode:
+			return left + "." + right.val
+		case NumberLiteralNode:
+			return left + "." + nToS(right.val)
+		}
+	}
+	return ""
+}
+
+// pprof sample value types, in the order of values in each sample
+var profileSampleTypes = [][2]string{
+	{"samples", "count"},
+	{"wall", "nanoseconds"},
+	{"alloc_objects", "count"},
+	{"alloc_space", "bytes"},
+}
+
+// WriteProfile writes the samples taken by the Profiler to w as
+// a gzipped protocol buffer in the pprof profile format.
+func (p *Profiler) WriteProfile(w io.Writer) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	strs := []string{""}
+	strIndex := map[string]int{"": 0}
+	str := func(s string) int64 {
+		idx, prs := strIndex[s]
+		if !prs {
+			idx = len(strs)
+			strs = append(strs, s)
+			strIndex[s] = idx
+		}
+		return int64(idx)
+	}
+
+	var buf protoBuffer
+	for _, st := range profileSampleTypes {
+		var vt protoBuffer
+		vt.int64(1, str(st[0]))
+		vt.int64(2, str(st[1]))
+		buf.message(1, vt)
+	}
+
+	funcIDs := map[profileFunc]uint64{}
+	var funcs protoBuffer
+	locationIDs := map[profileLocation]uint64{}
+	var locations protoBuffer
+	for _, s := range p.samples {
+		ids := make([]uint64, len(s.stack))
+		for i, loc := range s.stack {
+			fnID, prs := funcIDs[loc.fn]
+			if !prs {
+				fnID = uint64(len(funcIDs) + 1)
+				funcIDs[loc.fn] = fnID
+
+				var fn protoBuffer
+				fn.uint64(1, fnID)
+				fn.int64(2, str(loc.fn.name))
+				fn.int64(3, str(loc.fn.name))
+				fn.int64(4, str(loc.fn.file))
+				fn.int64(5, int64(loc.fn.startLine))
+				funcs.message(5, fn)
+			}
+
+			locID, prs := locationIDs[loc]
+			if !prs {
+				locID = uint64(len(locationIDs) + 1)
+				locationIDs[loc] = locID
+
+				var line protoBuffer
+				line.uint64(1, fnID)
+				line.int64(2, int64(loc.line))
+				var location protoBuffer
+				location.uint64(1, locID)
+				location.message(4, line)
+				locations.message(4, location)
+			}
+			ids[i] = locID
+		}
+
+		var sample protoBuffer
+		sample.packedUint64(1, ids)
+		sample.packedInt64(2, []int64{s.count, s.wall, s.allocObjects, s.allocBytes})
+		buf.message(2, sample)
+	}
+	buf = append(buf, locations...)
+	buf = append(buf, funcs...)
+
+	// the string table is complete once all other fields are encoded
+	var periodType protoBuffer
+	periodType.int64(1, str("wall"))
+	periodType.int64(2, str("nanoseconds"))
+	defaultType := str("wall")
+	for _, s := range strs {
+		buf.string(6, s)
+	}
+	buf.int64(9, p.start.UnixNano())
+	buf.int64(10, int64(p.duration))
+	buf.message(11, periodType)
+	buf.int64(12, int64(p.period))
+	buf.int64(14, defaultType)
+
+	gz := gzip.NewWriter(w)
+	_, err := gz.Write(buf)
+	if err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// protoBuffer encodes the protocol buffer wire format, for the few field
+// types used in pprof profiles.
+type protoBuffer []byte
+
+func (b *protoBuffer) varint(x uint64) {
+	for x >= 0x80 {
+		*b = append(*b, byte(x)|0x80)
+		x >>= 7
+	}
+	*b = append(*b, byte(x))
+}
+
+func (b *protoBuffer) uint64(field int, x uint64) {
+	b.varint(uint64(field) << 3)
+	b.varint(x)
+}
+
+func (b *protoBuffer) int64(field int, x int64) {
+	b.uint64(field, uint64(x))
+}
+
+func (b *protoBuffer) bytes(field int, bs []byte) {
+	b.varint(uint64(field)<<3 | 2)
+	b.varint(uint64(len(bs)))
+	*b = append(*b, bs...)
+}
+
+func (b *protoBuffer) string(field int, s string) {
+	b.bytes(field, []byte(s))
+}
+
+func (b *protoBuffer) message(field int, m protoBuffer) {
+	b.bytes(field, m)
+}
+
+func (b *protoBuffer) packedUint64(field int, xs []uint64) {
+	var packed protoBuffer
+	for _, x := range xs {
+		packed.varint(x)
+	}
+	b.bytes(field, packed)
+}
+
+func (b *protoBuffer) packedInt64(field int, xs []int64) {
+	var packed protoBuffer
+	for _, x := range xs {
+		packed.varint(uint64(x))
+	}
+	b.bytes(field, packed)
+}
@@ -0,0 +1,76 @@
+package ink
+
+import (
+	"regexp"
+	"strconv"
+	"sync"
+)
+
+// maxCachedRegexps is the number of compiled patterns kept by compileRegex.
+// When the cache is full, it is emptied, which is simpler than tracking use
+// and cheap, since programs rarely use this many patterns at once.
+const maxCachedRegexps = 256
+
+// regexCache holds compiled patterns by their source, so that the regex
+// builtins can be given the same pattern string in a hot loop without
+// compiling it on every call.
+var regexCache = struct {
+	sync.Mutex
+	patterns map[string]*regexp.Regexp
+}{
+	patterns: map[string]*regexp.Regexp{},
+}
+
+// compileRegex returns the compiled form of a pattern, from the cache if
+// the pattern has been compiled before.
+func compileRegex(pattern string) (*regexp.Regexp, error) {
+	regexCache.Lock()
+	defer regexCache.Unlock()
+
+	if re, ok := regexCache.patterns[pattern]; ok {
+		return re, nil
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(regexCache.patterns) >= maxCachedRegexps {
+		regexCache.patterns = map[string]*regexp.Regexp{}
+	}
+	regexCache.patterns[pattern] = re
+	return re, nil
+}
+
+// regexMatchValue converts a match of re in s, given as submatch indexes
+// by regexp's Find*SubmatchIndex methods, into an Ink composite of the form
+// {text, index, groups, named}. Groups that did not take part in the match
+// are ().
+func regexMatchValue(re *regexp.Regexp, s []byte, loc []int) CompositeValue {
+	group := func(i int) Value {
+		if loc[2*i] < 0 {
+			return Null
+		}
+		// copied, since strings are mutable
+		return append(StringValue{}, s[loc[2*i]:loc[2*i+1]]...)
+	}
+
+	groups := CompositeValue{}
+	named := CompositeValue{}
+	for i, name := range re.SubexpNames() {
+		if i == 0 {
+			continue
+		}
+		groups[strconv.Itoa(i-1)] = group(i)
+		if name != "" {
+			named[name] = group(i)
+		}
+	}
+
+	return CompositeValue{
+		"text":   group(0),
+		"index":  NumberValue(loc[0]),
+		"groups": groups,
+		"named":  named,
+	}
+}
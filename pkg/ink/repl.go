@@ -0,0 +1,323 @@
+package ink
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxHistory is the number of lines of history the REPL keeps
+const maxHistory = 1000
+
+// replCommands are the meta-commands understood by the REPL, with
+// descriptions shown by :help.
+var replCommands = [][2]string{
+	{":load <path>", "run an Ink file in the current session"},
+	{":reset", "clear all variables and start a new session"},
+	{":type <expr>", "show the inferred type of an expression without running it"},
+	{":time <expr>", "run an expression and show how long it took"},
+	{":ast <expr>", "show the syntax tree of an expression"},
+	{":help", "show this help message"},
+	{":quit", "exit the repl"},
+}
+
+// REPL is an interactive Ink session that reads expressions from a terminal
+// and prints their values. It supports line editing, multi-line input, tab
+// completion of names and composite keys, persistent history, and
+// meta-commands that start with ":".
+type REPL struct {
+	Engine *Engine
+
+	ctx         *Context
+	editor      *lineEditor
+	historyPath string
+	out         io.Writer
+}
+
+// NewREPL creates a REPL evaluating in eng, reading from in and writing to
+// out. If historyPath is not empty, history is loaded from and saved to the
+// file at that path.
+func NewREPL(eng *Engine, in *os.File, out io.Writer, historyPath string) *REPL {
+	r := &REPL{
+		Engine:      eng,
+		editor:      newLineEditor(in, out),
+		historyPath: historyPath,
+		out:         out,
+	}
+	r.editor.complete = r.complete
+	r.reset()
+	r.loadHistory()
+	return r
+}
+
+// reset starts a new session with a fresh Context.
+func (r *REPL) reset() {
+	r.ctx = r.Engine.CreateContext()
+
+	// add repl-specific builtins
+	r.ctx.LoadFunc("clear", func(ctx *Context, in []Value) (Value, error) {
+		fmt.Fprint(r.out, "\x1b[2J\x1b[H")
+		return Null, nil
+	})
+	r.ctx.LoadFunc("dump", func(ctx *Context, in []Value) (Value, error) {
+		ctx.Dump()
+		return Null, nil
+	})
+}
+
+func (r *REPL) loadHistory() {
+	if r.historyPath == "" {
+		return
+	}
+
+	file, err := os.Open(r.historyPath)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		r.editor.addHistory(scanner.Text())
+	}
+	if len(r.editor.history) > maxHistory {
+		r.editor.history = r.editor.history[len(r.editor.history)-maxHistory:]
+	}
+}
+
+func (r *REPL) saveHistory(line string) {
+	r.editor.addHistory(line)
+	if r.historyPath == "" {
+		return
+	}
+
+	file, err := os.OpenFile(r.historyPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	fmt.Fprintln(file, line)
+}
+
+// Run reads and evaluates input until input ends or the user quits.
+func (r *REPL) Run() {
+	prompt := AnsiGreenBold + "> " + AnsiReset
+	continuation := AnsiGreenBold + ". " + AnsiReset
+
+	source := ""
+	for {
+		p := prompt
+		if source != "" {
+			p = continuation
+		}
+
+		line, err := r.editor.readLine(p)
+		if err == errInterrupted {
+			source = ""
+			continue
+		} else if err == io.EOF {
+			return
+		} else if err != nil {
+			LogErrf(
+				ErrSystem,
+				"unexpected end of input:\n\t-> %s", err.Error(),
+			)
+		}
+
+		if strings.TrimSpace(line) != "" {
+			r.saveHistory(line)
+		}
+
+		if source == "" && strings.HasPrefix(strings.TrimSpace(line), ":") {
+			if !r.command(strings.TrimSpace(line)) {
+				return
+			}
+			continue
+		}
+
+		source += line + "\n"
+		if strings.TrimSpace(source) == "" {
+			source = ""
+			continue
+		}
+		if incompleteInput(source) {
+			continue
+		}
+
+		// we don't really care if expressions fail to eval
+		// at the top level, user will see regardless, so drop err
+		val, _ := r.ctx.Exec(strings.NewReader(source))
+		if val != nil {
+			r.print(val)
+		}
+		source = ""
+	}
+}
+
+// print prints the value of an expression, colored by type if the repl
+// is running in a terminal.
+func (r *REPL) print(val Value) {
+	cfg := ReplPrettyConfig
+	if r.editor.terminal {
+		cfg.Color = true
+		fmt.Fprintln(r.out, Pretty(val, cfg))
+	} else {
+		LogInteractive(Pretty(val, cfg))
+	}
+}
+
+// command runs a meta-command, and returns false if the REPL should exit.
+func (r *REPL) command(line string) bool {
+	name, arg := line, ""
+	if idx := strings.IndexAny(line, " \t"); idx >= 0 {
+		name, arg = line[:idx], strings.TrimSpace(line[idx+1:])
+	}
+
+	switch name {
+	case ":quit", ":q", ":exit":
+		return false
+	case ":help", ":h":
+		for _, cmd := range replCommands {
+			fmt.Fprintf(r.out, "  %-14s %s\n", cmd[0], cmd[1])
+		}
+	case ":reset":
+		r.reset()
+		LogInteractive("session reset")
+	case ":load":
+		if arg == "" {
+			LogSafeErr(ErrSystem, ":load needs a file path")
+			break
+		}
+		// run the file as if typed in, but resolve its load()
+		// calls and errors relative to the file
+		cwd, file := r.ctx.Cwd, r.ctx.File
+		if !filepath.IsAbs(arg) {
+			arg = filepath.Join(cwd, arg)
+		}
+		r.ctx.ExecPath(arg)
+		r.ctx.Cwd, r.ctx.File = cwd, file
+	case ":type":
+		nodes, diags := ParseAll(strings.NewReader(arg))
+		if len(diags) == 0 {
+			var t Type
+			// callbacks from wait() or listen() may be changing variables
+			r.Engine.WithLock(func() {
+				t, diags = CheckInFrame(nodes, r.ctx.Frame)
+			})
+			if len(diags) == 0 {
+				LogInteractive(t.String())
+			}
+		}
+		for _, d := range diags {
+			LogSafeErr(d.Reason, d.Message)
+		}
+	case ":time":
+		start := time.Now()
+		val, _ := r.ctx.Exec(strings.NewReader(arg))
+		elapsed := time.Since(start)
+		if val != nil {
+			r.print(val)
+		}
+		LogInteractivef("took %s", elapsed)
+	case ":ast":
+		nodes, diags := ParseAll(strings.NewReader(arg))
+		for _, n := range nodes {
+			LogInteractive(n.String())
+		}
+		for _, d := range diags {
+			LogSafeErr(d.Reason, d.Message)
+		}
+	default:
+		LogSafeErr(ErrSystem, fmt.Sprintf("unknown command %s, try :help", name))
+	}
+	return true
+}
+
+// isNameChar reports whether c can appear in an identifier, or in the
+// chain of property accesses being completed.
+func isNameChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '_' || c == '?' || c == '!' || c == '.'
+}
+
+// complete returns completions for the word at the end of text: names of
+// variables, keys of composites after a ".", or meta-commands.
+func (r *REPL) complete(text string) ([]string, int) {
+	if strings.HasPrefix(text, ":") && !strings.ContainsAny(text, " \t") {
+		candidates := []string{}
+		for _, cmd := range replCommands {
+			name := strings.Fields(cmd[0])[0]
+			if strings.HasPrefix(name, text) {
+				candidates = append(candidates, name)
+			}
+		}
+		return candidates, 0
+	}
+
+	start := len(text)
+	for start > 0 && isNameChar(text[start-1]) {
+		start--
+	}
+	word := text[start:]
+
+	var names map[string]bool
+	if dot := strings.LastIndex(word, "."); dot >= 0 {
+		// complete keys of a composite, like std.ma -> std.map
+		r.Engine.WithLock(func() {
+			names = r.keysAt(strings.Split(word[:dot], "."))
+		})
+		if names == nil {
+			return nil, start
+		}
+		start += dot + 1
+		word = word[dot+1:]
+	} else {
+		names = map[string]bool{}
+		r.Engine.WithLock(func() {
+			for frame := r.ctx.Frame; frame != nil; frame = frame.parent {
+				for name := range frame.vt {
+					names[name] = true
+				}
+			}
+		})
+	}
+
+	candidates := []string{}
+	for name := range names {
+		if strings.HasPrefix(name, word) {
+			candidates = append(candidates, name)
+		}
+	}
+	sort.Strings(candidates)
+	return candidates, start
+}
+
+// keysAt returns the keys of the composite at a chain of property accesses
+// like std.map, or nil if there is no composite there. Callers hold the
+// Engine's execution lock, since callbacks may be changing the composite.
+func (r *REPL) keysAt(parts []string) map[string]bool {
+	val, ok := r.ctx.Frame.Get(parts[0])
+	for _, key := range parts[1:] {
+		if comp, isComposite := val.(CompositeValue); ok && isComposite {
+			val, ok = comp[key]
+		} else {
+			ok = false
+		}
+	}
+	comp, isComposite := val.(CompositeValue)
+	if !ok || !isComposite {
+		return nil
+	}
+
+	names := map[string]bool{}
+	for key := range comp {
+		names[key] = true
+	}
+	return names
+}
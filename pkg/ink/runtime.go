@@ -5,6 +5,8 @@ import (
 	"bytes"
 	"context"
 	crand "crypto/rand"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -15,10 +17,13 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 )
 
 // NativeFunctionValue represents a function whose implementation is written
@@ -59,8 +64,17 @@ func (ctx *Context) LoadEnvironment() {
 	ctx.LoadFunc("read", inkRead)
 	ctx.LoadFunc("write", inkWrite)
 	ctx.LoadFunc("delete", inkDelete)
+	ctx.LoadFunc("open", inkOpen)
 	ctx.LoadFunc("listen", inkListen)
 	ctx.LoadFunc("req", inkReq)
+	ctx.LoadFunc("cookieJar", inkCookieJar)
+	ctx.LoadFunc("wsConnect", inkWsConnect)
+	ctx.LoadFunc("tcpListen", inkTCPListen)
+	ctx.LoadFunc("tcpConnect", inkTCPConnect)
+	ctx.LoadFunc("udpBind", inkUDPBind)
+	ctx.LoadFunc("udpSend", inkUDPSend)
+	ctx.LoadFunc("unixListen", inkUnixListen)
+	ctx.LoadFunc("unixConnect", inkUnixConnect)
 	ctx.LoadFunc("rand", inkRand)
 	ctx.LoadFunc("urand", inkUrand)
 	ctx.LoadFunc("time", inkTime)
@@ -84,11 +98,50 @@ func (ctx *Context) LoadEnvironment() {
 	ctx.LoadFunc("point", inkPoint)
 	ctx.LoadFunc("char", inkChar)
 
+	// serialization
+	ctx.LoadFunc("jsonEncode", inkJSONEncode)
+	ctx.LoadFunc("jsonDecode", inkJSONDecode)
+
+	// strings
+	ctx.LoadFunc("index", inkIndex)
+	ctx.LoadFunc("split", inkSplit)
+	ctx.LoadFunc("replace", inkReplace)
+	ctx.LoadFunc("upper", inkUpper)
+	ctx.LoadFunc("lower", inkLower)
+	ctx.LoadFunc("trim", inkTrim)
+	ctx.LoadFunc("trimPrefix", inkTrimPrefix)
+	ctx.LoadFunc("trimSuffix", inkTrimSuffix)
+	ctx.LoadFunc("hasPrefix?", inkHasPrefix)
+	ctx.LoadFunc("hasSuffix?", inkHasSuffix)
+	ctx.LoadFunc("repeat", inkRepeat)
+	ctx.LoadFunc("slice", inkSlice)
+
+	// unicode
+	ctx.LoadFunc("runes", inkRunes)
+	ctx.LoadFunc("runeCount", inkRuneCount)
+	ctx.LoadFunc("codepoint", inkCodepoint)
+	ctx.LoadFunc("fromCodepoint", inkFromCodepoint)
+	ctx.LoadFunc("fold", inkFold)
+	ctx.LoadFunc("nfc", inkNFC)
+	ctx.LoadFunc("nfd", inkNFD)
+
+	// regular expressions
+	ctx.LoadFunc("regex", inkRegex)
+	ctx.LoadFunc("regexMatch?", inkRegexMatch)
+	ctx.LoadFunc("regexFind", inkRegexFind)
+	ctx.LoadFunc("regexFindAll", inkRegexFindAll)
+	ctx.LoadFunc("regexReplace", inkRegexReplace)
+
 	// introspection
 	ctx.LoadFunc("type", inkType)
 	ctx.LoadFunc("len", inkLen)
 	ctx.LoadFunc("keys", inkKeys)
 
+	// assertions
+	ctx.LoadFunc("assert", inkAssert)
+	ctx.LoadFunc("assertEqual", inkAssertEqual)
+	ctx.LoadFunc("skip", inkSkip)
+
 	// side effects
 	rand.Seed(time.Now().UTC().UnixNano())
 }
@@ -718,6 +771,8 @@ func inkDelete(ctx *Context, in []Value) (Value, error) {
 type inkHTTPHandler struct {
 	ctx         *Context
 	inkCallback FunctionValue
+	// stream is whether request and response bodies are streamed
+	stream bool
 }
 
 func (h inkHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -736,10 +791,19 @@ func (h inkHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// unmarshal request
 	method := r.Method
 	url := r.URL.String()
-	headers := CompositeValue{}
-	for key, values := range r.Header {
-		headers[key] = StringValue(strings.Join(values, ","))
+	headers, headerValues := headersValue(r.Header)
+
+	if h.stream {
+		h.serveStream(w, r, CompositeValue{
+			"method":       StringValue(method),
+			"url":          StringValue(url),
+			"headers":      headers,
+			"headerValues": headerValues,
+			"body":         Null,
+		})
+		return
 	}
+
 	var body Value
 	if r.ContentLength == 0 {
 		body = StringValue{}
@@ -759,6 +823,7 @@ func (h inkHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// construct request object to pass to Ink, and call handler
 	responseEnded := false
+	upgradeCalled := false
 	responses := make(chan Value, 1)
 	// this is what Ink's callback calls to send a response
 	endHandler := func(ctx *Context, in []Value) (Value, error) {
@@ -774,88 +839,72 @@ func (h inkHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				"end() callback to listen() was called more than once",
 			})
 		}
+		if upgradeCalled {
+			return nil, Err{
+				ErrRuntime,
+				"end() callback to listen() was called after upgrade()",
+			}
+		}
 		responseEnded = true
 		responses <- in[0]
 
 		return Null, nil
 	}
+	// the handler may instead upgrade the request to a WebSocket,
+	// after which there is no response to write
+	upgraded := make(chan struct{})
+	upgradeFn := wsUpgradeFn(w, r, &upgradeCalled, func() bool {
+		return responseEnded
+	}, func() { close(upgraded) })
 
 	ctx.ExecListener(func() {
 		_, err := evalInkFunction(cb, false, CompositeValue{
 			"type": StringValue("req"),
 			"data": CompositeValue{
-				"method":  StringValue(method),
-				"url":     StringValue(url),
-				"headers": headers,
-				"body":    body,
+				"method":       StringValue(method),
+				"url":          StringValue(url),
+				"headers":      headers,
+				"headerValues": headerValues,
+				"body":         body,
 			},
 			"end": NativeFunctionValue{
 				name: "end",
 				exec: endHandler,
 				ctx:  ctx,
 			},
+			"upgrade": NativeFunctionValue{
+				name: "upgrade",
+				exec: upgradeFn,
+				ctx:  ctx,
+			},
 		})
 		cbMaybeErr(err)
 	})
 
-	// validate response from Ink callback
-	resp := <-responses
-	rsp, isComposite := resp.(CompositeValue)
-	if !isComposite {
-		ctx.LogErr(Err{
-			ErrRuntime,
-			fmt.Sprintf("callback to listen() should return a response, got %s", resp),
-		})
+	// validate response from Ink callback, and
+	// unmarshal response = {status, headers, body}
+	var resp Value
+	select {
+	case resp = <-responses:
+	case <-upgraded:
 		return
 	}
-
-	// unmarshal response from the return value
-	// response = {status, headers, body}
-	statusVal, okStatus := rsp["status"]
-	headersVal, okHeaders := rsp["headers"]
-	bodyVal, okBody := rsp["body"]
-
-	resStatus, okStatus := statusVal.(NumberValue)
-	resHeaders, okHeaders := headersVal.(CompositeValue)
-	resBody, okBody := bodyVal.(StringValue)
-
-	if !okStatus || !okHeaders || !okBody {
-		ctx.LogErr(Err{
-			ErrRuntime,
-			fmt.Sprintf("callback to listen() returned malformed response, %s", rsp),
-		})
+	code, header, resBody, err := parseResponse(resp)
+	if err != nil {
+		ctx.LogErr(err.(Err))
 		return
 	}
 
 	// write values to response
 	// Content-Length is automatically set for us by Go
-	for k, v := range resHeaders {
-		if str, isStr := v.(StringValue); isStr {
-			w.Header().Set(k, string(str))
-		} else {
-			ctx.LogErr(Err{
-				ErrRuntime,
-				fmt.Sprintf("could not set response header, value %s was not a string", v),
-			})
-			return
-		}
-	}
-
-	code := int(resStatus)
-	// guard against invalid HTTP codes, which cause Go panics.
-	// https://golang.org/src/net/http/server.go
-	if code < 100 || code > 599 {
-		ctx.LogErr(Err{
-			ErrRuntime,
-			fmt.Sprintf("could not set response status code, code %d is not valid", code),
-		})
-		return
+	for k, v := range header {
+		w.Header()[k] = v
 	}
 
 	// status code write must follow all other header writes,
 	// since it sends the status
-	w.WriteHeader(int(resStatus))
-	_, err := w.Write(resBody)
+	w.WriteHeader(code)
+	_, err = w.Write(resBody)
 	if err != nil {
 		ctx.ExecListener(func() {
 			_, err := evalInkFunction(cb, false, errMsg(
@@ -867,6 +916,66 @@ func (h inkHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func inkOpen(ctx *Context, in []Value) (Value, error) {
+	if len(in) < 3 {
+		return nil, Err{
+			ErrRuntime,
+			fmt.Sprintf("open() takes 3 arguments: path, mode, and callback, but got %d", len(in)),
+		}
+	}
+
+	filePath, isFilePathString := in[0].(StringValue)
+	mode, isModeString := in[1].(StringValue)
+	cb, isCbFunction := in[2].(FunctionValue)
+	if !isFilePathString || !isModeString || !isCbFunction {
+		return nil, Err{
+			ErrRuntime,
+			"unsupported combination of argument types in open()",
+		}
+	}
+	if _, isMode := fileModes[string(mode)]; !isMode {
+		return nil, Err{
+			ErrRuntime,
+			fmt.Sprintf("open() takes a mode of 'r', 'w', 'a', 'r+', 'w+', or 'a+', got %s", mode),
+		}
+	}
+
+	cbMaybeErr := func(err error) {
+		if err != nil {
+			ctx.LogErr(Err{
+				ErrRuntime,
+				fmt.Sprintf("error in callback to open(), %s", err.Error()),
+			})
+		}
+	}
+
+	ctx.Engine.Listeners.Add(1)
+	go func() {
+		defer ctx.Engine.Listeners.Done()
+
+		handle, err := openFile(ctx, string(filePath), string(mode))
+		if err != nil {
+			ctx.ExecListener(func() {
+				_, err := evalInkFunction(cb, false, errMsg(
+					fmt.Sprintf("error opening requested file in open(), %s", err.Error()),
+				))
+				cbMaybeErr(err)
+			})
+			return
+		}
+
+		ctx.ExecListener(func() {
+			_, err := evalInkFunction(cb, false, CompositeValue{
+				"type": StringValue("data"),
+				"data": handle.value(string(mode)),
+			})
+			cbMaybeErr(err)
+		})
+	}()
+
+	return Null, nil
+}
+
 func inkListen(ctx *Context, in []Value) (Value, error) {
 	if len(in) < 2 {
 		return nil, Err{
@@ -877,14 +986,31 @@ func inkListen(ctx *Context, in []Value) (Value, error) {
 
 	host, isString := in[0].(StringValue)
 	cb, isCbFunction := in[1].(FunctionValue)
+	opts := CompositeValue{}
+	isOptsComp := true
+	if len(in) > 2 {
+		opts, isOptsComp = in[2].(CompositeValue)
+	}
 
-	if !isString || !isCbFunction {
+	if !isString || !isCbFunction || !isOptsComp {
 		return nil, Err{
 			ErrRuntime,
 			"unsupported combination of argument types in listen()",
 		}
 	}
 
+	stream, isStreamBool := opts["stream"].(BooleanValue)
+	if _, hasStream := opts["stream"]; hasStream && !isStreamBool {
+		return nil, Err{
+			ErrRuntime,
+			fmt.Sprintf("stream option to listen() must be a boolean, got %s", opts["stream"]),
+		}
+	}
+	tlsOpts, err := parseTLSOptions(ctx, "listen", opts)
+	if err != nil {
+		return nil, err
+	}
+
 	if !ctx.Engine.Permissions.Net {
 		return NativeFunctionValue{
 			name: "close",
@@ -913,13 +1039,31 @@ func inkListen(ctx *Context, in []Value) (Value, error) {
 		Handler: inkHTTPHandler{
 			ctx:         ctx,
 			inkCallback: cb,
+			stream:      bool(stream),
 		},
 	}
 
 	ctx.Engine.Listeners.Add(1)
 	go func() {
 		defer ctx.Engine.Listeners.Done()
-		err := server.ListenAndServe()
+		if tlsOpts != nil {
+			config, err := tlsOpts.serverConfig()
+			if err != nil {
+				sendErr(fmt.Sprintf("error loading TLS certificates in listen(), %s", err.Error()))
+				return
+			}
+			server.TLSConfig = config
+		}
+
+		listener, err := httpListener(string(host))
+		if err == nil {
+			if tlsOpts != nil {
+				// certificates are already in server.TLSConfig
+				err = server.ServeTLS(listener, "", "")
+			} else {
+				err = server.Serve(listener)
+			}
+		}
 		if err != nil && err != http.ErrServerClosed {
 			sendErr(fmt.Sprintf("error starting http server in listen(), %s", err.Error()))
 		}
@@ -977,12 +1121,7 @@ func inkReq(ctx *Context, in []Value) (Value, error) {
 		}, nil
 	}
 
-	client := &http.Client{
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			// do not follow redirects
-			return http.ErrUseLastResponse
-		},
-	}
+	client := &http.Client{}
 	reqContext, reqCancel := context.WithCancel(context.Background())
 
 	closer := func(ctx *Context, in []Value) (Value, error) {
@@ -1011,6 +1150,8 @@ func inkReq(ctx *Context, in []Value) (Value, error) {
 		urlVal, okURL := data["url"]
 		headersVal, okHeaders := data["headers"]
 		bodyVal, okBody := data["body"]
+		streamVal, okStream := data["stream"]
+		socketVal, okSocket := data["socket"]
 
 		if !okMethod {
 			methodVal = StringValue("GET")
@@ -1024,13 +1165,23 @@ func inkReq(ctx *Context, in []Value) (Value, error) {
 			bodyVal = StringValue("")
 			okBody = true
 		}
+		if !okStream {
+			streamVal = BooleanValue(false)
+			okStream = true
+		}
+		if !okSocket {
+			socketVal = StringValue("")
+			okSocket = true
+		}
 
 		reqMethod, okMethod := methodVal.(StringValue)
 		reqURL, okURL := urlVal.(StringValue)
 		reqHeaders, okHeaders := headersVal.(CompositeValue)
 		reqBody, okBody := bodyVal.(StringValue)
+		stream, okStream := streamVal.(BooleanValue)
+		socket, okSocket := socketVal.(StringValue)
 
-		if !okMethod || !okURL || !okHeaders || !okBody {
+		if !okMethod || !okURL || !okHeaders || !okBody || !okStream || !okSocket {
 			ctx.LogErr(Err{
 				ErrRuntime,
 				fmt.Sprintf("request in req() is malformed, %s", data),
@@ -1038,6 +1189,12 @@ func inkReq(ctx *Context, in []Value) (Value, error) {
 			return
 		}
 
+		options, err := parseReqOptions(ctx, data)
+		if err != nil {
+			ctx.LogErr(err.(Err))
+			return
+		}
+
 		req, err := http.NewRequest(
 			string(reqMethod),
 			string(reqURL),
@@ -1050,18 +1207,52 @@ func inkReq(ctx *Context, in []Value) (Value, error) {
 
 		req = req.WithContext(reqContext)
 
+		if options.query != nil {
+			query := req.URL.Query()
+			for k, values := range options.query {
+				query[k] = append(query[k], values...)
+			}
+			req.URL.RawQuery = query.Encode()
+		}
+
+		client.Timeout = options.timeout
+		client.Jar = options.jar
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			// by default, do not follow redirects
+			if len(via) > options.maxRedirects {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		}
+
+		if len(socket) > 0 || options.proxy != nil || options.tls != nil {
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			defer transport.CloseIdleConnections()
+			client.Transport = transport
+
+			if len(socket) > 0 {
+				// send the request over a Unix domain socket
+				transport.Proxy = nil
+				transport.DialContext = unixDialer(string(socket))
+			}
+			if options.proxy != nil {
+				transport.Proxy = http.ProxyURL(options.proxy)
+			}
+			if options.tls != nil {
+				config, err := options.tls.clientConfig()
+				if err != nil {
+					sendErr(fmt.Sprintf("error loading TLS certificates in req(), %s", err.Error()))
+					return
+				}
+				transport.TLSClientConfig = config
+			}
+		}
+
 		// construct headers
 		// Content-Length is automatically set for us by Go
 		req.Header.Set("User-Agent", "") // remove Go's default user agent header
-		for k, v := range reqHeaders {
-			if str, isStr := v.(StringValue); isStr {
-				req.Header.Set(k, string(str))
-			} else {
-				ctx.LogErr(Err{
-					ErrRuntime,
-					fmt.Sprintf("could not set request header, value %s was not a string", v),
-				})
-			}
+		if err := setHeaders(req.Header, reqHeaders); err != nil {
+			ctx.LogErr(err.(Err))
 		}
 
 		// send request
@@ -1073,9 +1264,30 @@ func inkReq(ctx *Context, in []Value) (Value, error) {
 		defer resp.Body.Close()
 
 		resStatus := NumberValue(resp.StatusCode)
-		resHeaders := CompositeValue{}
-		for key, values := range resp.Header {
-			resHeaders[key] = StringValue(strings.Join(values, ","))
+		resHeaders, resHeaderValues := headersValue(resp.Header)
+
+		if stream {
+			// send the response as soon as headers arrive, then its body
+			// in chunks, waiting for each event to be handled in order
+			ctx.ExecListenerAndWait(func() {
+				_, err := evalInkFunction(cb, false, CompositeValue{
+					"type": StringValue("resp"),
+					"data": CompositeValue{
+						"status":       resStatus,
+						"headers":      resHeaders,
+						"headerValues": resHeaderValues,
+						"body":         Null,
+					},
+				})
+				if err != nil {
+					ctx.LogErr(Err{
+						ErrRuntime,
+						fmt.Sprintf("error in callback to req(), %s", err.Error()),
+					})
+				}
+			})
+			streamBody(ctx, "req", resp.Body, cb)
+			return
 		}
 
 		var resBody Value
@@ -1094,9 +1306,10 @@ func inkReq(ctx *Context, in []Value) (Value, error) {
 			_, err := evalInkFunction(cb, false, CompositeValue{
 				"type": StringValue("resp"),
 				"data": CompositeValue{
-					"status":  resStatus,
-					"headers": resHeaders,
-					"body":    resBody,
+					"status":       resStatus,
+					"headers":      resHeaders,
+					"headerValues": resHeaderValues,
+					"body":         resBody,
 				},
 			})
 			if err != nil {
@@ -1115,6 +1328,187 @@ func inkReq(ctx *Context, in []Value) (Value, error) {
 	}, nil
 }
 
+func inkCookieJar(ctx *Context, in []Value) (Value, error) {
+	return cookieJarValue(ctx), nil
+}
+
+func inkWsConnect(ctx *Context, in []Value) (Value, error) {
+	if len(in) < 2 {
+		return nil, Err{
+			ErrRuntime,
+			fmt.Sprintf("wsConnect() takes 2 arguments: url and callback, but got %d", len(in)),
+		}
+	}
+
+	wsURL, isString := in[0].(StringValue)
+	cb, isCbFunction := in[1].(FunctionValue)
+	opts := CompositeValue{}
+	isOptsComp := true
+	if len(in) > 2 {
+		opts, isOptsComp = in[2].(CompositeValue)
+	}
+
+	if !isString || !isCbFunction || !isOptsComp {
+		return nil, Err{
+			ErrRuntime,
+			"unsupported combination of argument types in wsConnect()",
+		}
+	}
+
+	header := http.Header{}
+	if headersVal, ok := opts["headers"]; ok {
+		headers, isComposite := headersVal.(CompositeValue)
+		if !isComposite {
+			return nil, Err{
+				ErrRuntime,
+				fmt.Sprintf("headers option to wsConnect() must be a composite, got %s", headersVal),
+			}
+		}
+		if err := setHeaders(header, headers); err != nil {
+			return nil, err
+		}
+	}
+	tlsOpts, err := parseTLSOptions(ctx, "wsConnect", opts)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := make(chan *wsConn, 1)
+	if !ctx.Engine.Permissions.Net {
+		// fake connection that never opens
+		conn <- nil
+		return wsControls(ctx, "wsConnect", conn), nil
+	}
+
+	ctx.Engine.Listeners.Add(1)
+	go func() {
+		defer ctx.Engine.Listeners.Done()
+
+		sendErr := func(msg string) {
+			ctx.ExecListener(func() {
+				_, err := evalInkFunction(cb, false, errMsg(msg))
+				if err != nil {
+					ctx.LogErr(Err{
+						ErrRuntime,
+						fmt.Sprintf("error in callback to wsConnect(), %s", err.Error()),
+					})
+				}
+			})
+		}
+
+		var config *tls.Config
+		if tlsOpts != nil {
+			var err error
+			config, err = tlsOpts.clientConfig()
+			if err != nil {
+				conn <- nil
+				sendErr(fmt.Sprintf("error loading TLS certificates in wsConnect(), %s", err.Error()))
+				return
+			}
+		}
+
+		ws, err := wsDial(string(wsURL), header, config)
+		conn <- ws
+		if err != nil {
+			sendErr(fmt.Sprintf("error connecting in wsConnect(), %s", err.Error()))
+			return
+		}
+
+		wsServe(ctx, "wsConnect", ws, cb)
+	}()
+
+	return wsControls(ctx, "wsConnect", conn), nil
+}
+
+// addrArgs validates the arguments of a socket builtin that takes an
+// address and a callback.
+func addrArgs(name string, in []Value) (string, FunctionValue, error) {
+	if len(in) < 2 {
+		return "", FunctionValue{}, Err{
+			ErrRuntime,
+			fmt.Sprintf("%s() takes 2 arguments: address and callback, but got %d", name, len(in)),
+		}
+	}
+
+	addr, isString := in[0].(StringValue)
+	cb, isCbFunction := in[1].(FunctionValue)
+	if !isString || !isCbFunction {
+		return "", FunctionValue{}, Err{
+			ErrRuntime,
+			fmt.Sprintf("unsupported combination of argument types in %s()", name),
+		}
+	}
+	return string(addr), cb, nil
+}
+
+func inkTCPListen(ctx *Context, in []Value) (Value, error) {
+	addr, cb, err := addrArgs("tcpListen", in)
+	if err != nil {
+		return nil, err
+	}
+
+	return netListen(ctx, "tcpListen", "tcp", addr, cb)
+}
+
+func inkTCPConnect(ctx *Context, in []Value) (Value, error) {
+	addr, cb, err := addrArgs("tcpConnect", in)
+	if err != nil {
+		return nil, err
+	}
+
+	return netConnect(ctx, "tcpConnect", "tcp", addr, cb)
+}
+
+func inkUnixListen(ctx *Context, in []Value) (Value, error) {
+	path, cb, err := addrArgs("unixListen", in)
+	if err != nil {
+		return nil, err
+	}
+
+	return netListen(ctx, "unixListen", "unix", path, cb)
+}
+
+func inkUnixConnect(ctx *Context, in []Value) (Value, error) {
+	path, cb, err := addrArgs("unixConnect", in)
+	if err != nil {
+		return nil, err
+	}
+
+	return netConnect(ctx, "unixConnect", "unix", path, cb)
+}
+
+func inkUDPBind(ctx *Context, in []Value) (Value, error) {
+	addr, cb, err := addrArgs("udpBind", in)
+	if err != nil {
+		return nil, err
+	}
+
+	return udpBind(ctx, addr, cb)
+}
+
+func inkUDPSend(ctx *Context, in []Value) (Value, error) {
+	if len(in) < 3 {
+		return nil, Err{
+			ErrRuntime,
+			fmt.Sprintf("udpSend() takes 3 arguments: address, data, and callback, but got %d", len(in)),
+		}
+	}
+
+	addr, isAddrString := in[0].(StringValue)
+	data, isDataString := in[1].(StringValue)
+	cb, isCbFunction := in[2].(FunctionValue)
+	if !isAddrString || !isDataString || !isCbFunction {
+		return nil, Err{
+			ErrRuntime,
+			"unsupported combination of argument types in udpSend()",
+		}
+	}
+
+	// copied, since strings are mutable
+	udpSend(ctx, string(addr), append(StringValue{}, data...), cb)
+	return Null, nil
+}
+
 func inkRand(ctx *Context, in []Value) (Value, error) {
 	return NumberValue(rand.Float64()), nil
 }
@@ -1202,9 +1596,10 @@ func inkExec(ctx *Context, in []Value) (Value, error) {
 	path, isPathStr := in[0].(StringValue)
 	args, isArgsComp := in[1].(CompositeValue)
 	stdin, isStdinStr := in[2].(StringValue)
+	opts, isOptsComp := in[2].(CompositeValue)
 	stdoutFn, isStdoutFnFunc := in[3].(FunctionValue)
 
-	if !isPathStr || !isArgsComp || !isStdinStr || !isStdoutFnFunc {
+	if !isPathStr || !isArgsComp || !(isStdinStr || isOptsComp) || !isStdoutFnFunc {
 		return nil, Err{
 			ErrRuntime,
 			"unsupported combination of argument types in exec()",
@@ -1231,6 +1626,11 @@ func inkExec(ctx *Context, in []Value) (Value, error) {
 		}
 	}
 
+	// with options in place of stdin, output is streamed
+	if isOptsComp {
+		return inkExecStream(ctx, string(path), argsList, opts, stdoutFn)
+	}
+
 	if !ctx.Engine.Permissions.Exec {
 		closed := false
 
@@ -1652,19 +2052,671 @@ func inkChar(ctx *Context, in []Value) (Value, error) {
 	return StringValue([]byte{byte(cp)}), nil
 }
 
-func inkType(ctx *Context, in []Value) (Value, error) {
+func inkJSONEncode(ctx *Context, in []Value) (Value, error) {
 	if len(in) < 1 {
 		return nil, Err{
 			ErrRuntime,
-			"type() takes 1 argument",
+			"jsonEncode() takes 1 argument",
 		}
 	}
 
-	switch in[0].(type) {
+	data, err := jsonValue(in[0], map[uintptr]bool{})
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(data); err != nil {
+		return nil, Err{
+			ErrRuntime,
+			fmt.Sprintf("jsonEncode() could not encode %s: %s", in[0], err),
+		}
+	}
+
+	return StringValue(bytes.TrimSuffix(buf.Bytes(), []byte("\n"))), nil
+}
+
+// jsonValue converts an Ink value to a Go value that encodes to JSON.
+// Composites with keys 0 to n-1 encode as arrays, and other composites as
+// objects, with keys sorted so that encoding is deterministic. ancestors are
+// the composites containing v, to report cycles, which cannot be encoded.
+func jsonValue(v Value, ancestors map[uintptr]bool) (interface{}, error) {
+	switch v := v.(type) {
+	case NullValue, EmptyValue:
+		return nil, nil
 	case StringValue:
-		return StringValue("string"), nil
-	case NumberValue:
-		return StringValue("number"), nil
+		return string(v), nil
+	case BooleanValue:
+		return bool(v), nil
+	case NumberValue:
+		f := float64(v)
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, Err{
+				ErrRuntime,
+				fmt.Sprintf("jsonEncode() cannot encode %s as a JSON number", v),
+			}
+		}
+		return json.Number(nvToS(v)), nil
+	case FunctionValue, NativeFunctionValue:
+		return nil, Err{
+			ErrRuntime,
+			fmt.Sprintf("jsonEncode() cannot encode a function, got %s", v),
+		}
+	case CompositeValue:
+		id := compositeID(v)
+		if ancestors[id] {
+			return nil, Err{
+				ErrRuntime,
+				"jsonEncode() cannot encode a composite that contains itself",
+			}
+		}
+		ancestors[id] = true
+		defer delete(ancestors, id)
+
+		isList := len(v) > 0
+		for i := 0; i < len(v) && isList; i++ {
+			_, isList = v[strconv.Itoa(i)]
+		}
+
+		if isList {
+			list := make([]interface{}, len(v))
+			for i := range list {
+				val, err := jsonValue(v[strconv.Itoa(i)], ancestors)
+				if err != nil {
+					return nil, err
+				}
+				list[i] = val
+			}
+			return list, nil
+		}
+
+		// encoding/json sorts map keys
+		obj := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			data, err := jsonValue(val, ancestors)
+			if err != nil {
+				return nil, err
+			}
+			obj[key] = data
+		}
+		return obj, nil
+	default:
+		return nil, Err{
+			ErrRuntime,
+			fmt.Sprintf("jsonEncode() cannot encode %s", v),
+		}
+	}
+}
+
+func inkJSONDecode(ctx *Context, in []Value) (Value, error) {
+	if len(in) < 1 {
+		return nil, Err{
+			ErrRuntime,
+			"jsonDecode() takes 1 argument",
+		}
+	}
+	str, isString := in[0].(StringValue)
+	if !isString {
+		return nil, Err{
+			ErrRuntime,
+			fmt.Sprintf("jsonDecode() takes a string argument, got %s", in[0]),
+		}
+	}
+
+	var data interface{}
+	dec := json.NewDecoder(bytes.NewReader(str))
+	dec.UseNumber()
+	err := dec.Decode(&data)
+	if err == nil && dec.More() {
+		err = fmt.Errorf("unexpected data after top-level value")
+	}
+	if err != nil {
+		return errMsg(fmt.Sprintf("could not decode JSON: %s", err.Error())), nil
+	}
+
+	val, err := inkValue(data)
+	if err != nil {
+		return errMsg(fmt.Sprintf("could not decode JSON: %s", err.Error())), nil
+	}
+	return val, nil
+}
+
+// inkValue converts a value decoded by encoding/json to an Ink value. It
+// returns an error for numbers out of the range of an Ink number.
+func inkValue(data interface{}) (Value, error) {
+	switch data := data.(type) {
+	case nil:
+		return Null, nil
+	case string:
+		return StringValue(data), nil
+	case bool:
+		return BooleanValue(data), nil
+	case json.Number:
+		f, err := data.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("number %s is out of range", data)
+		}
+		return NumberValue(f), nil
+	case []interface{}:
+		list := make(CompositeValue, len(data))
+		for i, val := range data {
+			v, err := inkValue(val)
+			if err != nil {
+				return nil, err
+			}
+			list[strconv.Itoa(i)] = v
+		}
+		return list, nil
+	case map[string]interface{}:
+		obj := make(CompositeValue, len(data))
+		for key, val := range data {
+			v, err := inkValue(val)
+			if err != nil {
+				return nil, err
+			}
+			obj[key] = v
+		}
+		return obj, nil
+	default:
+		return Null, nil
+	}
+}
+
+// stringArgs checks that a builtin is called with at least n arguments,
+// the first n of which are strings, and returns them.
+func stringArgs(name string, in []Value, n int) ([]StringValue, error) {
+	if len(in) < n {
+		return nil, Err{
+			ErrRuntime,
+			fmt.Sprintf("%s() takes %d arguments", name, n),
+		}
+	}
+
+	strs := make([]StringValue, n)
+	for i := range strs {
+		str, isString := in[i].(StringValue)
+		if !isString {
+			return nil, Err{
+				ErrRuntime,
+				fmt.Sprintf("%s() takes string arguments, got %s", name, in[i]),
+			}
+		}
+		strs[i] = str
+	}
+	return strs, nil
+}
+
+func inkIndex(ctx *Context, in []Value) (Value, error) {
+	args, err := stringArgs("index", in, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	return NumberValue(bytes.Index(args[0], args[1])), nil
+}
+
+func inkSplit(ctx *Context, in []Value) (Value, error) {
+	args, err := stringArgs("split", in, 2)
+	if err != nil {
+		return nil, err
+	}
+	s, delim := args[0], args[1]
+
+	list := CompositeValue{}
+	if len(delim) == 0 {
+		// split into bytes, not UTF-8 sequences like bytes.Split
+		for i := range s {
+			list[strconv.Itoa(i)] = StringValue{s[i]}
+		}
+		return list, nil
+	}
+
+	// parts are copied, since strings are mutable
+	for i, part := range bytes.Split(s, delim) {
+		list[strconv.Itoa(i)] = append(StringValue{}, part...)
+	}
+	return list, nil
+}
+
+func inkReplace(ctx *Context, in []Value) (Value, error) {
+	args, err := stringArgs("replace", in, 3)
+	if err != nil {
+		return nil, err
+	}
+	s, old, new := args[0], args[1], args[2]
+
+	if len(old) == 0 {
+		return s, nil
+	}
+	return StringValue(bytes.ReplaceAll(s, old, new)), nil
+}
+
+// mapASCII returns a copy of s with each byte between lo and hi
+// shifted by delta, as used for ASCII case mapping.
+func mapASCII(s StringValue, lo, hi byte, delta int) StringValue {
+	mapped := make(StringValue, len(s))
+	for i, b := range s {
+		if lo <= b && b <= hi {
+			b = byte(int(b) + delta)
+		}
+		mapped[i] = b
+	}
+	return mapped
+}
+
+func inkUpper(ctx *Context, in []Value) (Value, error) {
+	args, err := stringArgs("upper", in, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	return mapASCII(args[0], 'a', 'z', 'A'-'a'), nil
+}
+
+func inkLower(ctx *Context, in []Value) (Value, error) {
+	args, err := stringArgs("lower", in, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	return mapASCII(args[0], 'A', 'Z', 'a'-'A'), nil
+}
+
+// trimLeft removes prefix from the start of s until s does not begin
+// with prefix. trimRight does the same for suffixes.
+func trimLeft(s, prefix StringValue) StringValue {
+	if len(prefix) == 0 {
+		return s
+	}
+	for bytes.HasPrefix(s, prefix) {
+		s = s[len(prefix):]
+	}
+	return s
+}
+
+func trimRight(s, suffix StringValue) StringValue {
+	if len(suffix) == 0 {
+		return s
+	}
+	for bytes.HasSuffix(s, suffix) {
+		s = s[:len(s)-len(suffix)]
+	}
+	return s
+}
+
+func inkTrimPrefix(ctx *Context, in []Value) (Value, error) {
+	args, err := stringArgs("trimPrefix", in, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(StringValue{}, trimLeft(args[0], args[1])...), nil
+}
+
+func inkTrimSuffix(ctx *Context, in []Value) (Value, error) {
+	args, err := stringArgs("trimSuffix", in, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(StringValue{}, trimRight(args[0], args[1])...), nil
+}
+
+func inkTrim(ctx *Context, in []Value) (Value, error) {
+	args, err := stringArgs("trim", in, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(StringValue{}, trimLeft(trimRight(args[0], args[1]), args[1])...), nil
+}
+
+func inkHasPrefix(ctx *Context, in []Value) (Value, error) {
+	args, err := stringArgs("hasPrefix?", in, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	return BooleanValue(bytes.HasPrefix(args[0], args[1])), nil
+}
+
+func inkHasSuffix(ctx *Context, in []Value) (Value, error) {
+	args, err := stringArgs("hasSuffix?", in, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	return BooleanValue(bytes.HasSuffix(args[0], args[1])), nil
+}
+
+func inkRepeat(ctx *Context, in []Value) (Value, error) {
+	args, err := stringArgs("repeat", in, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(in) < 2 {
+		return nil, Err{
+			ErrRuntime,
+			"repeat() takes 2 arguments",
+		}
+	}
+	count, isNumber := in[1].(NumberValue)
+	if !isNumber || count < 0 {
+		return nil, Err{
+			ErrRuntime,
+			fmt.Sprintf("repeat() takes a non-negative number of times to repeat, got %s", in[1]),
+		}
+	}
+
+	return StringValue(bytes.Repeat(args[0], int(count))), nil
+}
+
+func inkSlice(ctx *Context, in []Value) (Value, error) {
+	if len(in) < 3 {
+		return nil, Err{
+			ErrRuntime,
+			"slice() takes 3 arguments",
+		}
+	}
+	start, isStartNumber := in[1].(NumberValue)
+	end, isEndNumber := in[2].(NumberValue)
+	if !isStartNumber || !isEndNumber {
+		return nil, Err{
+			ErrRuntime,
+			fmt.Sprintf("slice() takes number indexes, got %s and %s", in[1], in[2]),
+		}
+	}
+
+	// clamp indexes to 0 <= start <= end <= len, like std.clamp
+	clamp := func(length int) (int, int) {
+		lo, hi := int(start), int(end)
+		if hi > length {
+			hi = length
+		}
+		if hi < 0 {
+			hi = 0
+		}
+		if lo < 0 {
+			lo = 0
+		}
+		if lo > hi {
+			lo = hi
+		}
+		return lo, hi
+	}
+
+	switch s := in[0].(type) {
+	case StringValue:
+		lo, hi := clamp(len(s))
+		return append(StringValue{}, s[lo:hi]...), nil
+	case CompositeValue:
+		lo, hi := clamp(len(s))
+		list := make(CompositeValue, hi-lo)
+		for i := lo; i < hi; i++ {
+			val, prs := s[strconv.Itoa(i)]
+			if !prs {
+				val = Null
+			}
+			list[strconv.Itoa(i-lo)] = val
+		}
+		return list, nil
+	default:
+		return nil, Err{
+			ErrRuntime,
+			fmt.Sprintf("slice() takes a string or list, got %s", in[0]),
+		}
+	}
+}
+
+func inkRunes(ctx *Context, in []Value) (Value, error) {
+	args, err := stringArgs("runes", in, 1)
+	if err != nil {
+		return nil, err
+	}
+	s := args[0]
+
+	list := CompositeValue{}
+	for i := 0; len(s) > 0; i++ {
+		// invalid bytes are decoded with size 1, and kept as they are
+		_, size := utf8.DecodeRune(s)
+		list[strconv.Itoa(i)] = append(StringValue{}, s[:size]...)
+		s = s[size:]
+	}
+	return list, nil
+}
+
+func inkRuneCount(ctx *Context, in []Value) (Value, error) {
+	args, err := stringArgs("runeCount", in, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	return NumberValue(utf8.RuneCount(args[0])), nil
+}
+
+func inkCodepoint(ctx *Context, in []Value) (Value, error) {
+	if len(in) < 1 {
+		return nil, Err{
+			ErrRuntime,
+			"codepoint() takes 1 argument",
+		}
+	}
+	str, isString := in[0].(StringValue)
+	if !isString || len(str) < 1 {
+		return nil, Err{
+			ErrRuntime,
+			fmt.Sprintf("codepoint() takes a string argument of length at least 1, got %s", in[0]),
+		}
+	}
+
+	r, _ := utf8.DecodeRune(str)
+	return NumberValue(r), nil
+}
+
+func inkFromCodepoint(ctx *Context, in []Value) (Value, error) {
+	if len(in) < 1 {
+		return nil, Err{
+			ErrRuntime,
+			"fromCodepoint() takes 1 argument",
+		}
+	}
+	cp, isNumber := in[0].(NumberValue)
+	if !isNumber || cp != NumberValue(rune(cp)) || !utf8.ValidRune(rune(cp)) {
+		return nil, Err{
+			ErrRuntime,
+			fmt.Sprintf("fromCodepoint() takes a valid Unicode codepoint, got %s", in[0]),
+		}
+	}
+
+	return StringValue(string(rune(cp))), nil
+}
+
+func inkFold(ctx *Context, in []Value) (Value, error) {
+	args, err := stringArgs("fold", in, 1)
+	if err != nil {
+		return nil, err
+	}
+	s := args[0]
+
+	folded := make(StringValue, 0, len(s))
+	for len(s) > 0 {
+		r, size := utf8.DecodeRune(s)
+		if r == utf8.RuneError && size == 1 {
+			folded = append(folded, s[0])
+		} else {
+			if f, ok := caseFolds[r]; ok {
+				r = f
+			}
+			folded = append(folded, string(r)...)
+		}
+		s = s[size:]
+	}
+	return folded, nil
+}
+
+func inkNFC(ctx *Context, in []Value) (Value, error) {
+	args, err := stringArgs("nfc", in, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	return StringValue(normalizeNFC(args[0])), nil
+}
+
+func inkNFD(ctx *Context, in []Value) (Value, error) {
+	args, err := stringArgs("nfd", in, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	return StringValue(normalizeNFD(args[0])), nil
+}
+
+// regexArgs validates the string arguments of a regex builtin, of which the
+// first is a pattern, and compiles the pattern.
+func regexArgs(name string, in []Value, n int) (*regexp.Regexp, []StringValue, error) {
+	args, err := stringArgs(name, in, n)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	re, err := compileRegex(string(args[0]))
+	if err != nil {
+		return nil, nil, Err{
+			ErrRuntime,
+			fmt.Sprintf("%s() got an invalid pattern: %s", name, err.Error()),
+		}
+	}
+	return re, args, nil
+}
+
+func inkRegex(ctx *Context, in []Value) (Value, error) {
+	args, err := stringArgs("regex", in, 1)
+	if err != nil {
+		return nil, err
+	}
+	pattern := args[0]
+
+	if _, err := compileRegex(string(pattern)); err != nil {
+		return errMsg(fmt.Sprintf("invalid pattern: %s", err.Error())), nil
+	}
+
+	// methods of the compiled pattern call the regex builtins
+	// with the pattern as the first argument
+	method := func(name string, builtin func(*Context, []Value) (Value, error)) Value {
+		return NativeFunctionValue{
+			name: "regex." + name,
+			exec: func(ctx *Context, in []Value) (Value, error) {
+				return builtin(ctx, append([]Value{pattern}, in...))
+			},
+			ctx: ctx,
+		}
+	}
+	return CompositeValue{
+		"type":    StringValue("regex"),
+		"pattern": pattern,
+		"match?":  method("match?", inkRegexMatch),
+		"find":    method("find", inkRegexFind),
+		"findAll": method("findAll", inkRegexFindAll),
+		"replace": method("replace", inkRegexReplace),
+	}, nil
+}
+
+func inkRegexMatch(ctx *Context, in []Value) (Value, error) {
+	re, args, err := regexArgs("regexMatch?", in, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	return BooleanValue(re.Match(args[1])), nil
+}
+
+func inkRegexFind(ctx *Context, in []Value) (Value, error) {
+	re, args, err := regexArgs("regexFind", in, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	loc := re.FindSubmatchIndex(args[1])
+	if loc == nil {
+		return Null, nil
+	}
+	return regexMatchValue(re, args[1], loc), nil
+}
+
+func inkRegexFindAll(ctx *Context, in []Value) (Value, error) {
+	re, args, err := regexArgs("regexFindAll", in, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	list := CompositeValue{}
+	for i, loc := range re.FindAllSubmatchIndex(args[1], -1) {
+		list[strconv.Itoa(i)] = regexMatchValue(re, args[1], loc)
+	}
+	return list, nil
+}
+
+func inkRegexReplace(ctx *Context, in []Value) (Value, error) {
+	if len(in) < 3 {
+		return nil, Err{
+			ErrRuntime,
+			"regexReplace() takes 3 arguments",
+		}
+	}
+	re, args, err := regexArgs("regexReplace", in, 2)
+	if err != nil {
+		return nil, err
+	}
+	s := args[1]
+
+	switch replacement := in[2].(type) {
+	case StringValue:
+		return StringValue(re.ReplaceAll(s, replacement)), nil
+	case FunctionValue, NativeFunctionValue:
+		result := StringValue{}
+		last := 0
+		for _, loc := range re.FindAllSubmatchIndex(s, -1) {
+			rv, err := evalInkFunction(replacement, false, regexMatchValue(re, s, loc))
+			if err != nil {
+				return nil, err
+			}
+			str, isString := rv.(StringValue)
+			if !isString {
+				return nil, Err{
+					ErrRuntime,
+					fmt.Sprintf("regexReplace() callback must return a string, got %s", rv),
+				}
+			}
+
+			result = append(result, s[last:loc[0]]...)
+			result = append(result, str...)
+			last = loc[1]
+		}
+		return append(result, s[last:]...), nil
+	default:
+		return nil, Err{
+			ErrRuntime,
+			fmt.Sprintf("regexReplace() takes a string or function replacement, got %s", in[2]),
+		}
+	}
+}
+
+func inkType(ctx *Context, in []Value) (Value, error) {
+	if len(in) < 1 {
+		return nil, Err{
+			ErrRuntime,
+			"type() takes 1 argument",
+		}
+	}
+
+	switch in[0].(type) {
+	case StringValue:
+		return StringValue("string"), nil
+	case NumberValue:
+		return StringValue("number"), nil
 	case BooleanValue:
 		return StringValue("boolean"), nil
 	case NullValue:
@@ -1724,3 +2776,134 @@ func inkKeys(ctx *Context, in []Value) (Value, error) {
 
 	return cv, nil
 }
+
+func inkAssert(ctx *Context, in []Value) (Value, error) {
+	if len(in) < 1 {
+		return nil, Err{
+			ErrRuntime,
+			"assert() takes at least 1 argument",
+		}
+	}
+
+	if cond, isBool := in[0].(BooleanValue); isBool && bool(cond) {
+		return Null, nil
+	}
+
+	msg := fmt.Sprintf("expected true, got %s", in[0])
+	if len(in) >= 2 {
+		if label, isStr := in[1].(StringValue); isStr {
+			msg = string(label)
+		}
+	}
+	return nil, Err{ErrAssertion, msg}
+}
+
+func inkSkip(ctx *Context, in []Value) (Value, error) {
+	if len(in) != 1 {
+		return nil, Err{
+			ErrRuntime,
+			"skip() takes 1 argument",
+		}
+	}
+
+	reason, isStr := in[0].(StringValue)
+	if !isStr {
+		return nil, Err{
+			ErrRuntime,
+			fmt.Sprintf("skip() takes a string reason, but got %s", in[0]),
+		}
+	}
+
+	if ctx.Engine.skipHandler == nil {
+		return nil, Err{
+			ErrRuntime,
+			"skip() can only be called in a test run by ink test",
+		}
+	}
+	ctx.Engine.skipHandler(string(reason))
+	return Null, nil
+}
+
+func inkAssertEqual(ctx *Context, in []Value) (Value, error) {
+	if len(in) < 2 {
+		return nil, Err{
+			ErrRuntime,
+			"assertEqual() takes 2 arguments",
+		}
+	}
+
+	actual, expected := in[0], in[1]
+	if actual.Equals(expected) {
+		return Null, nil
+	}
+
+	_, actualIsComposite := actual.(CompositeValue)
+	_, expectedIsComposite := expected.(CompositeValue)
+	if !actualIsComposite || !expectedIsComposite {
+		return nil, Err{
+			ErrAssertion,
+			fmt.Sprintf("expected %s, got %s", expected, actual),
+		}
+	}
+
+	return nil, Err{
+		ErrAssertion,
+		"composite values differ\n\t" +
+			strings.Join(diffValues("", expected, actual, nil), "\n\t"),
+	}
+}
+
+// diffValues describes the differences between an expected and an actual
+// value, one line per difference found. Composite values are compared
+// property by property, where path is the path to the property from the
+// values first compared. Like compositeEquals, visited records pairs of
+// composites already being compared, so composites that contain
+// themselves are described once.
+func diffValues(path string, expected, actual Value, visited map[compositePair]bool) []string {
+	if expected.Equals(actual) {
+		return nil
+	}
+
+	expectedObj, expectedIsComposite := expected.(CompositeValue)
+	actualObj, actualIsComposite := actual.(CompositeValue)
+	if !expectedIsComposite || !actualIsComposite {
+		return []string{fmt.Sprintf("%s: expected %s, got %s", path, expected, actual)}
+	}
+
+	// composites may contain themselves, so differences already being
+	// described are not described again
+	pair := compositePair{compositeID(expectedObj), compositeID(actualObj)}
+	if visited[pair] {
+		return []string{fmt.Sprintf("%s: <cycle>", path)}
+	}
+	if visited == nil {
+		visited = map[compositePair]bool{}
+	}
+	visited[pair] = true
+
+	keys := make([]string, 0, len(expectedObj))
+	for key := range expectedObj {
+		keys = append(keys, key)
+	}
+	for key := range actualObj {
+		if _, prs := expectedObj[key]; !prs {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	diffs := make([]string, 0)
+	for _, key := range keys {
+		keyPath := path + "." + key
+		expectedVal, inExpected := expectedObj[key]
+		actualVal, inActual := actualObj[key]
+		if !inActual {
+			diffs = append(diffs, fmt.Sprintf("%s: expected %s, but missing", keyPath, expectedVal))
+		} else if !inExpected {
+			diffs = append(diffs, fmt.Sprintf("%s: unexpected %s", keyPath, actualVal))
+		} else {
+			diffs = append(diffs, diffValues(keyPath, expectedVal, actualVal, visited)...)
+		}
+	}
+	return diffs
+}
@@ -0,0 +1,338 @@
+package ink
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TestResult is the outcome of running a single test function
+// in an Ink test file.
+type TestResult struct {
+	File string
+	Name string
+	// Line and Col are the position of the test function's definition
+	Line int
+	Col  int
+	// Failures are the messages of every error or failed assertion
+	// while running the test, which is empty if the test passed
+	Failures []string
+	// Skipped is the reason given to skip() if the test skipped itself
+	Skipped  string
+	Duration time.Duration
+}
+
+// Passed reports whether the test ran without any errors.
+func (r TestResult) Passed() bool {
+	return len(r.Failures) == 0
+}
+
+// WasSkipped reports whether the test called skip() and ran without any errors.
+func (r TestResult) WasSkipped() bool {
+	return r.Passed() && r.Skipped != ""
+}
+
+// FindTestFiles returns the paths of all Ink test files (files ending in
+// _test.ink) in the directory tree at root. If root is a file, it is
+// returned as the only test file.
+func FindTestFiles(root string) ([]string, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{root}, nil
+	}
+
+	files := make([]string, 0)
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && strings.HasSuffix(info.Name(), "_test.ink") {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// testFunctions returns the definitions of the test functions in a program,
+// which are functions bound at the top level to names beginning with "test".
+func testFunctions(nodes []Node) []IdentifierNode {
+	tests := make([]IdentifierNode, 0)
+	for _, n := range nodes {
+		bin, isBin := n.(BinaryExprNode)
+		if !isBin || bin.operator != DefineOp {
+			continue
+		}
+
+		ident, isIdent := bin.leftOperand.(IdentifierNode)
+		if !isIdent || !strings.HasPrefix(ident.val, "test") {
+			continue
+		}
+		if _, isFn := bin.rightOperand.(FunctionLiteralNode); isFn {
+			tests = append(tests, ident)
+		}
+	}
+	return tests
+}
+
+// RunTestFile runs every test function in the Ink test file at filePath.
+//
+// Test functions are functions bound at the top level of the file to names
+// beginning with "test", like `testSum := () => assertEqual(sum([1, 2]), 3)`.
+// Each test runs in a fresh Context in its own Engine: the whole file is
+// evaluated, then the test function is called with no arguments, and the test
+// finishes when all of its callbacks have run. A test fails if there are any
+// runtime errors or failed assertions while it runs, and is skipped if it
+// calls skip(reason), like when a tool it needs is not installed.
+//
+// If hook is not nil, it is set as the Hook of every Engine running a test.
+func RunTestFile(filePath string, perms PermissionsConfig, hook EvalHook) ([]TestResult, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	nodes, diagnostics := ParseAll(file)
+	file.Close()
+
+	if len(diagnostics) > 0 {
+		msgs := make([]string, len(diagnostics))
+		for i, d := range diagnostics {
+			msgs[i] = d.Message
+		}
+		return nil, fmt.Errorf("could not parse %s:\n\t-> %s",
+			filePath, strings.Join(msgs, "\n\t-> "))
+	}
+
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	tests := testFunctions(nodes)
+	results := make([]TestResult, len(tests))
+	for i, test := range tests {
+		start := time.Now()
+		failures, skipped := runTest(absPath, nodes, test.val, perms, hook)
+		results[i] = TestResult{
+			File:     filePath,
+			Name:     test.val,
+			Line:     test.line,
+			Col:      test.col,
+			Failures: failures,
+			Skipped:  skipped,
+			Duration: time.Since(start),
+		}
+	}
+
+	return results, nil
+}
+
+func runTest(absPath string, nodes []Node, name string, perms PermissionsConfig, hook EvalHook) ([]string, string) {
+	eng := &Engine{
+		Permissions: perms,
+		Hook:        hook,
+	}
+
+	// errors may be reported from callbacks on other goroutines
+	var failuresLock sync.Mutex
+	failures := make([]string, 0)
+	eng.errHandler = func(e Err) {
+		failuresLock.Lock()
+		defer failuresLock.Unlock()
+
+		failures = append(failures, e.message)
+	}
+	skipped := ""
+	eng.skipHandler = func(reason string) {
+		failuresLock.Lock()
+		defer failuresLock.Unlock()
+
+		if skipped == "" {
+			skipped = reason
+		}
+	}
+
+	ctx := eng.CreateContext()
+	ctx.Cwd = filepath.Dir(absPath)
+	ctx.File = absPath
+
+	nodeStream := make(chan Node)
+	go func() {
+		defer close(nodeStream)
+		for _, n := range nodes {
+			nodeStream <- n
+		}
+	}()
+	_, err := ctx.Eval(nodeStream, false)
+	if err != nil {
+		// the rest of the nodes are not evaluated
+		for range nodeStream {
+		}
+		return failures, skipped
+	}
+
+	eng.evalLock.Lock()
+	fn, _ := ctx.Frame.Get(name)
+	_, err = evalInkFunction(fn, false)
+	eng.evalLock.Unlock()
+	if e, isErr := err.(Err); isErr {
+		ctx.LogErr(e)
+	}
+
+	eng.Listeners.Wait()
+
+	failuresLock.Lock()
+	defer failuresLock.Unlock()
+	return failures, skipped
+}
+
+// WriteTestReport writes a human-readable report of test results to w.
+func WriteTestReport(w io.Writer, results []TestResult) {
+	passed, skipped := 0, 0
+	for _, r := range results {
+		if r.WasSkipped() {
+			skipped++
+			fmt.Fprintf(w, "skip %s [%d:%d] in %s (%s): %s\n",
+				r.Name, r.Line, r.Col, r.File, r.Duration.Round(time.Microsecond), r.Skipped)
+		} else if r.Passed() {
+			passed++
+			fmt.Fprintf(w, "ok   %s [%d:%d] in %s (%s)\n",
+				r.Name, r.Line, r.Col, r.File, r.Duration.Round(time.Microsecond))
+		} else {
+			fmt.Fprintf(w, "FAIL %s [%d:%d] in %s (%s)\n",
+				r.Name, r.Line, r.Col, r.File, r.Duration.Round(time.Microsecond))
+			for _, f := range r.Failures {
+				fmt.Fprintf(w, "\t%s\n", strings.ReplaceAll(f, "\n", "\n\t"))
+			}
+		}
+	}
+
+	if skipped > 0 {
+		fmt.Fprintf(w, "%d passed, %d failed, %d skipped\n",
+			passed, len(results)-passed-skipped, skipped)
+	} else {
+		fmt.Fprintf(w, "%d passed, %d failed\n", passed, len(results)-passed)
+	}
+}
+
+// WriteTAP writes test results to w in the Test Anything Protocol format.
+func WriteTAP(w io.Writer, results []TestResult) {
+	fmt.Fprintf(w, "TAP version 13\n")
+	fmt.Fprintf(w, "1..%d\n", len(results))
+	for i, r := range results {
+		if r.WasSkipped() {
+			fmt.Fprintf(w, "ok %d - %s: %s # SKIP %s\n", i+1, r.File, r.Name, r.Skipped)
+			continue
+		}
+		if r.Passed() {
+			fmt.Fprintf(w, "ok %d - %s: %s\n", i+1, r.File, r.Name)
+			continue
+		}
+
+		fmt.Fprintf(w, "not ok %d - %s: %s\n", i+1, r.File, r.Name)
+		fmt.Fprintf(w, "  ---\n")
+		fmt.Fprintf(w, "  at: %s:%d:%d\n", r.File, r.Line, r.Col)
+		fmt.Fprintf(w, "  failures:\n")
+		for _, f := range r.Failures {
+			fmt.Fprintf(w, "    - |\n      %s\n", strings.ReplaceAll(f, "\n", "\n      "))
+		}
+		fmt.Fprintf(w, "  ...\n")
+	}
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Skipped  int             `xml:"skipped,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *junitSkipped `xml:"skipped,omitempty"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Body    string `xml:",chardata"`
+}
+
+// WriteJUnit writes test results to w as JUnit XML, with one test suite
+// for each test file.
+func WriteJUnit(w io.Writer, results []TestResult) error {
+	report := junitTestSuites{}
+	suiteIndex := map[string]int{}
+	for _, r := range results {
+		idx, prs := suiteIndex[r.File]
+		if !prs {
+			idx = len(report.Suites)
+			suiteIndex[r.File] = idx
+			report.Suites = append(report.Suites, junitTestSuite{Name: r.File})
+		}
+		suite := &report.Suites[idx]
+
+		tc := junitTestCase{
+			Name:      r.Name,
+			ClassName: r.File,
+			Time:      fmt.Sprintf("%.6f", r.Duration.Seconds()),
+		}
+		if !r.Passed() {
+			tc.Failure = &junitFailure{
+				Message: strings.SplitN(r.Failures[0], "\n", 2)[0],
+				Body: fmt.Sprintf("%s:%d:%d\n%s", r.File, r.Line, r.Col,
+					strings.Join(r.Failures, "\n")),
+			}
+			suite.Failures++
+		} else if r.WasSkipped() {
+			tc.Skipped = &junitSkipped{Message: r.Skipped}
+			suite.Skipped++
+		}
+		suite.Tests++
+		suite.Cases = append(suite.Cases, tc)
+	}
+
+	for i, suite := range report.Suites {
+		var total time.Duration
+		for _, r := range results {
+			if r.File == suite.Name {
+				total += r.Duration
+			}
+		}
+		report.Suites[i].Time = fmt.Sprintf("%.6f", total.Seconds())
+	}
+
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	err = enc.Encode(report)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
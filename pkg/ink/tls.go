@@ -0,0 +1,173 @@
+package ink
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// tlsOptions are the options to listen(), req(), and wsConnect() under the
+// tls key, {cert, key, ca, insecure}. Certificates and keys may each be given
+// as a PEM string or as the path of a PEM file.
+type tlsOptions struct {
+	cert     StringValue
+	key      StringValue
+	ca       StringValue
+	insecure bool
+	// canRead is whether the Engine may read PEM files
+	canRead bool
+}
+
+// parseTLSOptions validates the tls option to the named builtin. It returns
+// nil options if the option is not given.
+func parseTLSOptions(ctx *Context, name string, opts CompositeValue) (*tlsOptions, error) {
+	tlsVal, hasTLS := opts["tls"]
+	if !hasTLS {
+		return nil, nil
+	}
+
+	tlsOpts, isComposite := tlsVal.(CompositeValue)
+	if !isComposite {
+		return nil, Err{
+			ErrRuntime,
+			fmt.Sprintf("tls option to %s() must be a composite, got %s", name, tlsVal),
+		}
+	}
+
+	options := tlsOptions{
+		canRead: ctx.Engine.Permissions.Read,
+	}
+	for k, v := range tlsOpts {
+		var ok bool
+		switch k {
+		case "cert":
+			options.cert, ok = v.(StringValue)
+		case "key":
+			options.key, ok = v.(StringValue)
+		case "ca":
+			options.ca, ok = v.(StringValue)
+		case "insecure":
+			var insecure BooleanValue
+			insecure, ok = v.(BooleanValue)
+			options.insecure = bool(insecure)
+		default:
+			return nil, Err{
+				ErrRuntime,
+				fmt.Sprintf("unknown tls option %s to %s()", k, name),
+			}
+		}
+		if !ok {
+			return nil, Err{
+				ErrRuntime,
+				fmt.Sprintf("tls option %s to %s() has the wrong type, got %s", k, name, v),
+			}
+		}
+	}
+
+	if (len(options.cert) > 0) != (len(options.key) > 0) {
+		return nil, Err{
+			ErrRuntime,
+			fmt.Sprintf("tls options to %s() must include both cert and key, or neither", name),
+		}
+	}
+
+	return &options, nil
+}
+
+// loadPEM returns PEM data given either directly or as the path of a file,
+// which is only read with permission to read files.
+func (o tlsOptions) loadPEM(s StringValue) ([]byte, error) {
+	if strings.Contains(string(s), "-----BEGIN") {
+		return []byte(s), nil
+	}
+	if !o.canRead {
+		return nil, fmt.Errorf("cannot read %s without permission to read files", string(s))
+	}
+	return ioutil.ReadFile(string(s))
+}
+
+// certificate loads the certificate and key pair, if one was given.
+func (o tlsOptions) certificate() ([]tls.Certificate, error) {
+	if len(o.cert) == 0 {
+		return nil, nil
+	}
+
+	certPEM, err := o.loadPEM(o.cert)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := o.loadPEM(o.key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return []tls.Certificate{cert}, nil
+}
+
+// certPool loads the CA bundle, if one was given.
+func (o tlsOptions) certPool() (*x509.CertPool, error) {
+	if len(o.ca) == 0 {
+		return nil, nil
+	}
+
+	caPEM, err := o.loadPEM(o.ca)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in CA bundle")
+	}
+	return pool, nil
+}
+
+// serverConfig builds the TLS configuration of a listen() server. The server
+// must have a certificate, and with a CA bundle it requires clients to
+// present certificates signed by it.
+func (o tlsOptions) serverConfig() (*tls.Config, error) {
+	if len(o.cert) == 0 {
+		return nil, fmt.Errorf("serving TLS requires a cert and key")
+	}
+
+	certs, err := o.certificate()
+	if err != nil {
+		return nil, err
+	}
+	pool, err := o.certPool()
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: certs,
+	}
+	if pool != nil {
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// clientConfig builds the TLS configuration of a req() request or a
+// wsConnect() connection. A CA bundle replaces the system's trusted roots.
+func (o tlsOptions) clientConfig() (*tls.Config, error) {
+	certs, err := o.certificate()
+	if err != nil {
+		return nil, err
+	}
+	pool, err := o.certPool()
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates:       certs,
+		RootCAs:            pool,
+		InsecureSkipVerify: o.insecure,
+	}, nil
+}
@@ -0,0 +1,139 @@
+package ink
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// traceThreadID is the thread on which Ink code runs in a trace. Ink code
+// only runs while holding the Engine's execution lock, so all spans of Ink
+// code nest on one thread.
+const traceThreadID = 1
+
+// Tracer records a timeline of an Engine's execution as spans of time for
+// each top-level expression, each callback queued by builtins like read()
+// and wait(), and the time spent waiting for the execution lock. It is used
+// by `ink -trace`, and writes traces in the Chrome trace event format, which
+// can be opened in Perfetto or chrome://tracing.
+type Tracer struct {
+	// If Calls is true, the Tracer also records a span for each call
+	// to an Ink function, which makes programs run much more slowly
+	Calls bool
+
+	lock   sync.Mutex
+	start  time.Time
+	events []traceEvent
+	// waits counts time spent waiting for the execution lock,
+	// to give each wait a unique ID
+	waits int
+}
+
+// traceEvent is a single event in the Chrome trace event format.
+type traceEvent struct {
+	Name      string                 `json:"name"`
+	Category  string                 `json:"cat,omitempty"`
+	Phase     string                 `json:"ph"`
+	Timestamp float64                `json:"ts"`
+	Duration  float64                `json:"dur,omitempty"`
+	PID       int                    `json:"pid"`
+	TID       int                    `json:"tid"`
+	ID        int                    `json:"id,omitempty"`
+	Args      map[string]interface{} `json:"args,omitempty"`
+}
+
+// NewTracer creates a Tracer, to be set as an Engine's Tracer before the
+// Engine runs a program.
+func NewTracer() *Tracer {
+	return &Tracer{
+		start:  time.Now(),
+		events: []traceEvent{},
+	}
+}
+
+// micros returns the time as microseconds since the trace started.
+func (t *Tracer) micros(at time.Time) float64 {
+	return float64(at.Sub(t.start).Nanoseconds()) / 1000
+}
+
+// span records a span of Ink code running from start until now.
+func (t *Tracer) span(category, name string, start time.Time, args map[string]interface{}) {
+	end := time.Now()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.events = append(t.events, traceEvent{
+		Name:      name,
+		Category:  category,
+		Phase:     "X",
+		Timestamp: t.micros(start),
+		Duration:  t.micros(end) - t.micros(start),
+		PID:       1,
+		TID:       traceThreadID,
+		Args:      args,
+	})
+}
+
+// wait records a span of waiting for the execution lock from start
+// until now. Many waits may overlap, so they are recorded as async
+// events, which are shown on separate tracks.
+func (t *Tracer) wait(name string, start time.Time) {
+	end := time.Now()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.waits++
+	for _, event := range []traceEvent{
+		{Phase: "b", Timestamp: t.micros(start)},
+		{Phase: "e", Timestamp: t.micros(end)},
+	} {
+		event.Name = name
+		event.Category = "wait"
+		event.PID = 1
+		event.TID = traceThreadID
+		event.ID = t.waits
+		t.events = append(t.events, event)
+	}
+}
+
+// WriteTrace writes all events recorded by the Tracer to w as JSON in the
+// Chrome trace event format.
+func (t *Tracer) WriteTrace(w io.Writer) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	events := append([]traceEvent{
+		{
+			Name:  "process_name",
+			Phase: "M",
+			PID:   1,
+			Args:  map[string]interface{}{"name": "ink"},
+		},
+		{
+			Name:  "thread_name",
+			Phase: "M",
+			PID:   1,
+			TID:   traceThreadID,
+			Args:  map[string]interface{}{"name": "eval"},
+		},
+	}, t.events...)
+
+	enc := json.NewEncoder(w)
+	return enc.Encode(map[string]interface{}{
+		"traceEvents":     events,
+		"displayTimeUnit": "ms",
+	})
+}
+
+// traceName returns the name of an expression at a position in a file,
+// for display in a trace.
+func traceName(file string, pos position) string {
+	if file == "" {
+		return fmt.Sprintf("eval [%s]", pos)
+	}
+	return fmt.Sprintf("%s:%d", relativePath(file), pos.line)
+}
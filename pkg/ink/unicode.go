@@ -0,0 +1,159 @@
+package ink
+
+//go:generate sh -c "cd ../../utils/gennorm && go run . > ../../pkg/ink/unicode_tables.go"
+
+import (
+	"sort"
+	"unicode/utf8"
+)
+
+// cccRange is a range of runes with the same canonical combining class,
+// which orders combining marks in normalized text.
+type cccRange struct {
+	lo, hi rune
+	ccc    uint8
+}
+
+// Hangul syllables are composed of leading consonants, vowels, and optional
+// trailing consonants, and are decomposed and composed arithmetically.
+const (
+	hangulBase   = 0xAC00
+	hangulLBase  = 0x1100
+	hangulVBase  = 0x1161
+	hangulTBase  = 0x11A7
+	hangulLCount = 19
+	hangulVCount = 21
+	hangulTCount = 28
+	hangulNCount = hangulVCount * hangulTCount
+	hangulSCount = hangulLCount * hangulNCount
+)
+
+// combiningClass returns the canonical combining class of a rune,
+// which is 0 for starters.
+func combiningClass(r rune) uint8 {
+	i := sort.Search(len(cccRanges), func(i int) bool {
+		return cccRanges[i].hi >= r
+	})
+	if i < len(cccRanges) && cccRanges[i].lo <= r {
+		return cccRanges[i].ccc
+	}
+	return 0
+}
+
+// normRune is a rune in text being normalized. Bytes that are not valid
+// UTF-8 are kept as they are, as starters that never compose.
+type normRune struct {
+	r       rune
+	invalid byte
+	ccc     uint8
+}
+
+// decompose returns the canonical decomposition of s, in canonical order.
+func decompose(s []byte) []normRune {
+	runes := make([]normRune, 0, len(s))
+	for len(s) > 0 {
+		r, size := utf8.DecodeRune(s)
+		if r == utf8.RuneError && size == 1 {
+			runes = append(runes, normRune{invalid: s[0]})
+			s = s[1:]
+			continue
+		}
+		s = s[size:]
+
+		if idx := r - hangulBase; idx >= 0 && idx < hangulSCount {
+			runes = append(runes,
+				normRune{r: hangulLBase + idx/hangulNCount},
+				normRune{r: hangulVBase + (idx%hangulNCount)/hangulTCount},
+			)
+			if t := idx % hangulTCount; t != 0 {
+				runes = append(runes, normRune{r: hangulTBase + t})
+			}
+		} else if d, ok := decompositions[r]; ok {
+			for _, dr := range d {
+				runes = append(runes, normRune{r: dr, ccc: combiningClass(dr)})
+			}
+		} else {
+			runes = append(runes, normRune{r: r, ccc: combiningClass(r)})
+		}
+	}
+
+	// sort each run of combining marks by combining class, keeping marks
+	// of the same class in order
+	for i := 1; i < len(runes); i++ {
+		for j := i; j > 0 && runes[j].ccc != 0 && runes[j-1].ccc > runes[j].ccc; j-- {
+			runes[j], runes[j-1] = runes[j-1], runes[j]
+		}
+	}
+	return runes
+}
+
+// compose composes canonically decomposed runes into primary composites.
+func compose(runes []normRune) []normRune {
+	composed := runes[:0]
+	// starter is the index in composed of the last starter that
+	// following runes may compose with, or -1 if there is none
+	starter := -1
+	for _, nr := range runes {
+		if starter >= 0 && nr.invalid == 0 {
+			last := composed[len(composed)-1]
+			blocked := len(composed)-1 > starter &&
+				(last.ccc == 0 || last.ccc >= nr.ccc)
+			if !blocked {
+				if r, ok := composePair(composed[starter].r, nr.r); ok {
+					composed[starter].r = r
+					continue
+				}
+			}
+		}
+
+		if nr.ccc == 0 {
+			starter = len(composed)
+			if nr.invalid != 0 {
+				starter = -1
+			}
+		}
+		composed = append(composed, nr)
+	}
+	return composed
+}
+
+func composePair(a, b rune) (rune, bool) {
+	// Hangul LV and LVT syllables
+	if l := a - hangulLBase; l >= 0 && l < hangulLCount {
+		if v := b - hangulVBase; v >= 0 && v < hangulVCount {
+			return hangulBase + (l*hangulVCount+v)*hangulTCount, true
+		}
+	}
+	if s := a - hangulBase; s >= 0 && s < hangulSCount && s%hangulTCount == 0 {
+		if t := b - hangulTBase; t > 0 && t < hangulTCount {
+			return a + t, true
+		}
+	}
+
+	r, ok := compositions[[2]rune{a, b}]
+	return r, ok
+}
+
+func encodeNormRunes(runes []normRune) []byte {
+	s := make([]byte, 0, len(runes))
+	for _, nr := range runes {
+		if nr.invalid != 0 {
+			s = append(s, nr.invalid)
+		} else {
+			s = append(s, string(nr.r)...)
+		}
+	}
+	return s
+}
+
+// normalizeNFD returns s in Unicode Normalization Form D, canonical
+// decomposition. Invalid UTF-8 bytes are kept as they are.
+func normalizeNFD(s []byte) []byte {
+	return encodeNormRunes(decompose(s))
+}
+
+// normalizeNFC returns s in Unicode Normalization Form C, canonical
+// decomposition followed by canonical composition.
+func normalizeNFC(s []byte) []byte {
+	return encodeNormRunes(compose(decompose(s)))
+}
@@ -0,0 +1,418 @@
+package ink
+
+import (
+	"fmt"
+	"sort"
+)
+
+// VetRule is a check for a common mistake in Ink programs that is valid
+// Ink, but probably does not do what the programmer intended.
+type VetRule struct {
+	// ID is a short, stable name for the rule, used to enable
+	// and disable rules and printed alongside each report
+	ID          string
+	Description string
+}
+
+// VetRules are all rules checked by Vet.
+var VetRules = []VetRule{
+	{
+		ID:          "shadow",
+		Description: "assignment in a nested expression list that shadows an outer variable, rather than changing it",
+	},
+	{
+		ID:          "unreachable",
+		Description: "match clauses following a catch-all _ clause, which can never match",
+	},
+	{
+		ID:          "unused",
+		Description: "variables in a function or expression list that are bound but never used",
+	},
+	{
+		ID:          "arity",
+		Description: "calls to builtin functions with the wrong number of arguments",
+	},
+	{
+		ID:          "short-circuit",
+		Description: "& and | used as if they short-circuit, though both operands are always evaluated",
+	},
+}
+
+// vetBinding is a variable bound with := in some vetScope
+type vetBinding struct {
+	node IdentifierNode
+	used bool
+}
+
+// vetRef is a reference to a variable, which is resolved to a binding
+// when the scope containing it has been fully walked.
+type vetRef struct {
+	name string
+	// call is the function call of which the name is the callee,
+	// or nil if the name is not called
+	call *FunctionCallNode
+}
+
+// vetScope mirrors a StackFrame that the program will have at runtime.
+type vetScope struct {
+	parent   *vetScope
+	bindings map[string]*vetBinding
+	refs     []vetRef
+	// params are the arguments of a function,
+	// which are not reported if unused
+	params map[string]bool
+	// nested is true if the scope is an expression list
+	// that is not the body of a function
+	nested bool
+}
+
+func newVetScope(parent *vetScope) *vetScope {
+	return &vetScope{
+		parent:   parent,
+		bindings: map[string]*vetBinding{},
+		params:   map[string]bool{},
+	}
+}
+
+func (s *vetScope) isBound(name string) bool {
+	for ; s != nil; s = s.parent {
+		if _, ok := s.bindings[name]; ok {
+			return true
+		}
+		if s.params[name] {
+			return true
+		}
+	}
+	return false
+}
+
+type vetter struct {
+	disabled    map[string]bool
+	diagnostics []Diagnostic
+}
+
+func (v *vetter) reportf(rule string, n Node, format string, args ...interface{}) {
+	if v.disabled[rule] {
+		return
+	}
+
+	pos := n.Position()
+	v.diagnostics = append(v.diagnostics, Diagnostic{
+		Reason:  ErrVet,
+		Message: fmt.Sprintf("%s: ", rule) + fmt.Sprintf(format, args...) + fmt.Sprintf(" [%s]", pos),
+		Rule:    rule,
+		Line:    pos.line,
+		Col:     pos.col,
+	})
+}
+
+// Vet walks a parsed Ink program and reports likely mistakes according to
+// VetRules, except rules whose IDs are in disabled.
+func Vet(nodes []Node, disabled map[string]bool) []Diagnostic {
+	v := vetter{disabled: disabled}
+
+	// the top level scope of a program is exported when it is loaded
+	// by another program, so its bindings are never unused
+	top := newVetScope(nil)
+	v.walkExprs(nodes, top)
+	v.close(top, true)
+
+	sort.SliceStable(v.diagnostics, func(i, j int) bool {
+		a, b := v.diagnostics[i], v.diagnostics[j]
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Col < b.Col
+	})
+	return v.diagnostics
+}
+
+// walkExprs walks a list of expressions evaluated in order in one scope,
+// of which all but the last have their values discarded.
+func (v *vetter) walkExprs(exprs []Node, scope *vetScope) {
+	for i, expr := range exprs {
+		if i < len(exprs)-1 {
+			v.checkConditionalCall(expr)
+		}
+		v.walk(expr, scope)
+	}
+}
+
+// close resolves all references in a scope that has been fully walked,
+// and passes references to names not bound in it to its parent.
+func (v *vetter) close(scope *vetScope, top bool) {
+	for _, ref := range scope.refs {
+		if b, ok := scope.bindings[ref.name]; ok {
+			b.used = true
+		} else if scope.params[ref.name] {
+			continue
+		} else if scope.parent != nil {
+			scope.parent.refs = append(scope.parent.refs, ref)
+		} else if ref.call != nil {
+			v.checkArity(ref.name, *ref.call)
+		}
+	}
+
+	if top {
+		return
+	}
+	for name, b := range scope.bindings {
+		if !b.used {
+			v.reportf("unused", b.node, "%s is bound but never used", name)
+		}
+	}
+}
+
+func (v *vetter) checkArity(name string, call FunctionCallNode) {
+	t, ok := builtinTypes[name]
+	if !ok || t.sig == nil {
+		return
+	}
+
+	max, got := len(t.sig.params), len(call.arguments)
+	min := max - t.sig.optional
+	if got < min || got > max {
+		want := fmt.Sprintf("%d to %d arguments", min, max)
+		if min == max {
+			want = plural(max, "argument")
+		}
+		v.reportf("arity", call, "%s() takes %s, but is called with %d",
+			name, want, got)
+	}
+}
+
+// plural formats a count of things, like "1 argument" or "2 arguments".
+func plural(n int, noun string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, noun)
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+// checkConditionalCall reports an expression whose value is discarded, like
+// `ok & doThing()`, that is written as if the right operand of & or | only
+// runs depending on the left operand.
+func (v *vetter) checkConditionalCall(n Node) {
+	bin, ok := n.(BinaryExprNode)
+	if !ok || (bin.operator != LogicalAndOp && bin.operator != LogicalOrOp) {
+		return
+	}
+
+	if call, isCall := bin.rightOperand.(FunctionCallNode); isCall {
+		callee := "the function on the right"
+		if name := profileName(call.function); name != "" {
+			callee = name + "()"
+		}
+		v.reportf("short-circuit", bin, "%s is always called, regardless of the left operand of %s",
+			callee, bin.operator)
+	}
+}
+
+// checkNullGuard reports an expression like `x = () | x.y = 1`, which
+// accesses a value that the left operand checks against (), as if the
+// right operand only runs depending on the left operand.
+func (v *vetter) checkNullGuard(n BinaryExprNode) {
+	for _, name := range nullChecked(n.leftOperand) {
+		if usesAsValue(n.rightOperand, name) {
+			v.reportf("short-circuit", n, "right operand of %s uses %s even if %s is ()",
+				n.operator, name, name)
+			return
+		}
+	}
+}
+
+func isNullLiteral(n Node) bool {
+	list, ok := n.(ExpressionListNode)
+	return ok && len(list.expressions) == 0
+}
+
+// nullChecked returns the names of variables that are compared to ()
+// in a logical expression.
+func nullChecked(n Node) []string {
+	switch n := n.(type) {
+	case UnaryExprNode:
+		return nullChecked(n.operand)
+	case BinaryExprNode:
+		switch n.operator {
+		case EqualOp:
+			if ident, ok := n.leftOperand.(IdentifierNode); ok && isNullLiteral(n.rightOperand) {
+				return []string{ident.val}
+			}
+			if ident, ok := n.rightOperand.(IdentifierNode); ok && isNullLiteral(n.leftOperand) {
+				return []string{ident.val}
+			}
+		case LogicalAndOp, LogicalOrOp:
+			return append(nullChecked(n.leftOperand), nullChecked(n.rightOperand)...)
+		}
+	}
+	return nil
+}
+
+// usesAsValue reports whether an expression accesses a property of or
+// calls the variable of the given name, which fails if it is ().
+func usesAsValue(n Node, name string) bool {
+	switch n := n.(type) {
+	case BinaryExprNode:
+		if n.operator == AccessorOp {
+			if ident, ok := n.leftOperand.(IdentifierNode); ok && ident.val == name {
+				return true
+			}
+		}
+	case FunctionCallNode:
+		if ident, ok := n.function.(IdentifierNode); ok && ident.val == name {
+			return true
+		}
+	case FunctionLiteralNode:
+		// function bodies are not evaluated with the expression
+		return false
+	}
+
+	for _, child := range childNodes(n) {
+		if usesAsValue(child, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// childNodes returns the nodes directly contained in a node, in order.
+func childNodes(node Node) []Node {
+	switch n := node.(type) {
+	case UnaryExprNode:
+		return []Node{n.operand}
+	case BinaryExprNode:
+		return []Node{n.leftOperand, n.rightOperand}
+	case FunctionCallNode:
+		return append([]Node{n.function}, n.arguments...)
+	case MatchClauseNode:
+		return []Node{n.target, n.expression}
+	case MatchExprNode:
+		children := []Node{n.condition}
+		for _, cl := range n.clauses {
+			children = append(children, cl)
+		}
+		return children
+	case ExpressionListNode:
+		return n.expressions
+	case ObjectLiteralNode:
+		children := make([]Node, 0, len(n.entries)*2)
+		for _, entry := range n.entries {
+			children = append(children, entry.key, entry.val)
+		}
+		return children
+	case ListLiteralNode:
+		return n.vals
+	case FunctionLiteralNode:
+		return append(append([]Node{}, n.arguments...), n.body)
+	default:
+		return nil
+	}
+}
+
+func (v *vetter) walk(node Node, scope *vetScope) {
+	switch n := node.(type) {
+	case IdentifierNode:
+		scope.refs = append(scope.refs, vetRef{name: n.val})
+	case UnaryExprNode:
+		v.walk(n.operand, scope)
+	case BinaryExprNode:
+		v.walkBinaryExpr(n, scope)
+	case FunctionCallNode:
+		if ident, ok := n.function.(IdentifierNode); ok {
+			call := n
+			scope.refs = append(scope.refs, vetRef{name: ident.val, call: &call})
+		} else {
+			v.walk(n.function, scope)
+		}
+		for _, arg := range n.arguments {
+			v.walk(arg, scope)
+		}
+	case MatchExprNode:
+		v.walk(n.condition, scope)
+
+		caughtAll := false
+		for _, cl := range n.clauses {
+			if caughtAll {
+				v.reportf("unreachable", cl, "match clause after a catch-all _ clause can never match")
+			}
+			if _, isEmpty := cl.target.(EmptyIdentifierNode); isEmpty {
+				caughtAll = true
+			}
+
+			v.walk(cl.target, scope)
+			v.walk(cl.expression, scope)
+		}
+	case ExpressionListNode:
+		if len(n.expressions) == 0 {
+			return
+		}
+
+		blockScope := newVetScope(scope)
+		blockScope.nested = true
+		v.walkExprs(n.expressions, blockScope)
+		v.close(blockScope, false)
+	case ObjectLiteralNode:
+		for _, entry := range n.entries {
+			// identifier keys are names, not references
+			if _, isIdent := entry.key.(IdentifierNode); !isIdent {
+				v.walk(entry.key, scope)
+			}
+			v.walk(entry.val, scope)
+		}
+	case ListLiteralNode:
+		for _, val := range n.vals {
+			v.walk(val, scope)
+		}
+	case FunctionLiteralNode:
+		fnScope := newVetScope(scope)
+		for _, arg := range n.arguments {
+			if ident, isIdent := arg.(IdentifierNode); isIdent {
+				fnScope.params[ident.val] = true
+			}
+		}
+
+		// the body of a function is the function's own scope,
+		// so assignments in it do not shadow by mistake
+		if body, isList := n.body.(ExpressionListNode); isList {
+			v.walkExprs(body.expressions, fnScope)
+		} else {
+			v.walk(n.body, fnScope)
+		}
+		v.close(fnScope, false)
+	}
+}
+
+func (v *vetter) walkBinaryExpr(n BinaryExprNode, scope *vetScope) {
+	switch n.operator {
+	case DefineOp:
+		leftIdent, isIdent := n.leftOperand.(IdentifierNode)
+		if !isIdent {
+			v.walk(n.leftOperand, scope)
+			v.walk(n.rightOperand, scope)
+			return
+		}
+
+		v.walk(n.rightOperand, scope)
+		if _, ok := scope.bindings[leftIdent.val]; ok {
+			return
+		}
+		if scope.nested && scope.parent.isBound(leftIdent.val) {
+			v.reportf("shadow", n, "%s := declares a new variable in this expression list, "+
+				"shadowing %s in an outer scope", leftIdent.val, leftIdent.val)
+		}
+		scope.bindings[leftIdent.val] = &vetBinding{node: leftIdent}
+	case AccessorOp:
+		v.walk(n.leftOperand, scope)
+		// identifier property names are names, not references
+		if _, isIdent := n.rightOperand.(IdentifierNode); !isIdent {
+			v.walk(n.rightOperand, scope)
+		}
+	case LogicalAndOp, LogicalOrOp:
+		v.checkNullGuard(n)
+		v.walk(n.leftOperand, scope)
+		v.walk(n.rightOperand, scope)
+	default:
+		v.walk(n.leftOperand, scope)
+		v.walk(n.rightOperand, scope)
+	}
+}
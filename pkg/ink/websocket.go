@@ -0,0 +1,631 @@
+package ink
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// WebSocket opcodes and close codes, from RFC 6455
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+
+	wsCloseNormal      = 1000
+	wsCloseProtocol    = 1002
+	wsCloseNoStatus    = 1005
+	wsCloseAbnormal    = 1006
+	wsCloseInvalidData = 1007
+	wsCloseTooBig      = 1009
+)
+
+// wsValidCloseCode reports whether code may be sent in a close frame. Codes
+// from 3000 to 4999 are for libraries and applications, and the rest are
+// defined by RFC 6455 or registered with IANA. 1005, 1006, and 1015 are
+// only reported locally, and are never sent.
+func wsValidCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	default:
+		return code >= 3000 && code <= 4999
+	}
+}
+
+// wsGUID is appended to a client's key to compute the server's accept key
+// in the opening handshake.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// wsMaxMessage is the largest message, in bytes, that will be received.
+const wsMaxMessage = 32 << 20
+
+// wsCloseTimeout is how long to wait for the other end to answer a close
+// frame before closing the connection anyway.
+const wsCloseTimeout = 5 * time.Second
+
+// wsCloseError is returned when reading from a WebSocket connection that
+// has been closed, with the code and reason given by the other end.
+type wsCloseError struct {
+	code   int
+	reason string
+}
+
+func (e wsCloseError) Error() string {
+	return fmt.Sprintf("websocket closed with code %d %s", e.code, e.reason)
+}
+
+// wsConn is one end of a WebSocket connection, which reads and writes
+// frames over a network connection after the opening handshake.
+type wsConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+	// client connections mask the frames they send, and server
+	// connections require received frames to be masked
+	client bool
+
+	writeMu   sync.Mutex
+	closeSent bool
+}
+
+func wsAcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerContains reports whether a comma-separated header has a token,
+// ignoring case.
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsUpgrade completes the server side of the opening handshake of a request
+// to upgrade to a WebSocket, and takes over its connection.
+func wsUpgrade(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != "GET" ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" ||
+		key == "" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return nil, errors.New("request is not a websocket handshake")
+	}
+
+	hijacker, canHijack := w.(http.Hijacker)
+	if !canHijack {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return nil, errors.New("connection does not support websockets")
+	}
+	conn, bufrw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", wsAcceptKey(key))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &wsConn{
+		conn: conn,
+		br:   bufrw.Reader,
+	}, nil
+}
+
+// wsDial opens a client WebSocket connection to a ws:// or wss:// URL.
+// wss:// connections use config, or the default TLS configuration if it
+// is nil.
+func wsDial(rawURL string, header http.Header, config *tls.Config) (*wsConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		switch u.Scheme {
+		case "ws":
+			host = net.JoinHostPort(u.Hostname(), "80")
+		case "wss":
+			host = net.JoinHostPort(u.Hostname(), "443")
+		}
+	}
+
+	var conn net.Conn
+	switch u.Scheme {
+	case "ws":
+		conn, err = net.Dial("tcp", host)
+	case "wss":
+		if config == nil {
+			config = &tls.Config{}
+		} else {
+			config = config.Clone()
+		}
+		config.ServerName = u.Hostname()
+		conn, err = tls.Dial("tcp", host, config)
+	default:
+		return nil, fmt.Errorf("unsupported websocket URL scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keyBytes := make([]byte, 16)
+	if _, err := rand.Read(keyBytes); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(keyBytes)
+
+	req := &http.Request{
+		Method:     "GET",
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Host:       u.Host,
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		resp.Header.Get("Sec-WebSocket-Accept") != wsAcceptKey(key) {
+		conn.Close()
+		return nil, fmt.Errorf("server refused websocket handshake with status %s", resp.Status)
+	}
+
+	return &wsConn{
+		conn:   conn,
+		br:     br,
+		client: true,
+	}, nil
+}
+
+// writeFrame writes a single, final frame.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closeSent {
+		return errors.New("websocket is closed")
+	}
+	if opcode == wsClose {
+		c.closeSent = true
+	}
+
+	frame := []byte{0x80 | opcode}
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, maskBit|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, maskBit|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(n))
+	default:
+		frame = append(frame, maskBit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(n))
+	}
+
+	if c.client {
+		mask := make([]byte, 4)
+		if _, err := rand.Read(mask); err != nil {
+			return err
+		}
+		frame = append(frame, mask...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := range frame[start:] {
+			frame[start+i] ^= mask[i%4]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// writeClose starts the closing handshake, or answers the other end's
+// close frame.
+func (c *wsConn) writeClose(code int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+
+	err := c.writeFrame(wsClose, payload)
+	c.conn.SetReadDeadline(time.Now().Add(wsCloseTimeout))
+	return err
+}
+
+// readFrame reads a single frame, unmasking its payload.
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	head := make([]byte, 2)
+	if _, err = io.ReadFull(c.br, head); err != nil {
+		return
+	}
+	fin = head[0]&0x80 != 0
+	opcode = head[0] & 0x0f
+	masked := head[1]&0x80 != 0
+
+	if head[0]&0x70 != 0 {
+		err = wsCloseError{wsCloseProtocol, "reserved bits set"}
+		return
+	}
+	if masked == c.client {
+		err = wsCloseError{wsCloseProtocol, "wrong frame masking"}
+		return
+	}
+
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err = io.ReadFull(c.br, ext); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err = io.ReadFull(c.br, ext); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext)
+	}
+	if length > wsMaxMessage {
+		err = wsCloseError{wsCloseTooBig, "message too big"}
+		return
+	}
+	// control frames may not be fragmented, and have short payloads
+	// that fit in the first byte of the length
+	if opcode&0x8 != 0 {
+		if !fin {
+			err = wsCloseError{wsCloseProtocol, "fragmented control frame"}
+			return
+		}
+		if length > 125 {
+			err = wsCloseError{wsCloseProtocol, "control frame too long"}
+			return
+		}
+	}
+
+	var mask []byte
+	if masked {
+		mask = make([]byte, 4)
+		if _, err = io.ReadFull(c.br, mask); err != nil {
+			return
+		}
+	}
+
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return
+	}
+	for i := range mask {
+		for j := i; j < len(payload); j += 4 {
+			payload[j] ^= mask[i]
+		}
+	}
+	return
+}
+
+// readMessage reads the next text or binary message, putting together
+// fragmented messages and answering pings. When the other end closes the
+// connection, it returns a wsCloseError.
+func (c *wsConn) readMessage() ([]byte, error) {
+	var message []byte
+	var messageOpcode byte
+	fragmented := false
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case wsPing:
+			c.writeFrame(wsPong, payload)
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			closeErr := wsCloseError{code: wsCloseNoStatus}
+			if len(payload) == 1 {
+				return nil, wsCloseError{wsCloseProtocol, "close frame too short"}
+			}
+			if len(payload) >= 2 {
+				closeErr.code = int(binary.BigEndian.Uint16(payload))
+				closeErr.reason = string(payload[2:])
+				if !wsValidCloseCode(closeErr.code) {
+					return nil, wsCloseError{wsCloseProtocol, "invalid close code"}
+				}
+				if !utf8.Valid(payload[2:]) {
+					return nil, wsCloseError{wsCloseInvalidData, "invalid UTF-8 in close reason"}
+				}
+			}
+			return nil, closeErr
+		case wsText, wsBinary:
+			if fragmented {
+				return nil, wsCloseError{wsCloseProtocol, "expected continuation frame"}
+			}
+			message = payload
+			messageOpcode = opcode
+		case wsContinuation:
+			if !fragmented {
+				return nil, wsCloseError{wsCloseProtocol, "unexpected continuation frame"}
+			}
+			if len(message)+len(payload) > wsMaxMessage {
+				return nil, wsCloseError{wsCloseTooBig, "message too big"}
+			}
+			message = append(message, payload...)
+		default:
+			return nil, wsCloseError{wsCloseProtocol, "unknown opcode"}
+		}
+
+		if fin {
+			if messageOpcode == wsText && !utf8.Valid(message) {
+				return nil, wsCloseError{wsCloseInvalidData, "invalid UTF-8 in text message"}
+			}
+			return message, nil
+		}
+		fragmented = true
+	}
+}
+
+// wsControls returns the {send, close} functions of a WebSocket for Ink.
+// They may be called before the connection is open, in which case they take
+// effect once it is. conn receives the connection when it is open, or nil if
+// it could not be opened.
+func wsControls(ctx *Context, name string, conn <-chan *wsConn) CompositeValue {
+	// sends happen in the order they were called, in the background
+	sends := serialQueue{}
+	var ws *wsConn
+	opened := false
+	open := func() *wsConn {
+		if !opened {
+			ws = <-conn
+			opened = true
+		}
+		return ws
+	}
+
+	return CompositeValue{
+		"send": NativeFunctionValue{
+			name: "send",
+			exec: func(ctx *Context, in []Value) (Value, error) {
+				if len(in) < 1 {
+					return nil, Err{
+						ErrRuntime,
+						fmt.Sprintf("send() callback to %s() takes 1 argument", name),
+					}
+				}
+				data, isString := in[0].(StringValue)
+				if !isString {
+					return nil, Err{
+						ErrRuntime,
+						fmt.Sprintf("send() callback to %s() takes a string, got %s", name, in[0]),
+					}
+				}
+				// copied, since strings are mutable
+				data = append(StringValue{}, data...)
+
+				ctx.Engine.Listeners.Add(1)
+				sends.queue(func() {
+					defer ctx.Engine.Listeners.Done()
+
+					if ws := open(); ws != nil {
+						opcode := byte(wsText)
+						if !utf8.Valid(data) {
+							opcode = wsBinary
+						}
+						// errors sending are reported when reading
+						// from the closed connection
+						ws.writeFrame(opcode, data)
+					}
+				})
+				return Null, nil
+			},
+			ctx: ctx,
+		},
+		"close": NativeFunctionValue{
+			name: "close",
+			exec: func(ctx *Context, in []Value) (Value, error) {
+				code := NumberValue(wsCloseNormal)
+				reason := StringValue{}
+				if len(in) > 0 {
+					c, isNumber := in[0].(NumberValue)
+					if !isNumber || c != NumberValue(int(c)) || !wsValidCloseCode(int(c)) {
+						return nil, Err{
+							ErrRuntime,
+							fmt.Sprintf("close() callback to %s() takes a close code that can be sent, got %s", name, in[0]),
+						}
+					}
+					code = c
+				}
+				if len(in) > 1 {
+					r, isString := in[1].(StringValue)
+					if !isString || len(r) > 123 {
+						return nil, Err{
+							ErrRuntime,
+							fmt.Sprintf("close() callback to %s() takes a reason of at most 123 bytes, got %s", name, in[1]),
+						}
+					}
+					reason = r
+				}
+
+				ctx.Engine.Listeners.Add(1)
+				sends.queue(func() {
+					defer ctx.Engine.Listeners.Done()
+
+					if ws := open(); ws != nil {
+						ws.writeClose(int(code), string(reason))
+					}
+				})
+				return Null, nil
+			},
+			ctx: ctx,
+		},
+	}
+}
+
+// wsServe delivers events from an open WebSocket connection to cb until the
+// connection closes: {type: 'open'}, then {type: 'message', data} for each
+// message, then {type: 'close', code, reason}.
+func wsServe(ctx *Context, name string, ws *wsConn, cb FunctionValue) {
+	send := func(event Value) {
+		ctx.ExecListenerAndWait(func() {
+			_, err := evalInkFunction(cb, false, event)
+			if err != nil {
+				ctx.LogErr(Err{
+					ErrRuntime,
+					fmt.Sprintf("error in callback to %s(), %s", name, err.Error()),
+				})
+			}
+		})
+	}
+
+	send(CompositeValue{
+		"type": StringValue("open"),
+	})
+	for {
+		message, err := ws.readMessage()
+		if err == nil {
+			send(CompositeValue{
+				"type": StringValue("message"),
+				"data": StringValue(message),
+			})
+			continue
+		}
+
+		closeErr, isCloseErr := err.(wsCloseError)
+		if !isCloseErr {
+			closeErr = wsCloseError{wsCloseAbnormal, err.Error()}
+		}
+		// answer a close frame, or report a protocol error, to the other
+		// end, if we have not already started closing. Codes for missing
+		// or abnormal closes are never sent.
+		replyCode := closeErr.code
+		if replyCode == wsCloseNoStatus || replyCode == wsCloseAbnormal {
+			replyCode = wsCloseNormal
+		}
+		ws.writeClose(replyCode, "")
+		ws.conn.Close()
+
+		send(CompositeValue{
+			"type":   StringValue("close"),
+			"code":   NumberValue(closeErr.code),
+			"reason": StringValue(closeErr.reason),
+		})
+		return
+	}
+}
+
+// wsUpgradeFn returns the upgrade() function given to listen() handlers,
+// which upgrades the request to a WebSocket connection, and calls upgraded
+// once the request has been handled. It sets called, so that the handler's
+// other functions can refuse to respond after upgrade(), and refuses to
+// upgrade once responded reports that a response has started.
+func wsUpgradeFn(w http.ResponseWriter, r *http.Request, called *bool, responded func() bool, upgraded func()) func(*Context, []Value) (Value, error) {
+	return func(ctx *Context, in []Value) (Value, error) {
+		if len(in) < 1 {
+			return nil, Err{
+				ErrRuntime,
+				"upgrade() callback to listen() takes 1 argument",
+			}
+		}
+		cb, isCbFunction := in[0].(FunctionValue)
+		if !isCbFunction {
+			return nil, Err{
+				ErrRuntime,
+				fmt.Sprintf("upgrade() callback to listen() takes a callback, got %s", in[0]),
+			}
+		}
+		if *called {
+			return nil, Err{
+				ErrRuntime,
+				"upgrade() callback to listen() was called more than once",
+			}
+		}
+		if responded() {
+			return nil, Err{
+				ErrRuntime,
+				"upgrade() callback to listen() was called after the response started",
+			}
+		}
+		*called = true
+
+		conn := make(chan *wsConn, 1)
+		ctx.Engine.Listeners.Add(1)
+		go func() {
+			defer ctx.Engine.Listeners.Done()
+
+			ws, err := wsUpgrade(w, r)
+			upgraded()
+			conn <- ws
+			if err != nil {
+				ctx.ExecListener(func() {
+					_, err := evalInkFunction(cb, false, errMsg(
+						fmt.Sprintf("error upgrading to websocket in listen(), %s", err.Error()),
+					))
+					if err != nil {
+						ctx.LogErr(Err{
+							ErrRuntime,
+							fmt.Sprintf("error in callback to listen(), %s", err.Error()),
+						})
+					}
+				})
+				return
+			}
+
+			wsServe(ctx, "listen", ws, cb)
+		}()
+
+		return wsControls(ctx, "listen", conn), nil
+	}
+}
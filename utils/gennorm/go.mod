@@ -0,0 +1,5 @@
+module github.com/thesephist/ink/utils/gennorm
+
+go 1.18
+
+require golang.org/x/text v0.22.0
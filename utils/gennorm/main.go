@@ -0,0 +1,126 @@
+// Command gennorm generates the Unicode normalization tables used by the
+// nfc() and nfd() builtins in pkg/ink, from golang.org/x/text/unicode/norm,
+// and the simple case folding table used by fold(), from
+// golang.org/x/text/cases.
+// It lives in its own module so that the interpreter itself does not depend
+// on golang.org/x/text. Run it with go generate in pkg/ink.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Hangul syllables are decomposed and composed algorithmically
+const (
+	hangulBase = 0xAC00
+	hangulEnd  = 0xD7A4
+)
+
+func main() {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by utils/gennorm from Unicode %s. DO NOT EDIT.\n\n", norm.Version)
+	fmt.Fprintf(&buf, "package ink\n\n")
+
+	type cccRange struct {
+		lo, hi rune
+		ccc    uint8
+	}
+	ranges := []cccRange{}
+	decomps := [][2]interface{}{}
+	type pair struct {
+		a, b, r rune
+	}
+	pairs := []pair{}
+	folds := [][2]rune{}
+	folder := cases.Fold()
+
+	for r := rune(0); r <= utf8.MaxRune; r++ {
+		if !utf8.ValidRune(r) || (r >= hangulBase && r < hangulEnd) {
+			continue
+		}
+		s := string(r)
+
+		// simple case folding maps each rune to a single rune. Where the
+		// full folding of a rune is a single rune, the two are the same.
+		// Otherwise the simple folding is the lowercase rune, if it has the
+		// same full folding, as with U+1E9E and U+00DF.
+		full := []rune(folder.String(s))
+		if len(full) == 1 && full[0] != r {
+			folds = append(folds, [2]rune{r, full[0]})
+		} else if lower := unicode.ToLower(r); len(full) > 1 && lower != r &&
+			folder.String(string(lower)) == string(full) {
+			folds = append(folds, [2]rune{r, lower})
+		}
+
+		if ccc := norm.NFD.PropertiesString(s).CCC(); ccc != 0 {
+			last := len(ranges) - 1
+			if last >= 0 && ranges[last].hi == r-1 && ranges[last].ccc == ccc {
+				ranges[last].hi = r
+			} else {
+				ranges = append(ranges, cccRange{r, r, ccc})
+			}
+		}
+
+		d := norm.NFD.String(s)
+		if d == s {
+			continue
+		}
+		decomps = append(decomps, [2]interface{}{r, d})
+
+		// primary composites compose from the composition of all but the
+		// last rune of their decomposition, and the last rune
+		if norm.NFC.String(d) != s {
+			continue
+		}
+		runes := []rune(d)
+		first := []rune(norm.NFC.String(string(runes[:len(runes)-1])))
+		last := runes[len(runes)-1]
+		if len(first) != 1 || norm.NFC.String(string([]rune{first[0], last})) != s {
+			log.Fatalf("could not find the composition pair of %U", r)
+		}
+		pairs = append(pairs, pair{first[0], last, r})
+	}
+
+	fmt.Fprintf(&buf, "// cccRanges are the ranges of runes with a non-zero canonical combining class\n")
+	fmt.Fprintf(&buf, "var cccRanges = []cccRange{\n")
+	for _, r := range ranges {
+		fmt.Fprintf(&buf, "{0x%04X, 0x%04X, %d},\n", r.lo, r.hi, r.ccc)
+	}
+	fmt.Fprintf(&buf, "}\n\n")
+
+	fmt.Fprintf(&buf, "// decompositions are the full canonical decompositions of runes\n")
+	fmt.Fprintf(&buf, "var decompositions = map[rune]string{\n")
+	for _, d := range decomps {
+		fmt.Fprintf(&buf, "0x%04X: %+q,\n", d[0], d[1])
+	}
+	fmt.Fprintf(&buf, "}\n\n")
+
+	fmt.Fprintf(&buf, "// compositions are the pairs of runes that compose to a primary composite\n")
+	fmt.Fprintf(&buf, "var compositions = map[[2]rune]rune{\n")
+	for _, p := range pairs {
+		fmt.Fprintf(&buf, "{0x%04X, 0x%04X}: 0x%04X,\n", p.a, p.b, p.r)
+	}
+	fmt.Fprintf(&buf, "}\n\n")
+
+	fmt.Fprintf(&buf, "// caseFolds are the simple case foldings of runes that do not fold to themselves\n")
+	fmt.Fprintf(&buf, "var caseFolds = map[rune]rune{\n")
+	for _, f := range folds {
+		fmt.Fprintf(&buf, "0x%04X: 0x%04X,\n", f[0], f[1])
+	}
+	fmt.Fprintf(&buf, "}\n")
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Stdout.Write(src)
+}